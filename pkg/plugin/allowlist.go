@@ -0,0 +1,279 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+)
+
+const (
+	// defaultBucket and requiredBucket are the buckets checked against the allowlist for
+	// queries without a bucket, which read both default buckets of the project
+	defaultBucket  = "global/buckets/_Default"
+	requiredBucket = "global/buckets/_Required"
+	// defaultView is the view checked against the allowlist for queries without a view
+	defaultView = "_AllLogs"
+	// logScopesCacheTTL is how long the log scopes checked against the allowlist are reused
+	logScopesCacheTTL = time.Minute
+	// maxLogScopesCacheEntries is the number of projects whose log scopes are kept
+	maxLogScopesCacheEntries = 100
+)
+
+// allowlistConfig is the projects, buckets and views the data source may read, as exact
+// names or glob patterns. An empty list allows everything
+type allowlistConfig struct {
+	Projects []string `json:"projects"`
+	// Buckets are bucket IDs with their location, such as global/buckets/my-bucket
+	Buckets []string `json:"buckets"`
+	Views   []string `json:"views"`
+}
+
+// allowlist restricts the projects, buckets and views queried through the data source
+type allowlist struct {
+	projects []string
+	buckets  []string
+	views    []string
+}
+
+var (
+	// projectIDPattern matches project IDs, including those of domain-scoped projects such as
+	// example.com:my-project
+	projectIDPattern = regexp.MustCompile(`^[a-z0-9._:-]+$`)
+	// bucketIDPattern matches bucket IDs with their location, such as global/buckets/_Default
+	bucketIDPattern = regexp.MustCompile(`^[a-z0-9-]+/buckets/[A-Za-z0-9._-]+$`)
+	// viewIDPattern matches view IDs, such as _AllLogs
+	viewIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// invalidIDError is returned for project, bucket and view IDs which are not Cloud IDs. They
+// are refused before checking the allowlist, as an ID with slashes could name another resource
+type invalidIDError struct {
+	kind string
+	id   string
+}
+
+func (e *invalidIDError) Error() string {
+	return fmt.Sprintf("invalid %s ID %q", e.kind, e.id)
+}
+
+// validateID returns an invalidIDError if id is set and does not match pattern
+func validateID(kind, id string, pattern *regexp.Regexp) error {
+	if id == "" || pattern.MatchString(id) {
+		return nil
+	}
+	return &invalidIDError{kind: kind, id: id}
+}
+
+// permissionError is returned for projects, buckets and views that are not in the allowlist
+type permissionError struct {
+	kind string
+	name string
+}
+
+func (e *permissionError) Error() string {
+	return fmt.Sprintf("permission denied: %s %q is not allowed by the data source allowlist", e.kind, e.name)
+}
+
+// newAllowlist validates the patterns of the allowlist. It returns nil if nothing is restricted
+func newAllowlist(conf allowlistConfig) (*allowlist, error) {
+	if len(conf.Projects) == 0 && len(conf.Buckets) == 0 && len(conf.Views) == 0 {
+		return nil, nil
+	}
+	for _, patterns := range [][]string{conf.Projects, conf.Buckets, conf.Views} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid allowlist pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return &allowlist{projects: conf.Projects, buckets: conf.Buckets, views: conf.Views}, nil
+}
+
+// matches checks whether name matches one of the patterns. Glob patterns do not match
+// across slashes, so a pattern never matches a longer resource name
+func matches(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProject returns a permission error if the project is not allowed, or an invalidIDError
+// if the project ID is invalid
+func (a *allowlist) checkProject(projectID string) error {
+	if err := validateID("project", projectID, projectIDPattern); err != nil {
+		return err
+	}
+	if a == nil || matches(a.projects, projectID) {
+		return nil
+	}
+	return &permissionError{kind: "project", name: projectID}
+}
+
+// checkBucket returns a permission error if the project or the bucket is not allowed
+func (a *allowlist) checkBucket(projectID, bucketID string) error {
+	return a.checkParentBucket("projects/"+projectID, bucketID)
+}
+
+// checkView returns a permission error if the project, the bucket or the view is not allowed
+func (a *allowlist) checkView(projectID, bucketID, viewID string) error {
+	return a.checkParentView("projects/"+projectID, bucketID, viewID)
+}
+
+// checkParent returns a permission error if the parent of sinks, exclusions or logs is a
+// project that is not allowed. Folders, organizations and billing accounts span projects, so
+// they are only allowed when projects are not restricted
+func (a *allowlist) checkParent(parent string) error {
+	collection, id, _ := strings.Cut(parent, "/")
+	if collection == "projects" {
+		return a.checkProject(id)
+	}
+	if a == nil || len(a.projects) == 0 {
+		return nil
+	}
+	return &permissionError{kind: strings.TrimSuffix(collection, "s"), name: id}
+}
+
+// checkParentBucket returns a permission error if the project, folder, organization or
+// billing account, or its bucket, is not allowed
+func (a *allowlist) checkParentBucket(parent, bucketID string) error {
+	if err := a.checkParent(parent); err != nil {
+		return err
+	}
+	if err := validateID("bucket", bucketID, bucketIDPattern); err != nil {
+		return err
+	}
+	if a == nil {
+		return nil
+	}
+	buckets := []string{bucketID}
+	if bucketID == "" {
+		buckets = []string{defaultBucket, requiredBucket}
+	}
+	for _, bucket := range buckets {
+		if !matches(a.buckets, bucket) {
+			return &permissionError{kind: "bucket", name: bucket}
+		}
+	}
+	return nil
+}
+
+// checkParentView returns a permission error if the project, folder, organization or billing
+// account, its bucket or the view is not allowed
+func (a *allowlist) checkParentView(parent, bucketID, viewID string) error {
+	if err := a.checkParentBucket(parent, bucketID); err != nil {
+		return err
+	}
+	if err := validateID("view", viewID, viewIDPattern); err != nil {
+		return err
+	}
+	if viewID == "" {
+		viewID = defaultView
+	}
+	if a == nil || matches(a.views, viewID) {
+		return nil
+	}
+	return &permissionError{kind: "view", name: viewID}
+}
+
+// checkLogScope returns a permission error if a project or view of the log scope is not allowed
+func (a *allowlist) checkLogScope(scope cloudlogging.LogScope) error {
+	if a == nil {
+		return nil
+	}
+	for _, name := range scope.ResourceNames {
+		// Resources are projects/PROJECT_ID or projects/PROJECT_ID/locations/LOCATION/buckets/BUCKET/views/VIEW
+		parts := strings.Split(name, "/")
+		switch {
+		case len(parts) == 2 && parts[0] == "projects":
+			if err := a.checkView(parts[1], "", ""); err != nil {
+				return err
+			}
+		case len(parts) == 8 && parts[0] == "projects" && parts[2] == "locations" && parts[4] == "buckets" && parts[6] == "views":
+			if err := a.checkView(parts[1], strings.Join(parts[3:6], "/"), parts[7]); err != nil {
+				return err
+			}
+		default:
+			return &permissionError{kind: "resource", name: name}
+		}
+	}
+	return nil
+}
+
+// filterProjects returns the allowed projects
+func (a *allowlist) filterProjects(projects []cloudlogging.Project) []cloudlogging.Project {
+	return filterAllowed(a, projects, func(project cloudlogging.Project) error {
+		return a.checkProject(project.ID)
+	})
+}
+
+// filterOrganizations returns the organizations when projects are not restricted, as
+// organizations span projects
+func (a *allowlist) filterOrganizations(organizations []cloudlogging.Organization) []cloudlogging.Organization {
+	return filterAllowed(a, organizations, func(organization cloudlogging.Organization) error {
+		return a.checkParent(organization.Name)
+	})
+}
+
+// filterLogScopes returns the log scopes of a project whose projects and views are all allowed
+func (a *allowlist) filterLogScopes(scopes []cloudlogging.LogScope) []cloudlogging.LogScope {
+	return filterAllowed(a, scopes, a.checkLogScope)
+}
+
+// filterBuckets returns the allowed buckets of a project, folder, organization or billing
+// account, such as projects/my-project
+func (a *allowlist) filterBuckets(parent string, buckets []cloudlogging.LogBucket) []cloudlogging.LogBucket {
+	return filterAllowed(a, buckets, func(bucket cloudlogging.LogBucket) error {
+		return a.checkParentBucket(parent, bucket.ID)
+	})
+}
+
+// filterViews returns the allowed views of a bucket of a project, folder, organization or
+// billing account
+func (a *allowlist) filterViews(parent, bucketID string, views []cloudlogging.LogView) []cloudlogging.LogView {
+	return filterAllowed(a, views, func(view cloudlogging.LogView) error {
+		return a.checkParentView(parent, bucketID, view.ID)
+	})
+}
+
+func filterAllowed[T any](a *allowlist, items []T, check func(T) error) []T {
+	if a == nil {
+		return items
+	}
+	allowed := make([]T, 0, len(items))
+	for _, item := range items {
+		if check(item) == nil {
+			allowed = append(allowed, item)
+		}
+	}
+	return allowed
+}
+
+// newLogScopesCache returns a cache of the log scopes of projects, as they are checked
+// against the allowlist before every query and export of a log scope
+func newLogScopesCache() *ttlCache[[]cloudlogging.LogScope] {
+	return newTTLCache[[]cloudlogging.LogScope](logScopesCacheTTL, maxLogScopesCacheEntries)
+}
@@ -0,0 +1,293 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// maxAnalyticsRows caps the rows read from the results of a SQL query
+	maxAnalyticsRows = 10000
+	// timeSeriesFormat returns the results of a SQL query as time series instead of a table
+	timeSeriesFormat = "time_series"
+)
+
+// macroPattern matches the macros of SQL queries, with their arguments
+var macroPattern = regexp.MustCompile(`\$__(timeFilter|timeGroup|timeFrom|timeTo)\(([^)]*)\)|\$__(table|interval_s)\b`)
+
+// expandMacros replaces the macros of a SQL query:
+//   - $__timeFilter(column) restricts column to the time range of the query
+//   - $__timeFrom() and $__timeTo() are the bounds of the time range, as timestamps
+//   - $__timeGroup(column) truncates column to the interval of the query, or to the
+//     interval given as second argument, such as $__timeGroup(timestamp, 5m)
+//   - $__interval_s is the interval of the query in seconds
+//   - $__table is the view of the query, named by table
+func expandMacros(sql string, timeRange backend.TimeRange, interval time.Duration, table func() (string, error)) (string, error) {
+	timestamp := func(t time.Time) string {
+		return fmt.Sprintf("TIMESTAMP('%s')", t.UTC().Format(time.RFC3339Nano))
+	}
+	seconds := func(d time.Duration) int64 {
+		return max(1, int64(d/time.Second))
+	}
+
+	var expandErr error
+	expanded := macroPattern.ReplaceAllStringFunc(sql, func(match string) string {
+		groups := macroPattern.FindStringSubmatch(match)
+		name, args := groups[1]+groups[3], strings.Split(groups[2], ",")
+		for i := range args {
+			args[i] = strings.TrimSpace(args[i])
+		}
+
+		switch name {
+		case "timeFilter":
+			if args[0] == "" {
+				expandErr = errors.New("$__timeFilter needs a column")
+				return match
+			}
+			return fmt.Sprintf("%s BETWEEN %s AND %s", args[0], timestamp(timeRange.From), timestamp(timeRange.To))
+		case "timeFrom":
+			return timestamp(timeRange.From)
+		case "timeTo":
+			return timestamp(timeRange.To)
+		case "timeGroup":
+			if args[0] == "" {
+				expandErr = errors.New("$__timeGroup needs a column")
+				return match
+			}
+			groupBy := interval
+			if len(args) > 1 {
+				d, err := time.ParseDuration(args[1])
+				if err != nil {
+					expandErr = fmt.Errorf("$__timeGroup: invalid interval %q", args[1])
+					return match
+				}
+				groupBy = d
+			}
+			n := seconds(groupBy)
+			return fmt.Sprintf("TIMESTAMP_SECONDS(DIV(UNIX_SECONDS(%s), %d) * %d)", args[0], n, n)
+		case "interval_s":
+			return strconv.FormatInt(seconds(interval), 10)
+		default:
+			name, err := table()
+			if err != nil {
+				expandErr = err
+				return match
+			}
+			return name
+		}
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return expanded, nil
+}
+
+// analyticsQuery runs the Log Analytics SQL query of a query, and returns its results as a
+// table or as time series
+func (d *CloudLoggingDatasource) analyticsQuery(ctx context.Context, query backend.DataQuery, q queryModel, client cloudlogging.API) backend.DataResponse {
+	bucketID, viewID := q.BucketId, q.ViewId
+	if bucketID == "" {
+		bucketID = defaultBucket
+	}
+	if viewID == "" {
+		viewID = defaultView
+	}
+	// The query can only read its view, so the allowlist is checked against it
+	if err := d.allowlist.checkView(q.ProjectID, bucketID, viewID); err != nil {
+		return allowlistErrorResponse(err)
+	}
+	if strings.TrimSpace(q.SQL) == "" {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "sql: the query is empty")
+	}
+
+	table := func() (string, error) {
+		// Buckets are LOCATION/buckets/BUCKET, and their views are named
+		// PROJECT.LOCATION.BUCKET.VIEW in SQL queries
+		location, bucket, found := strings.Cut(bucketID, "/buckets/")
+		if !found {
+			return "", fmt.Errorf("$__table: invalid log bucket %q", bucketID)
+		}
+		return fmt.Sprintf("`%s.%s.%s.%s`", q.ProjectID, location, bucket, viewID), nil
+	}
+	sql, err := expandMacros(q.SQL, query.TimeRange, query.Interval, table)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("sql: %s", err))
+	}
+
+	view := fmt.Sprintf("projects/%s/locations/%s/views/%s", q.ProjectID, bucketID, viewID)
+	result, err := client.QueryAnalytics(ctx, view, sql, maxAnalyticsRows)
+	if err != nil {
+		// Invalid queries are the fault of the user
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("sql: %s", apiErr.Message))
+		}
+		return backend.ErrDataResponse(backend.StatusBadGateway, fmt.Sprintf("sql: %s", sanitizeErrorMessage(err)))
+	}
+
+	frame, err := analyticsFrame(result, d.redactor)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("sql: %s", err))
+	}
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: sql, PreferredVisualization: data.VisTypeTable}
+	if result.Truncated {
+		frame.Meta.Notices = append(frame.Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("The results are limited to the first %d rows", maxAnalyticsRows),
+		})
+	}
+
+	if q.Format == timeSeriesFormat {
+		switch frame.TimeSeriesSchema().Type {
+		case data.TimeSeriesTypeNot:
+			return backend.ErrDataResponse(backend.StatusBadRequest, "sql: time series need a TIMESTAMP column and a numeric column")
+		case data.TimeSeriesTypeLong:
+			if frame.Rows() > 0 {
+				if frame, err = data.LongToWide(frame, nil); err != nil {
+					return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("sql: %s, order the rows by time", err))
+				}
+			}
+		}
+		frame.Meta.PreferredVisualization = data.VisTypeGraph
+	}
+	return backend.DataResponse{Frames: data.Frames{frame}}
+}
+
+// analyticsFrame returns the results of a SQL query as a frame with a nullable field per
+// column. Arrays and records are returned as JSON, and strings are redacted
+func analyticsFrame(result *cloudlogging.AnalyticsResult, redactor *redactor) (*data.Frame, error) {
+	frame := data.NewFrame("")
+	for i, column := range result.Columns {
+		field, err := analyticsField(column, result.Rows, i, redactor)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", column.Name, err)
+		}
+		frame.Fields = append(frame.Fields, field)
+	}
+	return frame, nil
+}
+
+func analyticsField(column cloudlogging.AnalyticsColumn, rows [][]any, index int, redactor *redactor) (*data.Field, error) {
+	nested := column.Repeated || column.Type == "RECORD" || column.Type == "STRUCT"
+	var field *data.Field
+	switch {
+	case nested:
+		field = data.NewField(column.Name, nil, []*string{})
+	case column.Type == "INTEGER" || column.Type == "INT64":
+		field = data.NewField(column.Name, nil, []*int64{})
+	case column.Type == "FLOAT" || column.Type == "FLOAT64" || column.Type == "NUMERIC" || column.Type == "BIGNUMERIC":
+		field = data.NewField(column.Name, nil, []*float64{})
+	case column.Type == "BOOLEAN" || column.Type == "BOOL":
+		field = data.NewField(column.Name, nil, []*bool{})
+	case column.Type == "TIMESTAMP":
+		field = data.NewField(column.Name, nil, []*time.Time{})
+	default:
+		field = data.NewField(column.Name, nil, []*string{})
+	}
+
+	for _, row := range rows {
+		value := row[index]
+		if value == nil {
+			field.Append(nil)
+			continue
+		}
+		if nested {
+			encoded, err := json.Marshal(unwrapCell(value))
+			if err != nil {
+				return nil, err
+			}
+			text, _ := redactor.redact(string(encoded))
+			field.Append(&text)
+			continue
+		}
+
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected value %v", value)
+		}
+		switch field.Type() {
+		case data.FieldTypeNullableInt64:
+			n, err := strconv.ParseInt(text, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			field.Append(&n)
+		case data.FieldTypeNullableFloat64:
+			f, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, err
+			}
+			field.Append(&f)
+		case data.FieldTypeNullableBool:
+			b, err := strconv.ParseBool(text)
+			if err != nil {
+				return nil, err
+			}
+			field.Append(&b)
+		case data.FieldTypeNullableTime:
+			t, err := parseTimestamp(text)
+			if err != nil {
+				return nil, err
+			}
+			field.Append(&t)
+		default:
+			text, _ = redactor.redact(text)
+			field.Append(&text)
+		}
+	}
+	return field, nil
+}
+
+// parseTimestamp parses a TIMESTAMP value, as microseconds since the epoch or RFC 3339
+func parseTimestamp(text string) (time.Time, error) {
+	if micros, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.UnixMicro(micros).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, text)
+}
+
+// unwrapCell removes the {"v": value} wrappers of array items and the {"f": [...]} wrappers
+// of records from a value returned by the Logging API
+func unwrapCell(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		if fields, ok := v["f"]; ok {
+			return unwrapCell(fields)
+		}
+		return unwrapCell(v["v"])
+	case []any:
+		items := make([]any, 0, len(v))
+		for _, item := range v {
+			items = append(items, unwrapCell(item))
+		}
+		return items
+	default:
+		return v
+	}
+}
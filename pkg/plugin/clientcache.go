@@ -0,0 +1,232 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	// maxPassthroughClients is the number of OAuth passthrough clients kept open per data source
+	maxPassthroughClients = 100
+	// passthroughClientTTL is how long a passthrough client is used at most. Google access tokens
+	// are valid for at most an hour, so the token of an older client has expired. Tokens expiring
+	// sooner evict their client when a call is rejected as unauthenticated
+	passthroughClientTTL = time.Hour
+	// passthroughClientIdleTimeout is how long an unused passthrough client is kept open
+	passthroughClientIdleTimeout = 10 * time.Minute
+	// passthroughCacheSweepInterval is how often expired passthrough clients are closed
+	passthroughCacheSweepInterval = time.Minute
+)
+
+// errClientCacheClosed is returned for the calls made after the data source is disposed
+var errClientCacheClosed = errors.New("the data source is disposed")
+
+// cachedClient is a client in the passthrough client cache
+type cachedClient struct {
+	key      string
+	client   cloudlogging.API
+	created  time.Time
+	lastUsed time.Time
+	// refs is the number of calls using the client. An evicted client is closed once it is unused
+	refs    int
+	evicted bool
+}
+
+// passthroughClientCache keeps the clients created for OAuth passthrough open between calls. Clients
+// are keyed by a hash of the Authorization header, so a client is never shared between tokens
+type passthroughClientCache struct {
+	// newClient creates the client of a token, which calls onUnauthenticated when the token is rejected
+	newClient   func(ctx context.Context, headers map[string]string, onUnauthenticated func()) (cloudlogging.API, error)
+	maxEntries  int
+	ttl         time.Duration
+	idleTimeout time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the cached clients, most recently used first
+	lru *list.List
+	// closed is set by close, after which no client is created
+	closed bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newPassthroughClientCache(newClient func(ctx context.Context, headers map[string]string, onUnauthenticated func()) (cloudlogging.API, error)) *passthroughClientCache {
+	c := &passthroughClientCache{
+		newClient:   newClient,
+		maxEntries:  maxPassthroughClients,
+		ttl:         passthroughClientTTL,
+		idleTimeout: passthroughClientIdleTimeout,
+		now:         time.Now,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		stop:        make(chan struct{}),
+	}
+	go c.sweepLoop()
+	return c
+}
+
+// get returns the client for the Authorization header, creating one if needed. The returned
+// function must be called once the client is no longer used
+func (c *passthroughClientCache) get(ctx context.Context, headers map[string]string) (cloudlogging.API, func(), error) {
+	key := authorizationKey(headers["Authorization"])
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, nil, errClientCacheClosed
+	}
+	c.sweepLocked()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cachedClient)
+		entry.refs++
+		entry.lastUsed = c.now()
+		c.lru.MoveToFront(elem)
+		c.mu.Unlock()
+		return entry.client, c.releaseFunc(entry), nil
+	}
+	c.mu.Unlock()
+
+	// The client outlives the call creating it
+	var client cloudlogging.API
+	client, err := c.newClient(context.WithoutCancel(ctx), headers, func() { c.evict(key, client) })
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		closeClient(client)
+		return nil, nil, errClientCacheClosed
+	}
+	if elem, ok := c.entries[key]; ok {
+		// Another call created a client for the same token in the meantime
+		closeClient(client)
+		entry := elem.Value.(*cachedClient)
+		entry.refs++
+		entry.lastUsed = c.now()
+		c.lru.MoveToFront(elem)
+		return entry.client, c.releaseFunc(entry), nil
+	}
+
+	now := c.now()
+	entry := &cachedClient{key: key, client: client, created: now, lastUsed: now, refs: 1}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.evictLocked(c.lru.Back())
+	}
+	return client, c.releaseFunc(entry), nil
+}
+
+// releaseFunc returns a function marking the client as unused by a call
+func (c *passthroughClientCache) releaseFunc(entry *cachedClient) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			entry.refs--
+			if entry.evicted && entry.refs == 0 {
+				closeClient(entry.client)
+			}
+		})
+	}
+}
+
+// sweepLocked evicts the clients whose token has expired or which have not been used for a while
+func (c *passthroughClientCache) sweepLocked() {
+	now := c.now()
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		entry := elem.Value.(*cachedClient)
+		if now.Sub(entry.created) >= c.ttl || now.Sub(entry.lastUsed) >= c.idleTimeout {
+			c.evictLocked(elem)
+		}
+		elem = prev
+	}
+}
+
+// evict removes the client of a token rejected as unauthenticated from the cache. The calls
+// still using it finish, and the next calls create a client for the token of the user
+func (c *passthroughClientCache) evict(key string, client cloudlogging.API) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok && elem.Value.(*cachedClient).client == client {
+		c.evictLocked(elem)
+	}
+}
+
+// evictLocked removes a client from the cache, closing it unless a call still uses it
+func (c *passthroughClientCache) evictLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedClient)
+	delete(c.entries, entry.key)
+	entry.evicted = true
+	if entry.refs == 0 {
+		closeClient(entry.client)
+	}
+}
+
+func (c *passthroughClientCache) sweepLoop() {
+	ticker := time.NewTicker(passthroughCacheSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			c.sweepLocked()
+			c.mu.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// close evicts all clients and stops sweeping the cache. Clients are no longer created
+func (c *passthroughClientCache) close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for c.lru.Len() > 0 {
+		c.evictLocked(c.lru.Back())
+	}
+}
+
+// authorizationKey returns the key of the caches of OAuth passthrough users, a hash of their
+// Authorization header
+func authorizationKey(authorization string) string {
+	sum := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(sum[:])
+}
+
+func closeClient(client cloudlogging.API) {
+	if err := client.Close(); err != nil {
+		log.DefaultLogger.Error("failed closing client", "error", err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// analyticsWaitTimeout is how long each call waits for a SQL query to complete before the
+// client asks again
+const analyticsWaitTimeout = 10 * time.Second
+
+// AnalyticsColumn is a column of the results of a SQL query
+type AnalyticsColumn struct {
+	Name string
+	// Type is the type of the column, such as STRING, INT64 or TIMESTAMP
+	Type string
+	// Repeated is set for array columns
+	Repeated bool
+}
+
+// AnalyticsResult is the results of a SQL query
+type AnalyticsResult struct {
+	Columns []AnalyticsColumn
+	// Rows are the values of the columns as the Logging API returns them: strings for scalars,
+	// with TIMESTAMP as microseconds since the epoch or RFC 3339, nil for NULL, and nested
+	// values for arrays and records
+	Rows [][]any
+	// Truncated is set when the query returned more rows than were read
+	Truncated bool
+}
+
+// queryDataResponse is the response of the Logging entries.queryData method
+type queryDataResponse struct {
+	QueryStepHandles []string `json:"queryStepHandles"`
+}
+
+// queryResults is the response of the Logging entries.readQueryResults method
+type queryResults struct {
+	QueryComplete bool `json:"queryComplete"`
+	Schema        struct {
+		Fields []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+			Mode string `json:"mode"`
+		} `json:"fields"`
+	} `json:"schema"`
+	Rows []struct {
+		F []struct {
+			V any `json:"v"`
+		} `json:"f"`
+	} `json:"rows"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// QueryAnalytics runs a Log Analytics SQL query on a log view, such as
+// projects/my-project/locations/global/buckets/_Default/views/_AllLogs, with the query API of
+// Logging, and reads up to maxRows rows of its results. The query can only read the view
+func (c *Client) QueryAnalytics(ctx context.Context, view, sql string, maxRows int) (*AnalyticsResult, error) {
+	queryURL, err := c.loggingRESTURL("v2/entries:queryData")
+	if err != nil {
+		return nil, err
+	}
+	readURL, err := c.loggingRESTURL("v2/entries:readQueryResults")
+	if err != nil {
+		return nil, err
+	}
+	var query queryDataResponse
+	err = c.postJSON(ctx, queryURL, map[string]any{
+		"resourceNames": []string{view},
+		"query": map[string]any{
+			"querySteps": []any{map[string]any{"sqlQueryStep": map[string]any{"sqlQuery": sql}}},
+		},
+	}, &query)
+	if err != nil {
+		return nil, err
+	}
+	if len(query.QueryStepHandles) == 0 {
+		return nil, errors.New("the query returned no results")
+	}
+	// The results are those of the last step
+	handle := query.QueryStepHandles[len(query.QueryStepHandles)-1]
+
+	// Incomplete queries are read again until they complete
+	result := &AnalyticsResult{}
+	pageToken := ""
+	for {
+		var results queryResults
+		err := c.postJSON(ctx, readURL, map[string]any{
+			"resourceNames":   []string{view},
+			"queryStepHandle": handle,
+			"pageSize":        maxRows - len(result.Rows),
+			"pageToken":       pageToken,
+			"readTimeout":     fmt.Sprintf("%ds", int(analyticsWaitTimeout.Seconds())),
+		}, &results)
+		if err != nil {
+			return nil, err
+		}
+		if !results.QueryComplete {
+			continue
+		}
+
+		if len(result.Columns) == 0 {
+			for _, field := range results.Schema.Fields {
+				result.Columns = append(result.Columns, AnalyticsColumn{Name: field.Name, Type: field.Type, Repeated: field.Mode == "REPEATED"})
+			}
+		}
+		for _, row := range results.Rows {
+			if len(result.Rows) == maxRows {
+				result.Truncated = true
+				return result, nil
+			}
+			values := make([]any, 0, len(row.F))
+			for _, cell := range row.F {
+				values = append(values, cell.V)
+			}
+			result.Rows = append(result.Rows, values)
+		}
+		if results.NextPageToken == "" {
+			return result, nil
+		}
+		if len(result.Rows) == maxRows {
+			result.Truncated = true
+			return result, nil
+		}
+		pageToken = results.NextPageToken
+	}
+}
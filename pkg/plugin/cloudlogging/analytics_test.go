@@ -0,0 +1,118 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// queryStandIn runs queries on a view of test-project with the REST query API of Logging. The
+// query is incomplete when first read, and its results span two pages
+func queryStandIn(t *testing.T) (*httptest.Server, *[]string) {
+	const view = "projects/test-project/locations/global/buckets/analytics/views/_AllLogs"
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		var req map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, []any{view}, req["resourceNames"])
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/entries:queryData":
+			steps := req["query"].(map[string]any)["querySteps"].([]any)
+			if steps[0].(map[string]any)["sqlQueryStep"].(map[string]any)["sqlQuery"] == "SELECT broken" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": {"code": 400, "message": "Unrecognized name: broken", "status": "INVALID_ARGUMENT"}}`))
+				return
+			}
+			w.Write([]byte(`{"queryStepHandles": ["step-1"]}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v2/entries:readQueryResults":
+			require.Equal(t, "step-1", req["queryStepHandle"])
+			require.Equal(t, "10s", req["readTimeout"])
+			schema := `"schema": {"fields": [
+				{"name": "time", "type": "TIMESTAMP", "mode": "NULLABLE"},
+				{"name": "severity", "type": "STRING", "mode": "NULLABLE"},
+				{"name": "count", "type": "INTEGER", "mode": "NULLABLE"},
+				{"name": "labels", "type": "STRING", "mode": "REPEATED"}
+			]}`
+			switch req["pageToken"] {
+			case "":
+				if len(requests) == 2 {
+					w.Write([]byte(`{"queryComplete": false}`))
+					return
+				}
+				w.Write([]byte(`{"queryComplete": true, ` + schema + `,
+					"rows": [
+						{"f": [{"v": "1704067200000000"}, {"v": "ERROR"}, {"v": "3"}, {"v": [{"v": "a"}]}]},
+						{"f": [{"v": "1704067260000000"}, {"v": null}, {"v": "1"}, {"v": []}]}
+					],
+					"nextPageToken": "page-2"}`))
+			default:
+				require.Equal(t, "page-2", req["pageToken"])
+				w.Write([]byte(`{"queryComplete": true, ` + schema + `,
+					"rows": [{"f": [{"v": "1704067320000000"}, {"v": "INFO"}, {"v": "7"}, {"v": []}]}]}`))
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "Not found", "status": "NOT_FOUND"}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestQueryAnalytics(t *testing.T) {
+	const view = "projects/test-project/locations/global/buckets/analytics/views/_AllLogs"
+	server, requests := queryStandIn(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{LoggingREST: server.Listener.Addr().String()}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	result, err := client.QueryAnalytics(context.Background(), view, "SELECT 1", 100)
+	require.NoError(t, err)
+	require.Equal(t, []AnalyticsColumn{
+		{Name: "time", Type: "TIMESTAMP"},
+		{Name: "severity", Type: "STRING"},
+		{Name: "count", Type: "INTEGER"},
+		{Name: "labels", Type: "STRING", Repeated: true},
+	}, result.Columns)
+	require.Equal(t, [][]any{
+		{"1704067200000000", "ERROR", "3", []any{map[string]any{"v": "a"}}},
+		{"1704067260000000", nil, "1", []any{}},
+		{"1704067320000000", "INFO", "7", []any{}},
+	}, result.Rows)
+	require.False(t, result.Truncated)
+	require.Equal(t, []string{
+		"POST /v2/entries:queryData",
+		"POST /v2/entries:readQueryResults",
+		"POST /v2/entries:readQueryResults",
+		"POST /v2/entries:readQueryResults",
+	}, *requests)
+
+	// Reading stops at the maximum number of rows
+	result, err = client.QueryAnalytics(context.Background(), view, "SELECT 1", 2)
+	require.NoError(t, err)
+	require.Len(t, result.Rows, 2)
+	require.True(t, result.Truncated)
+
+	_, err = client.QueryAnalytics(context.Background(), view, "SELECT broken", 100)
+	require.ErrorContains(t, err, "Unrecognized name: broken")
+}
@@ -19,17 +19,20 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	logging "cloud.google.com/go/logging/apiv2"
 	resourcemanager "cloud.google.com/go/resourcemanager/apiv3"
 	resourcemanagerpb "cloud.google.com/go/resourcemanager/apiv3/resourcemanagerpb"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
-	"golang.org/x/oauth2"
-	"google.golang.org/api/impersonate"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+	grpctransport "google.golang.org/api/transport/grpc"
+	"google.golang.org/grpc"
 
 	// Currently, LogEntry.ProtoPayload only supports two types
 	// https://pkg.go.dev/cloud.google.com/go/logging/apiv2/loggingpb#LogEntry_ProtoPayload
@@ -40,210 +43,428 @@ import (
 	"cloud.google.com/go/logging/apiv2/loggingpb"
 )
 
-const testConnectionTimeout = time.Minute * 1
+// maxLogNames is the number of log names listed at most
+const maxLogNames = 1000
+
+// projectsPageSize is the number of projects requested per page. The API returns fewer
+// projects by default, which takes many round trips in large organizations
+const projectsPageSize = 500
+
+// cloudPlatformScope is the scope requested for federated credentials, which STS requires, and
+// used to check service account keys
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
 
 // API implements the methods we need to query logs and list projects from GCP
 type API interface {
-	// ListLogs retrieves all logs matching some query filter up to the given limit
+	// ListLogs retrieves all logs matching some query filter up to the given limit. When a
+	// page fails after others were fetched, their logs are returned with the error
 	ListLogs(context.Context, *Query) ([]*loggingpb.LogEntry, error)
-	// TestConnection queries for any log from the given project
-	TestConnection(ctx context.Context, projectID string) error
-	// ListProjects returns the project IDs of all visible projects
-	ListProjects(context.Context) ([]string, error)
-	// ListProjectBuckets returns all log buckets of a project
-	ListProjectBuckets(ctx context.Context, projectId string) ([]string, error)
-	// ListProjectBucketViews returns all views of a log bucket
-	ListProjectBucketViews(ctx context.Context, projectId string, bucketId string) ([]string, error)
+	// StreamLogs retrieves all logs matching some query filter up to the given limit, one page at a time
+	StreamLogs(ctx context.Context, q *Query, fn func([]*loggingpb.LogEntry) error) error
+	// TestConnection queries for any log from the given project, folder, organization or billing
+	// account, such as projects/my-project
+	TestConnection(ctx context.Context, parent string) error
+	// ListProjects returns all visible active projects
+	ListProjects(context.Context) ([]Project, error)
+	// ListFolders returns the active folders directly under a folder or organization, such as organizations/123
+	ListFolders(ctx context.Context, parent string) ([]Folder, error)
+	// ListOrganizations returns the visible active organizations
+	ListOrganizations(ctx context.Context) ([]Organization, error)
+	// ListBuckets returns all log buckets of a project, folder, organization or billing account,
+	// such as organizations/123
+	ListBuckets(ctx context.Context, parent string) ([]LogBucket, error)
+	// ListBucketViews returns all views of a log bucket of a project, folder, organization or billing account
+	ListBucketViews(ctx context.Context, parent string, bucketID string) ([]LogView, error)
+	// ListErrorGroups returns the Error Reporting error groups of log entries matching a query,
+	// by insert ID
+	ListErrorGroups(ctx context.Context, q *Query, insertIDs []string) (map[string][]string, error)
+	// ListLogScopes returns the log scopes of a project
+	ListLogScopes(ctx context.Context, projectID string) ([]LogScope, error)
+	// ListLogNames returns the names of the logs of a project, or of a bucket or view if given
+	ListLogNames(ctx context.Context, projectID, bucketID, viewID string) ([]string, error)
+	// ListMonitoredResourceDescriptors returns the monitored resource types which logs can be written for
+	ListMonitoredResourceDescriptors(ctx context.Context) ([]MonitoredResourceDescriptor, error)
+	// ListSavedQueries returns the Logs Explorer queries saved in a project
+	ListSavedQueries(ctx context.Context, projectID string) ([]SavedQuery, error)
+	// ListRecentQueries returns the Logs Explorer queries recently run in a project
+	ListRecentQueries(ctx context.Context, projectID string) ([]RecentQuery, error)
+	// ListSinks returns the sinks of a project, folder or organization, such as projects/my-project
+	ListSinks(ctx context.Context, parent string) ([]Sink, error)
+	// ListExclusions returns the exclusions of a project, folder or organization, such as folders/123
+	ListExclusions(ctx context.Context, parent string) ([]Exclusion, error)
+	// QueryAnalytics runs a Log Analytics SQL query on a log view, and reads up to maxRows rows of its results
+	QueryAnalytics(ctx context.Context, view, sql string, maxRows int) (*AnalyticsResult, error)
+	// TestProxy connects to the logging API through the configured proxy, if any
+	TestProxy(ctx context.Context) error
 	// Close closes the underlying connection to the GCP API
 	Close() error
 }
 
 // Client wraps a GCP logging client to fetch logs, a resourcemanager client
-// to list projects, and a config client to get log bucket configurations
+// to list projects, and a config client to get log bucket configurations.
+// The sub-clients are created on first use, and clients of APIs served by
+// the same endpoint share one connection
 type Client struct {
-	lClient      *logging.Client
+	opts           []option.ClientOption
+	endpoints      Endpoints
+	plaintext      bool
+	universeDomain string
+	// dialer connects through the configured proxy, if any
+	dialer ContextDialer
+	retry  RetryPolicy
+	// rateLimiter limits the log entry requests, if set
+	rateLimiter *RateLimiter
+	// onUnauthenticated is called when a call is rejected as unauthenticated, if set
+	onUnauthenticated func()
+	// refreshableToken is the token source that REST calls rejected as unauthenticated are
+	// retried with, if the client authenticates with one
+	refreshableToken *RefreshableTokenSource
+
+	mu sync.Mutex
+	// conns are the connections of the sub-clients, by endpoint
+	conns   map[string]*grpc.ClientConn
+	lClient *logging.Client
+	// logEntries lists log entries with one call per page, on the connection of lClient
+	logEntries   loggingpb.LoggingServiceV2Client
 	rClient      *resourcemanager.ProjectsClient
+	fClient      *resourcemanager.FoldersClient
+	oClient      *resourcemanager.OrganizationsClient
 	configClient *logging.ConfigClient
+	// httpClient makes the REST calls, for the methods the generated clients lack
+	httpClient *http.Client
+	// closed is set by Close, after which the sub-clients are not created again
+	closed bool
 }
 
-func universeDomainOpts(universeDomain string) []option.ClientOption {
-	if universeDomain == "" {
-		return nil
+// New creates a new Client. Without a credential source option, the application
+// default credentials are used
+func New(ctx context.Context, opts ...ClientOption) (*Client, error) {
+	settings := &clientSettings{}
+	for _, opt := range opts {
+		opt(settings)
+	}
+	clientOpts, err := settings.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	retry := DefaultRetryPolicy()
+	if settings.retry != nil {
+		if err := settings.retry.Validate(); err != nil {
+			return nil, fmt.Errorf("retry policy: %w", err)
+		}
+		retry = *settings.retry
 	}
-	return []option.ClientOption{option.WithUniverseDomain(universeDomain)}
+	return &Client{
+		opts:              clientOpts,
+		endpoints:         settings.endpoints,
+		plaintext:         settings.plaintext,
+		universeDomain:    settings.universeDomain,
+		dialer:            newDialer(settings.proxy, settings.dialer),
+		retry:             retry,
+		rateLimiter:       settings.rateLimiter,
+		conns:             map[string]*grpc.ClientConn{},
+		onUnauthenticated: settings.onUnauthenticated,
+		refreshableToken:  settings.refreshableToken,
+	}, nil
 }
 
 // NewClient creates a new Client using jsonCreds for authentication
 func NewClient(ctx context.Context, jsonCreds []byte, universeDomain string) (*Client, error) {
-	opts := append([]option.ClientOption{
-		option.WithCredentialsJSON(jsonCreds),
-		option.WithUserAgent("googlecloud-logging-datasource"),
-	}, universeDomainOpts(universeDomain)...)
+	return New(ctx, WithCredentialsJSON(jsonCreds), WithUniverseDomain(universeDomain))
+}
 
-	client, err := logging.NewClient(ctx, opts...)
-	if err != nil {
-		return nil, err
+// NewClient creates a new Clients using GCE metadata for authentication
+func NewClientWithGCE(ctx context.Context, universeDomain string) (*Client, error) {
+	return New(ctx, WithDefaultCredentials(), WithUniverseDomain(universeDomain))
+}
+
+// NewClient creates a new Clients using service account impersonation
+func NewClientWithImpersonation(ctx context.Context, jsonCreds []byte, impersonateSA string, universeDomain string) (*Client, error) {
+	return New(ctx, WithImpersonation(jsonCreds, impersonateSA), WithUniverseDomain(universeDomain))
+}
+
+// NewClientWithAccessToken creates a new Client using an access token for authentication.
+// Since the datasource is re-created whenever the token changes, we can treat this token as static.
+func NewClientWithAccessToken(ctx context.Context, accessToken string, universeDomain string) (*Client, error) {
+	return New(ctx, WithAccessToken(accessToken), WithUniverseDomain(universeDomain))
+}
+
+// NewClientWithExternalAccount creates a new Client using an external account (workload identity
+// federation) credential configuration for authentication
+func NewClientWithExternalAccount(ctx context.Context, jsonCreds []byte, universeDomain string) (*Client, error) {
+	return New(ctx, WithExternalAccount(jsonCreds), WithUniverseDomain(universeDomain))
+}
+
+// NewClientWithRefreshableToken creates a new Client using an access token read from a file or
+// a credential helper command. Calls rejected as unauthenticated are retried once with a new token
+func NewClientWithRefreshableToken(ctx context.Context, ts *RefreshableTokenSource, universeDomain string) (*Client, error) {
+	return New(ctx, WithRefreshableToken(ts), WithUniverseDomain(universeDomain))
+}
+
+// NewClientWithPassThrough creates a new Clients using Oauth browser credentials
+func NewClientWithPassThrough(ctx context.Context, headers map[string]string, universeDomain string) (*Client, error) {
+	return New(ctx, WithPassThrough(headers), WithUniverseDomain(universeDomain))
+}
+
+// apiService is a Google Cloud API the client connects to
+type apiService struct {
+	// name is the first label of the host name of the API, such as logging
+	name string
+	// scopes are the OAuth scopes requested for the API
+	scopes []string
+}
+
+var loggingService = apiService{name: "logging", scopes: logging.DefaultAuthScopes()}
+
+var resourceManagerService = apiService{name: "cloudresourcemanager", scopes: resourcemanager.DefaultAuthScopes()}
+
+// defaultOptions are the options of the generated client of the API, which are applied when
+// dialing the connection it uses. Among them, service account keys sign their own JWTs
+// instead of exchanging them for access tokens
+func (s apiService) defaultOptions() []option.ClientOption {
+	return []option.ClientOption{
+		internaloption.WithDefaultEndpoint(s.name + ".googleapis.com:443"),
+		internaloption.WithDefaultEndpointTemplate(s.name + ".UNIVERSE_DOMAIN:443"),
+		internaloption.WithDefaultMTLSEndpoint(s.name + ".mtls.googleapis.com:443"),
+		internaloption.WithDefaultUniverseDomain("googleapis.com"),
+		internaloption.WithDefaultAudience("https://" + s.name + ".googleapis.com/"),
+		internaloption.WithDefaultScopes(s.scopes...),
+		internaloption.EnableJwtWithScope(),
+		internaloption.EnableNewAuthLibrary(),
+		option.WithGRPCDialOption(grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32))),
 	}
-	rClient, err := resourcemanager.NewProjectsClient(ctx, opts...)
-	if err != nil {
-		return nil, err
+}
+
+// errClientClosed is returned by the calls made after the client is closed
+var errClientClosed = errors.New("the client is closed")
+
+// serviceHost returns the host name of an API, such as logging, in the universe domain of the client
+func (c *Client) serviceHost(service string) string {
+	universeDomain := c.universeDomain
+	if universeDomain == "" {
+		universeDomain = "googleapis.com"
 	}
+	return service + "." + universeDomain
+}
 
-	configClient, err := logging.NewConfigClient(ctx, opts...)
+// connLocked returns the connection to an API at the given endpoint, or its default endpoint
+// if empty, dialing it on first use. It also returns whether the connection was just dialed
+func (c *Client) connLocked(ctx context.Context, service apiService, endpoint string) (*grpc.ClientConn, bool, error) {
+	if c.closed {
+		return nil, false, errClientClosed
+	}
+	key := endpoint
+	if key == "" {
+		key = c.serviceHost(service.name) + ":443"
+	}
+	if conn, ok := c.conns[key]; ok {
+		return conn, false, nil
+	}
+
+	opts := append(service.defaultOptions(), c.opts...)
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	dial := grpctransport.Dial
+	if c.plaintext {
+		dial = grpctransport.DialInsecure
+	}
+	conn, err := dial(ctx, opts...)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	return &Client{
-		lClient:      client,
-		rClient:      rClient,
-		configClient: configClient,
-	}, nil
+	c.conns[key] = conn
+	return conn, true, nil
 }
 
-// NewClient creates a new Clients using GCE metadata for authentication
-func NewClientWithGCE(ctx context.Context, universeDomain string) (*Client, error) {
-	opts := append([]option.ClientOption{
-		option.WithUserAgent("googlecloud-logging-datasource"),
-	}, universeDomainOpts(universeDomain)...)
+// closeConnLocked closes a connection which was just dialed, after creating its client failed
+func (c *Client) closeConnLocked(conn *grpc.ClientConn) {
+	for key, other := range c.conns {
+		if other == conn {
+			delete(c.conns, key)
+		}
+	}
+	if err := conn.Close(); err != nil {
+		log.DefaultLogger.Error("failed closing connection", "error", err)
+	}
+}
 
-	client, err := logging.NewClient(ctx, opts...)
-	if err != nil {
-		return nil, err
+// loggingClient returns the logging client, creating it on first use
+func (c *Client) loggingClient(ctx context.Context) (*logging.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lClient != nil {
+		return c.lClient, nil
 	}
-	rClient, err := resourcemanager.NewProjectsClient(ctx, opts...)
+
+	// The client outlives the call creating it
+	ctx = context.WithoutCancel(ctx)
+	conn, dialed, err := c.connLocked(ctx, loggingService, c.endpoints.Logging)
 	if err != nil {
 		return nil, err
 	}
-	configClient, err := logging.NewConfigClient(ctx, opts...)
+	lClient, err := logging.NewClient(ctx, option.WithGRPCConn(conn))
 	if err != nil {
+		if dialed {
+			c.closeConnLocked(conn)
+		}
 		return nil, err
 	}
-	return &Client{
-		lClient:      client,
-		rClient:      rClient,
-		configClient: configClient,
-	}, nil
+	c.lClient = lClient
+	c.logEntries = loggingpb.NewLoggingServiceV2Client(conn)
+	return lClient, nil
 }
 
-// NewClient creates a new Clients using service account impersonation
-func NewClientWithImpersonation(ctx context.Context, jsonCreds []byte, impersonateSA string, universeDomain string) (*Client, error) {
-	var ts oauth2.TokenSource
-	var err error
-
-	impersonateOpts := append([]option.ClientOption{}, universeDomainOpts(universeDomain)...)
-
-	if jsonCreds == nil {
-		ts, err = impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
-			TargetPrincipal: impersonateSA,
-			Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform.read-only"},
-		}, impersonateOpts...)
-	} else {
-		impersonateOpts = append(impersonateOpts, option.WithCredentialsJSON(jsonCreds))
-		ts, err = impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
-			TargetPrincipal: impersonateSA,
-			Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform.read-only"},
-		}, impersonateOpts...)
-	}
-	if err != nil {
+// logEntriesClient returns the gRPC client listing log entries, creating it on first use. The
+// iterators of the generated client fetch pages until one has entries, while this client makes
+// exactly one call per page, each of them rate limited and retried on its own
+func (c *Client) logEntriesClient(ctx context.Context) (loggingpb.LoggingServiceV2Client, error) {
+	if _, err := c.loggingClient(ctx); err != nil {
 		return nil, err
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.logEntries == nil {
+		return nil, errClientClosed
+	}
+	return c.logEntries, nil
+}
 
-	opts := append([]option.ClientOption{
-		option.WithTokenSource(ts),
-		option.WithUserAgent("googlecloud-logging-datasource"),
-	}, universeDomainOpts(universeDomain)...)
+// logConfigClient returns the config client, creating it on first use
+func (c *Client) logConfigClient(ctx context.Context) (*logging.ConfigClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.configClient != nil {
+		return c.configClient, nil
+	}
 
-	client, err := logging.NewClient(ctx, opts...)
-	if err != nil {
-		return nil, err
+	// The config API is served by the logging endpoint, unless another endpoint is set
+	endpoint := c.endpoints.Config
+	if endpoint == "" {
+		endpoint = c.endpoints.Logging
 	}
-	rClient, err := resourcemanager.NewProjectsClient(ctx, opts...)
+	ctx = context.WithoutCancel(ctx)
+	conn, dialed, err := c.connLocked(ctx, loggingService, endpoint)
 	if err != nil {
 		return nil, err
 	}
-	configClient, err := logging.NewConfigClient(ctx, opts...)
+	configClient, err := logging.NewConfigClient(ctx, option.WithGRPCConn(conn))
 	if err != nil {
+		if dialed {
+			c.closeConnLocked(conn)
+		}
 		return nil, err
 	}
-	return &Client{
-		lClient:      client,
-		rClient:      rClient,
-		configClient: configClient,
-	}, nil
+	c.configClient = configClient
+	return configClient, nil
 }
 
-// NewClientWithAccessToken creates a new Client using an access token for authentication.
-// Since the datasource is re-created whenever the token changes, we can treat this token as static.
-func NewClientWithAccessToken(ctx context.Context, accessToken string, universeDomain string) (*Client, error) {
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken})
-
-	opts := append([]option.ClientOption{
-		option.WithTokenSource(ts),
-		option.WithUserAgent("googlecloud-logging-datasource"),
-	}, universeDomainOpts(universeDomain)...)
-
-	client, err := logging.NewClient(ctx, opts...)
-	if err != nil {
-		return nil, err
+// projectsClient returns the resourcemanager client, creating it on first use
+func (c *Client) projectsClient(ctx context.Context) (*resourcemanager.ProjectsClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rClient != nil {
+		return c.rClient, nil
 	}
 
-	rClient, err := resourcemanager.NewProjectsClient(ctx, opts...)
+	ctx = context.WithoutCancel(ctx)
+	conn, dialed, err := c.connLocked(ctx, resourceManagerService, c.endpoints.ResourceManager)
 	if err != nil {
 		return nil, err
 	}
-
-	configClient, err := logging.NewConfigClient(ctx, opts...)
+	rClient, err := resourcemanager.NewProjectsClient(ctx, option.WithGRPCConn(conn))
 	if err != nil {
+		if dialed {
+			c.closeConnLocked(conn)
+		}
 		return nil, err
 	}
-
-	return &Client{
-		lClient:      client,
-		rClient:      rClient,
-		configClient: configClient,
-	}, nil
+	c.rClient = rClient
+	return rClient, nil
 }
 
-// NewClientWithPassThrough creates a new Clients using Oauth browser credentials
-func NewClientWithPassThrough(ctx context.Context, headers map[string]string, universeDomain string) (*Client, error) {
-	token, found := strings.CutPrefix(headers["Authorization"], "Bearer ")
-	if !found || token == "" {
-		return nil, errors.New("missing or invalid Authorization header")
+// foldersClient returns the resourcemanager folders client, creating it on first use
+func (c *Client) foldersClient(ctx context.Context) (*resourcemanager.FoldersClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fClient != nil {
+		return c.fClient, nil
 	}
 
-	opts := append([]option.ClientOption{
-		option.WithTokenSource(
-			oauth2.StaticTokenSource(&oauth2.Token{
-				AccessToken: token,
-			}),
-		),
-		option.WithUserAgent("googlecloud-logging-datasource"),
-	}, universeDomainOpts(universeDomain)...)
-
-	client, err := logging.NewClient(ctx, opts...)
+	ctx = context.WithoutCancel(ctx)
+	conn, dialed, err := c.connLocked(ctx, resourceManagerService, c.endpoints.ResourceManager)
 	if err != nil {
 		return nil, err
 	}
-	rClient, err := resourcemanager.NewProjectsClient(ctx, opts...)
+	fClient, err := resourcemanager.NewFoldersClient(ctx, option.WithGRPCConn(conn))
 	if err != nil {
+		if dialed {
+			c.closeConnLocked(conn)
+		}
 		return nil, err
 	}
-	configClient, err := logging.NewConfigClient(ctx, opts...)
+	c.fClient = fClient
+	return fClient, nil
+}
+
+// organizationsClient returns the resourcemanager organizations client, creating it on first use
+func (c *Client) organizationsClient(ctx context.Context) (*resourcemanager.OrganizationsClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.oClient != nil {
+		return c.oClient, nil
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	conn, dialed, err := c.connLocked(ctx, resourceManagerService, c.endpoints.ResourceManager)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
-		lClient:      client,
-		rClient:      rClient,
-		configClient: configClient,
-	}, nil
+	oClient, err := resourcemanager.NewOrganizationsClient(ctx, option.WithGRPCConn(conn))
+	if err != nil {
+		if dialed {
+			c.closeConnLocked(conn)
+		}
+		return nil, err
+	}
+	c.oClient = oClient
+	return oClient, nil
 }
 
-// Close closes the underlying connection to the GCP API
+// Close closes the underlying connection to the GCP API. The calls made afterwards fail
 func (c *Client) Close() error {
-	c.rClient.Close()
-	c.configClient.Close()
-	return c.lClient.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+
+	// The sub-clients only hold the connections
+	var errs []error
+	for key, conn := range c.conns {
+		errs = append(errs, conn.Close())
+		delete(c.conns, key)
+	}
+	if c.httpClient != nil {
+		c.httpClient.CloseIdleConnections()
+	}
+	c.lClient, c.logEntries, c.configClient, c.rClient, c.fClient, c.oClient, c.httpClient = nil, nil, nil, nil, nil, nil, nil
+	return errors.Join(errs...)
+}
+
+// TestProxy connects to the logging API through the configured proxy, if any
+func (c *Client) TestProxy(ctx context.Context) error {
+	if c.dialer == nil {
+		return nil
+	}
+
+	endpoint := c.endpoints.Logging
+	if endpoint == "" {
+		endpoint = c.serviceHost(loggingService.name) + ":443"
+	}
+	conn, err := c.dialer.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
 }
 
 // Query is the information from a Grafana query needed to query GCP for logs
@@ -251,6 +472,11 @@ type Query struct {
 	ProjectID string
 	BucketId  string
 	ViewId    string
+	// LogScope is the ID of a log scope of the project, queried instead of its buckets
+	LogScope string
+	// Parent is the folder, organization or billing account queried instead of the project,
+	// such as organizations/123. Buckets and views are those of the parent
+	Parent    string
 	Filter    string
 	Limit     int64
 	TimeRange struct {
@@ -262,16 +488,116 @@ type Query struct {
 // String is the query formatted for querying GCP
 // It is the query text, with the time range constraints appended
 func (q *Query) String() string {
-	return fmt.Sprintf(`%s AND timestamp >= "%s" AND timestamp <= "%s"`,
-		q.Filter, q.TimeRange.From, q.TimeRange.To,
-	)
+	timeRange := fmt.Sprintf(`timestamp >= "%s" AND timestamp <= "%s"`, q.TimeRange.From, q.TimeRange.To)
+	if strings.TrimSpace(q.Filter) == "" {
+		return timeRange
+	}
+	return fmt.Sprintf("%s AND %s", q.Filter, timeRange)
 }
 
-// ListProjects returns the project IDs of all visible projects
-func (c *Client) ListProjects(ctx context.Context) ([]string, error) {
-	projectIDs := []string{}
-	req := &resourcemanagerpb.SearchProjectsRequest{}
-	it := c.rClient.SearchProjects(ctx, req)
+// MonitoredResourceDescriptor describes a monitored resource type, such as k8s_container
+type MonitoredResourceDescriptor struct {
+	Type        string   `json:"type"`
+	DisplayName string   `json:"displayName"`
+	Description string   `json:"description"`
+	LabelKeys   []string `json:"labelKeys"`
+}
+
+// LogBucket is a log bucket of a project
+type LogBucket struct {
+	// ID is the bucket with its location, such as global/buckets/my-bucket
+	ID string `json:"id"`
+	// Name is the resource name of the bucket, such as projects/my-project/locations/global/buckets/my-bucket
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	RetentionDays int32  `json:"retentionDays"`
+	// LifecycleState is ACTIVE, DELETE_REQUESTED, UPDATING, CREATING or FAILED
+	LifecycleState string `json:"lifecycleState"`
+	// Locked buckets cannot be deleted, and their retention cannot be shortened
+	Locked           bool `json:"locked"`
+	AnalyticsEnabled bool `json:"analyticsEnabled"`
+	// KmsKeyName is the Cloud KMS key encrypting the bucket, if it uses CMEK
+	KmsKeyName string `json:"kmsKeyName,omitempty"`
+}
+
+// LogView is a view of a log bucket
+type LogView struct {
+	// ID is the view, such as _AllLogs
+	ID string `json:"id"`
+	// Name is the resource name of the view
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Filter restricts the log entries of the bucket which the view shows
+	Filter string `json:"filter"`
+}
+
+// Sink routes the log entries matching its filter to a destination, such as a bucket,
+// a BigQuery dataset or a Pub/Sub topic
+type Sink struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	Filter      string `json:"filter"`
+	Description string `json:"description"`
+	Disabled    bool   `json:"disabled"`
+	// Exclusions are the filters of the entries the sink does not route
+	Exclusions []Exclusion `json:"exclusions"`
+	// WriterIdentity is the service account writing to the destination
+	WriterIdentity string `json:"writerIdentity"`
+	// IncludeChildren is set on folder and organization sinks routing the entries of their children
+	IncludeChildren bool `json:"includeChildren"`
+}
+
+// Exclusion keeps the log entries matching its filter from being stored
+type Exclusion struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Filter      string `json:"filter"`
+	Disabled    bool   `json:"disabled"`
+}
+
+func exclusionFromProto(e *loggingpb.LogExclusion) Exclusion {
+	return Exclusion{
+		Name:        e.GetName(),
+		Description: e.GetDescription(),
+		Filter:      e.GetFilter(),
+		Disabled:    e.GetDisabled(),
+	}
+}
+
+// Project is a Google Cloud project
+type Project struct {
+	// ID is the project ID, such as my-project
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	// Parent is the folder or organization of the project, such as folders/123, if any
+	Parent string `json:"parent"`
+}
+
+// Folder is a folder of the resource hierarchy
+type Folder struct {
+	// Name is the resource name of the folder, such as folders/123
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	// Parent is the folder or organization of the folder, such as organizations/456
+	Parent string `json:"parent"`
+}
+
+// Organization is the root of a resource hierarchy
+type Organization struct {
+	// Name is the resource name of the organization, such as organizations/456
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// ListProjects returns all visible active projects
+func (c *Client) ListProjects(ctx context.Context) ([]Project, error) {
+	projects := []Project{}
+	req := &resourcemanagerpb.SearchProjectsRequest{PageSize: projectsPageSize}
+	rClient, err := c.projectsClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	it := rClient.SearchProjects(ctx, req)
 	for {
 		project, err := it.Next()
 		if err == iterator.Done {
@@ -283,20 +609,84 @@ func (c *Client) ListProjects(ctx context.Context) ([]string, error) {
 		if project.State != resourcemanagerpb.Project_ACTIVE {
 			continue
 		}
-		projectIDs = append(projectIDs, project.ProjectId)
+		projects = append(projects, Project{
+			ID:          project.GetProjectId(),
+			DisplayName: project.GetDisplayName(),
+			Parent:      project.GetParent(),
+		})
+	}
+	return projects, nil
+}
+
+// ListFolders returns the active folders directly under a folder or organization, such as organizations/123
+func (c *Client) ListFolders(ctx context.Context, parent string) ([]Folder, error) {
+	folders := []Folder{}
+	fClient, err := c.foldersClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	it := fClient.ListFolders(ctx, &resourcemanagerpb.ListFoldersRequest{Parent: parent})
+	for {
+		folder, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if folder.State != resourcemanagerpb.Folder_ACTIVE {
+			continue
+		}
+		folders = append(folders, Folder{
+			Name:        folder.GetName(),
+			DisplayName: folder.GetDisplayName(),
+			Parent:      folder.GetParent(),
+		})
+	}
+	return folders, nil
+}
+
+// ListOrganizations returns the visible active organizations
+func (c *Client) ListOrganizations(ctx context.Context) ([]Organization, error) {
+	organizations := []Organization{}
+	oClient, err := c.organizationsClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	it := oClient.SearchOrganizations(ctx, &resourcemanagerpb.SearchOrganizationsRequest{})
+	for {
+		organization, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if organization.State != resourcemanagerpb.Organization_ACTIVE {
+			continue
+		}
+		organizations = append(organizations, Organization{
+			Name:        organization.GetName(),
+			DisplayName: organization.GetDisplayName(),
+		})
 	}
-	return projectIDs, nil
+	return organizations, nil
 }
 
-// ListProjectBucketsViews returns all views of a log bucket
-func (c *Client) ListProjectBucketViews(ctx context.Context, projectId string, bucketId string) ([]string, error) {
-	views := []string{""}
+// ListBucketViews returns all views of a log bucket of a project, folder, organization or
+// billing account, such as projects/my-project
+func (c *Client) ListBucketViews(ctx context.Context, parent string, bucketID string) ([]LogView, error) {
+	views := []LogView{}
 
 	req := &loggingpb.ListViewsRequest{
 		// See https://pkg.go.dev/cloud.google.com/go/logging/apiv2/loggingpb#ListViewsRequest
-		Parent: fmt.Sprintf("projects/%s/locations/%s", projectId, bucketId),
+		Parent: fmt.Sprintf("%s/locations/%s", parent, bucketID),
 	}
-	it := c.configClient.ListViews(ctx, req)
+	configClient, err := c.logConfigClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	it := configClient.ListViews(ctx, req)
 	for {
 		resp, err := it.Next()
 		if err == iterator.Done {
@@ -307,23 +697,33 @@ func (c *Client) ListProjectBucketViews(ctx context.Context, projectId string, b
 		}
 		// See response format: https://cloud.google.com/logging/docs/reference/v2/rest/v2/billingAccounts.locations.buckets.views#LogView
 		view := strings.Split(resp.Name, "/")
-		// Append `my-view` for `projects/my-project/locations/global/buckets/my-bucket/views/my-view`
-		views = append(views, view[len(view)-1])
+		views = append(views, LogView{
+			// `my-view` for `projects/my-project/locations/global/buckets/my-bucket/views/my-view`
+			ID:          view[len(view)-1],
+			Name:        resp.GetName(),
+			Description: resp.GetDescription(),
+			Filter:      resp.GetFilter(),
+		})
 	}
 
 	return views, nil
 }
 
-// ListProjectBuckets returns all log buckets of a project
-func (c *Client) ListProjectBuckets(ctx context.Context, projectId string) ([]string, error) {
-	buckets := []string{""}
+// ListBuckets returns all log buckets of a project, folder, organization or billing account,
+// such as organizations/123
+func (c *Client) ListBuckets(ctx context.Context, parent string) ([]LogBucket, error) {
+	buckets := []LogBucket{}
 
 	req := &loggingpb.ListBucketsRequest{
 		// Request struct fields. Using '-' to get the full list
 		// See https://pkg.go.dev/cloud.google.com/go/logging/apiv2/loggingpb#ListBucketsRequest
-		Parent: fmt.Sprintf("projects/%s/locations/-", projectId),
+		Parent: fmt.Sprintf("%s/locations/-", parent),
+	}
+	configClient, err := c.logConfigClient(ctx)
+	if err != nil {
+		return nil, err
 	}
-	it := c.configClient.ListBuckets(ctx, req)
+	it := configClient.ListBuckets(ctx, req)
 	for {
 		resp, err := it.Next()
 		if err == iterator.Done {
@@ -334,98 +734,300 @@ func (c *Client) ListProjectBuckets(ctx context.Context, projectId string) ([]st
 		}
 		// See response format: https://cloud.google.com/logging/docs/reference/v2/rest/v2/billingAccounts.locations.buckets#LogBucket
 		bucket := strings.Split(resp.Name, "/")
-		// Get `global/buckets/my-bucket` for `projects/my-project/locations/global/buckets/my-bucket`
-		buckets = append(buckets, strings.Join(bucket[3:], "/"))
+		buckets = append(buckets, LogBucket{
+			// `global/buckets/my-bucket` for `projects/my-project/locations/global/buckets/my-bucket`,
+			// as all parents are named with two parts
+			ID:               strings.Join(bucket[3:], "/"),
+			Name:             resp.GetName(),
+			Description:      resp.GetDescription(),
+			RetentionDays:    resp.GetRetentionDays(),
+			LifecycleState:   resp.GetLifecycleState().String(),
+			Locked:           resp.GetLocked(),
+			AnalyticsEnabled: resp.GetAnalyticsEnabled(),
+			KmsKeyName:       resp.GetCmekSettings().GetKmsKeyName(),
+		})
 	}
 
 	return buckets, nil
 }
 
-// TestConnection queries for any log from the given project
-func (c *Client) TestConnection(ctx context.Context, projectID string) error {
-	start := time.Now()
+// ListSinks returns the sinks of a project, folder or organization, such as projects/my-project
+func (c *Client) ListSinks(ctx context.Context, parent string) ([]Sink, error) {
+	configClient, err := c.logConfigClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sinks := []Sink{}
+	it := configClient.ListSinks(ctx, &loggingpb.ListSinksRequest{Parent: parent})
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		exclusions := make([]Exclusion, 0, len(resp.GetExclusions()))
+		for _, e := range resp.GetExclusions() {
+			exclusions = append(exclusions, exclusionFromProto(e))
+		}
+		sinks = append(sinks, Sink{
+			Name:            resp.GetName(),
+			Destination:     resp.GetDestination(),
+			Filter:          resp.GetFilter(),
+			Description:     resp.GetDescription(),
+			Disabled:        resp.GetDisabled(),
+			Exclusions:      exclusions,
+			WriterIdentity:  resp.GetWriterIdentity(),
+			IncludeChildren: resp.GetIncludeChildren(),
+		})
+	}
+	return sinks, nil
+}
+
+// ListExclusions returns the exclusions of a project, folder or organization, such as folders/123
+func (c *Client) ListExclusions(ctx context.Context, parent string) ([]Exclusion, error) {
+	configClient, err := c.logConfigClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	exclusions := []Exclusion{}
+	it := configClient.ListExclusions(ctx, &loggingpb.ListExclusionsRequest{Parent: parent})
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		exclusions = append(exclusions, exclusionFromProto(resp))
+	}
+	return exclusions, nil
+}
+
+// ListLogNames returns the names of the logs of a project, or of a bucket or view if given,
+// such as projects/my-project/logs/syslog. At most maxLogNames names are returned
+func (c *Client) ListLogNames(ctx context.Context, projectID, bucketID, viewID string) ([]string, error) {
+	req := &loggingpb.ListLogsRequest{
+		// See https://pkg.go.dev/cloud.google.com/go/logging/apiv2/loggingpb#ListLogsRequest
+		Parent: legacyProjectResourceName(projectID),
+	}
+	if bucketID != "" {
+		req.ResourceNames = []string{projectResourceName(projectID, bucketID, viewID)}
+	}
+	lClient, err := c.loggingClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logNames := []string{}
+	it := lClient.ListLogs(ctx, req)
+	for len(logNames) < maxLogNames {
+		logName, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		logNames = append(logNames, logName)
+	}
+	return logNames, nil
+}
+
+// ListMonitoredResourceDescriptors returns the monitored resource types which logs can be written for
+func (c *Client) ListMonitoredResourceDescriptors(ctx context.Context) ([]MonitoredResourceDescriptor, error) {
+	lClient, err := c.loggingClient(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	listCtx, cancel := context.WithTimeout(ctx, time.Duration(testConnectionTimeout))
+	descriptors := []MonitoredResourceDescriptor{}
+	it := lClient.ListMonitoredResourceDescriptors(ctx, &loggingpb.ListMonitoredResourceDescriptorsRequest{})
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		labelKeys := make([]string, 0, len(resp.GetLabels()))
+		for _, label := range resp.GetLabels() {
+			labelKeys = append(labelKeys, label.GetKey())
+		}
+		descriptors = append(descriptors, MonitoredResourceDescriptor{
+			Type:        resp.GetType(),
+			DisplayName: resp.GetDisplayName(),
+			Description: resp.GetDescription(),
+			LabelKeys:   labelKeys,
+		})
+	}
+	return descriptors, nil
+}
 
+// TestConnection queries for any log from the given project, folder, organization or billing
+// account, such as projects/my-project
+func (c *Client) TestConnection(ctx context.Context, parent string) error {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, c.retry.TotalTimeout)
 	defer func() {
 		cancel()
 		log.DefaultLogger.Debug("Finished testConnection", "duration", time.Since(start).String())
 	}()
 
-	it := c.lClient.ListLogEntries(listCtx, &loggingpb.ListLogEntriesRequest{
-		ResourceNames: []string{legacyProjectResourceName(projectID)},
+	entriesClient, err := c.logEntriesClient(ctx)
+	if err != nil {
+		return fmt.Errorf("list entries: %w", err)
+	}
+	req := &loggingpb.ListLogEntriesRequest{
+		ResourceNames: []string{parent},
 		PageSize:      1,
-	})
-
-	if listCtx.Err() != nil {
-		return errors.New("list entries: timeout")
 	}
 
-	entry, err := it.Next()
-	if err == iterator.Done {
-		return errors.New("no entries")
-	}
-	if err == context.DeadlineExceeded {
+	var entries []*loggingpb.LogEntry
+	err = c.retry.do(ctx, func(ctx context.Context) error {
+		if err := c.rateLimiter.wait(ctx, rateLimitKey(parent)); err != nil {
+			return err
+		}
+		resp, err := entriesClient.ListLogEntries(ctx, req)
+		c.rateLimiter.backOffOnQuota(rateLimitKey(parent), err)
+		entries = resp.GetEntries()
+		return err
+	})
+	if ctx.Err() == context.DeadlineExceeded {
 		return errors.New("list entries: timeout")
 	}
 	if err != nil {
-		return fmt.Errorf("list entries: %w", err)
+		return fmt.Errorf("list entries: %w", quotaError(err))
 	}
-	if entry == nil {
+	if len(entries) == 0 {
 		return errors.New("no entries")
 	}
 
 	return nil
 }
 
-// ListLogs retrieves all logs matching some query filter up to the given limit
+// ListLogs retrieves all logs matching some query filter up to the given limit. Each page
+// request is retried according to the retry policy. When a page still fails, the entries of
+// the pages fetched before it are returned with the error
 func (c *Client) ListLogs(ctx context.Context, q *Query) ([]*loggingpb.LogEntry, error) {
-	// Never exceed the maximum page size
-	pageSize := int32(math.Min(float64(q.Limit), 1000))
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, c.retry.TotalTimeout)
+	defer func() {
+		cancel()
+		log.DefaultLogger.Debug("Finished listing logs", "duration", time.Since(start).String())
+	}()
 
-	resourceName := []string{}
-	if q.BucketId == "" {
-		resourceName = append(resourceName, legacyProjectResourceName(q.ProjectID))
-	} else {
-		resourceName = append(resourceName, projectResourceName(q.ProjectID, q.BucketId, q.ViewId))
+	entries := []*loggingpb.LogEntry{}
+	err := c.eachLogPage(ctx, q, func(page []*loggingpb.LogEntry) error {
+		entries = append(entries, page...)
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("list entries: no response within %s: %w", c.retry.TotalTimeout, err)
+		} else {
+			err = fmt.Errorf("list entries: %w", err)
+		}
+		if len(entries) == 0 {
+			return nil, err
+		}
+		return entries, err
 	}
+	return entries, nil
+}
+
+// StreamLogs retrieves the logs matching some query filter up to the given limit, and calls
+// fn with each page of them as it is fetched. Unlike ListLogs, the pages are not bounded by
+// the total timeout of the retry policy, so that large exports can take as long as the
+// context allows. An error returned by fn stops the listing and is returned as is
+func (c *Client) StreamLogs(ctx context.Context, q *Query, fn func([]*loggingpb.LogEntry) error) error {
+	var fnErr error
+	err := c.eachLogPage(ctx, q, func(page []*loggingpb.LogEntry) error {
+		fnErr = fn(page)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("list entries: %w", err)
+	}
+	return nil
+}
+
+// eachLogPage fetches the pages of the logs matching a query, newest first, until the limit
+// of the query is reached, and calls fn with each of them
+func (c *Client) eachLogPage(ctx context.Context, q *Query, fn func([]*loggingpb.LogEntry) error) error {
+	limit := max(q.Limit, 1)
 
+	parent, resourceName := q.resourceNames()
 	req := loggingpb.ListLogEntriesRequest{
 		ResourceNames: resourceName,
 		Filter:        q.String(),
 		OrderBy:       "timestamp desc",
-		PageSize:      pageSize,
 	}
 
-	start := time.Now()
-	defer func() {
-		log.DefaultLogger.Debug("Finished listing logs", "duration", time.Since(start).String())
-	}()
-
-	it := c.lClient.ListLogEntries(ctx, &req)
-	if it == nil {
-		return nil, errors.New("nil response")
+	entriesClient, err := c.logEntriesClient(ctx)
+	if err != nil {
+		return err
 	}
 
-	var i int64
-	entries := []*loggingpb.LogEntry{}
+	var fetched int64
 	for {
-		resp, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
+		var resp *loggingpb.ListLogEntriesResponse
+		// Never exceed the maximum page size
+		req.PageSize = int32(min(limit-fetched, 1000))
+		// Each page is a single call, with its own deadline and retries, so that the pages
+		// fetched before one fails are kept
+		err := c.retry.do(ctx, func(ctx context.Context) error {
+			if err := c.rateLimiter.wait(ctx, rateLimitKey(parent)); err != nil {
+				return err
+			}
+			var err error
+			resp, err = entriesClient.ListLogEntries(ctx, &req)
+			c.rateLimiter.backOffOnQuota(rateLimitKey(parent), err)
+			return err
+		})
 		if err != nil {
-			log.DefaultLogger.Error("error getting page", "error", err)
-			break
+			return quotaError(err)
 		}
+		page, nextPageToken := resp.GetEntries(), resp.GetNextPageToken()
 
-		entries = append(entries, resp)
-		i++
-		if i >= q.Limit {
-			break
+		if remaining := limit - fetched; int64(len(page)) > remaining {
+			page = page[:remaining]
+		}
+		fetched += int64(len(page))
+		if err := fn(page); err != nil {
+			return err
 		}
+		if fetched >= limit || nextPageToken == "" {
+			return nil
+		}
+		req.PageToken = nextPageToken
+	}
+}
+
+// resourceNames returns the project, folder, organization or billing account that a query
+// reads, and the resource names of its log entry requests
+func (q *Query) resourceNames() (string, []string) {
+	parent := q.Parent
+	if parent == "" {
+		parent = legacyProjectResourceName(q.ProjectID)
+	}
+	switch {
+	case q.LogScope != "":
+		return parent, []string{logScopeResourceName(q.ProjectID, q.LogScope)}
+	case q.BucketId == "":
+		return parent, []string{parent}
+	default:
+		return parent, []string{viewResourceName(parent, q.BucketId, q.ViewId)}
 	}
-	return entries, nil
 }
 
 func legacyProjectResourceName(projectID string) string {
@@ -433,10 +1035,30 @@ func legacyProjectResourceName(projectID string) string {
 }
 
 func projectResourceName(projectId string, bucketId string, viewId string) string {
-	if viewId != "" {
-		return fmt.Sprintf("projects/%s/locations/%s/views/%s", projectId, bucketId, viewId)
-	} else {
+	return viewResourceName(legacyProjectResourceName(projectId), bucketId, viewId)
+}
+
+// viewResourceName returns the name of a view of a log bucket of a project, folder,
+// organization or billing account, such as folders/123
+func viewResourceName(parent string, bucketID string, viewID string) string {
+	if viewID == "" {
 		// Use default `_AllLogs` view
-		return fmt.Sprintf("projects/%s/locations/%s/views/_AllLogs", projectId, bucketId)
+		viewID = "_AllLogs"
 	}
+	return fmt.Sprintf("%s/locations/%s/views/%s", parent, bucketID, viewID)
+}
+
+// rateLimitKey returns the key that requests reading a parent are rate limited by: the ID
+// of projects, and the name of folders, organizations and billing accounts
+func rateLimitKey(parent string) string {
+	if projectID, ok := strings.CutPrefix(parent, "projects/"); ok {
+		return projectID
+	}
+	return parent
+}
+
+// logScopeResourceName returns the name of a log scope of a project. Log scopes only exist in
+// the global location
+func logScopeResourceName(projectID, logScope string) string {
+	return fmt.Sprintf("projects/%s/locations/global/logScopes/%s", projectID, logScope)
 }
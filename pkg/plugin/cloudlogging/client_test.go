@@ -0,0 +1,731 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	resourcemanagerpb "cloud.google.com/go/resourcemanager/apiv3/resourcemanagerpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/api/label"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// stsStandIn is a local stand-in for the Security Token Service, which exchanges
+// any subject token for an access token derived from it
+type stsStandIn struct {
+	*httptest.Server
+}
+
+func newSTSStandIn(t *testing.T) *stsStandIn {
+	sts := &stsStandIn{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:token-exchange" {
+			http.Error(w, "unexpected grant type", http.StatusBadRequest)
+			return
+		}
+		subjectToken := r.Form.Get("subject_token")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":      "federated-" + subjectToken,
+			"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+			"token_type":        "Bearer",
+			"expires_in":        3600,
+		})
+	})
+	mux.HandleFunc("/subject-token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "True" {
+			http.Error(w, "missing header", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "url-subject-token"}`)
+	})
+	sts.Server = httptest.NewServer(mux)
+	t.Cleanup(sts.Close)
+	return sts
+}
+
+func (s *stsStandIn) credentials(source map[string]any) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"type":               "external_account",
+		"audience":           "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          s.URL + "/v1/token",
+		"credential_source":  source,
+	})
+	return b
+}
+
+func TestExternalAccountTokenSource(t *testing.T) {
+	sts := newSTSStandIn(t)
+
+	t.Run("file source", func(t *testing.T) {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(tokenFile, []byte("file-subject-token"), 0600))
+
+		ts, err := externalAccountTokenSource(context.Background(), sts.credentials(map[string]any{
+			"file": tokenFile,
+		}))
+		require.NoError(t, err)
+
+		token, err := ts.Token()
+		require.NoError(t, err)
+		require.Equal(t, "federated-file-subject-token", token.AccessToken)
+	})
+
+	t.Run("URL source", func(t *testing.T) {
+		ts, err := externalAccountTokenSource(context.Background(), sts.credentials(map[string]any{
+			"url":     sts.URL + "/subject-token",
+			"headers": map[string]string{"Metadata": "True"},
+			"format":  map[string]string{"type": "json", "subject_token_field_name": "access_token"},
+		}))
+		require.NoError(t, err)
+
+		token, err := ts.Token()
+		require.NoError(t, err)
+		require.Equal(t, "federated-url-subject-token", token.AccessToken)
+	})
+
+	t.Run("executable source", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("requires a shell script")
+		}
+		t.Setenv("GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES", "1")
+
+		script := filepath.Join(t.TempDir(), "token.sh")
+		output := fmt.Sprintf(`{"version": 1, "success": true, "token_type": "urn:ietf:params:oauth:token-type:jwt", "id_token": "exec-subject-token", "expiration_time": %d}`,
+			time.Now().Add(time.Hour).Unix())
+		require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho '"+output+"'\n"), 0700))
+
+		ts, err := externalAccountTokenSource(context.Background(), sts.credentials(map[string]any{
+			"executable": map[string]any{"command": script, "timeout_millis": 5000},
+		}))
+		require.NoError(t, err)
+
+		token, err := ts.Token()
+		require.NoError(t, err)
+		require.Equal(t, "federated-exec-subject-token", token.AccessToken)
+	})
+
+	t.Run("STS rejects the exchange", func(t *testing.T) {
+		creds, _ := json.Marshal(map[string]any{
+			"type":               "external_account",
+			"audience":           "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+			"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+			"token_url":          sts.URL + "/missing",
+			"credential_source":  map[string]any{"url": sts.URL + "/subject-token", "headers": map[string]string{"Metadata": "True"}},
+		})
+		ts, err := externalAccountTokenSource(context.Background(), creds)
+		require.NoError(t, err)
+
+		_, err = ts.Token()
+		require.Error(t, err)
+	})
+
+	t.Run("not an external account", func(t *testing.T) {
+		_, err := externalAccountTokenSource(context.Background(), []byte(`{"type": "service_account"}`))
+		require.ErrorContains(t, err, "external account credentials")
+	})
+}
+
+func TestNewClientWithExternalAccount(t *testing.T) {
+	sts := newSTSStandIn(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("file-subject-token"), 0600))
+
+	client, err := NewClientWithExternalAccount(context.Background(), sts.credentials(map[string]any{
+		"file": tokenFile,
+	}), "")
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+}
+
+func TestNew(t *testing.T) {
+	t.Run("sub-clients are created on first use", func(t *testing.T) {
+		client, err := New(context.Background(), WithAccessToken("token"), WithUniverseDomain("googleapis.com"))
+		require.NoError(t, err)
+		require.Empty(t, client.conns)
+		require.Nil(t, client.lClient)
+		require.Nil(t, client.configClient)
+		require.Nil(t, client.rClient)
+
+		lClient, err := client.loggingClient(context.Background())
+		require.NoError(t, err)
+		require.Len(t, client.conns, 1)
+		configClient, err := client.logConfigClient(context.Background())
+		require.NoError(t, err)
+		require.Len(t, client.conns, 1, "the logging and config clients share one connection")
+
+		again, err := client.loggingClient(context.Background())
+		require.NoError(t, err)
+		require.Same(t, lClient, again)
+		require.NotNil(t, configClient)
+
+		rClient, err := client.projectsClient(context.Background())
+		require.NoError(t, err)
+		require.NotNil(t, rClient)
+		require.Len(t, client.conns, 2)
+
+		require.NoError(t, client.Close())
+		require.Empty(t, client.conns)
+		require.NoError(t, client.Close())
+
+		// Closed clients do not dial again
+		_, err = client.loggingClient(context.Background())
+		require.ErrorIs(t, err, errClientClosed)
+		err = client.getJSON(context.Background(), "https://logging.googleapis.com/v2/entries", &struct{}{})
+		require.ErrorIs(t, err, errClientClosed)
+		require.Empty(t, client.conns)
+		require.Nil(t, client.httpClient)
+	})
+
+	t.Run("connections are dialed at the endpoints of the universe domain", func(t *testing.T) {
+		client, err := New(context.Background(), WithAccessToken("token"), WithUniverseDomain("example.com"))
+		require.NoError(t, err)
+		defer client.Close()
+
+		_, err = client.loggingClient(context.Background())
+		require.NoError(t, err)
+		require.Contains(t, client.conns, "logging.example.com:443")
+	})
+
+	t.Run("unused client", func(t *testing.T) {
+		client, err := New(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, client.Close())
+	})
+
+	t.Run("multiple credential sources", func(t *testing.T) {
+		_, err := New(context.Background(), WithAccessToken("token"), WithDefaultCredentials())
+		require.ErrorIs(t, err, errMultipleCredentials)
+	})
+
+	t.Run("invalid service account key", func(t *testing.T) {
+		_, err := New(context.Background(), WithCredentialsJSON([]byte(`{"type": "service_account", "private_key": "dummy-private-key", "client_email": "test@test.iam.gserviceaccount.com"}`)))
+		require.ErrorContains(t, err, "service account credentials")
+
+		_, err = New(context.Background(), WithCredentialsJSON([]byte(`not json`)))
+		require.ErrorContains(t, err, "parse credentials")
+	})
+
+	t.Run("invalid external account", func(t *testing.T) {
+		_, err := New(context.Background(), WithExternalAccount([]byte(`{"type": "service_account"}`)))
+		require.ErrorContains(t, err, "external account credentials")
+	})
+}
+
+// fakeLoggingServer serves the logging, config and resource manager APIs over plaintext gRPC
+type fakeLoggingServer struct {
+	loggingpb.UnimplementedLoggingServiceV2Server
+	loggingpb.UnimplementedConfigServiceV2Server
+	resourcemanagerpb.UnimplementedProjectsServer
+
+	addr        string
+	requests    []*loggingpb.ListLogEntriesRequest
+	logRequests []*loggingpb.ListLogsRequest
+}
+
+func newFakeLoggingServer(t *testing.T) *fakeLoggingServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	fake := &fakeLoggingServer{addr: lis.Addr().String()}
+	server := grpc.NewServer()
+	loggingpb.RegisterLoggingServiceV2Server(server, fake)
+	loggingpb.RegisterConfigServiceV2Server(server, fake)
+	resourcemanagerpb.RegisterProjectsServer(server, fake)
+	resourcemanagerpb.RegisterFoldersServer(server, fakeFoldersServer{})
+	resourcemanagerpb.RegisterOrganizationsServer(server, fakeOrganizationsServer{})
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return fake
+}
+
+func (f *fakeLoggingServer) ListLogEntries(ctx context.Context, req *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+	f.requests = append(f.requests, req)
+	return &loggingpb.ListLogEntriesResponse{
+		Entries: []*loggingpb.LogEntry{
+			{InsertId: "1", LogName: "projects/test-project/logs/app", Payload: &loggingpb.LogEntry_TextPayload{TextPayload: "hello"}},
+		},
+	}, nil
+}
+
+func (f *fakeLoggingServer) ListLogs(ctx context.Context, req *loggingpb.ListLogsRequest) (*loggingpb.ListLogsResponse, error) {
+	f.logRequests = append(f.logRequests, req)
+	if req.PageToken == "" {
+		return &loggingpb.ListLogsResponse{LogNames: []string{"projects/test-project/logs/syslog"}, NextPageToken: "page-2"}, nil
+	}
+	return &loggingpb.ListLogsResponse{LogNames: []string{"projects/test-project/logs/cloudaudit.googleapis.com%2Factivity"}}, nil
+}
+
+func (f *fakeLoggingServer) ListMonitoredResourceDescriptors(ctx context.Context, req *loggingpb.ListMonitoredResourceDescriptorsRequest) (*loggingpb.ListMonitoredResourceDescriptorsResponse, error) {
+	return &loggingpb.ListMonitoredResourceDescriptorsResponse{
+		ResourceDescriptors: []*monitoredres.MonitoredResourceDescriptor{
+			{
+				Type:        "k8s_container",
+				DisplayName: "Kubernetes Container",
+				Description: "A Kubernetes container instance.",
+				Labels: []*label.LabelDescriptor{
+					{Key: "project_id"}, {Key: "namespace_name"}, {Key: "container_name"},
+				},
+			},
+			{Type: "global", DisplayName: "Global"},
+		},
+	}, nil
+}
+
+func (f *fakeLoggingServer) ListBuckets(ctx context.Context, req *loggingpb.ListBucketsRequest) (*loggingpb.ListBucketsResponse, error) {
+	return &loggingpb.ListBucketsResponse{
+		Buckets: []*loggingpb.LogBucket{{
+			Name:             strings.TrimSuffix(req.Parent, "/locations/-") + "/locations/global/buckets/_Default",
+			RetentionDays:    30,
+			LifecycleState:   loggingpb.LifecycleState_ACTIVE,
+			AnalyticsEnabled: true,
+		}},
+	}, nil
+}
+
+func (f *fakeLoggingServer) ListViews(ctx context.Context, req *loggingpb.ListViewsRequest) (*loggingpb.ListViewsResponse, error) {
+	return &loggingpb.ListViewsResponse{
+		Views: []*loggingpb.LogView{{Name: req.Parent + "/views/my-view", Filter: `resource.type="k8s_container"`}},
+	}, nil
+}
+
+func (f *fakeLoggingServer) ListSinks(ctx context.Context, req *loggingpb.ListSinksRequest) (*loggingpb.ListSinksResponse, error) {
+	return &loggingpb.ListSinksResponse{
+		Sinks: []*loggingpb.LogSink{
+			{
+				Name:           "_Default",
+				Destination:    "logging.googleapis.com/" + req.Parent + "/locations/global/buckets/_Default",
+				Filter:         `NOT LOG_ID("cloudaudit.googleapis.com/activity")`,
+				Exclusions:     []*loggingpb.LogExclusion{{Name: "debug", Filter: "severity < INFO", Disabled: true}},
+				WriterIdentity: "serviceAccount:service-123@gcp-sa-logging.iam.gserviceaccount.com",
+			},
+		},
+	}, nil
+}
+
+func (f *fakeLoggingServer) ListExclusions(ctx context.Context, req *loggingpb.ListExclusionsRequest) (*loggingpb.ListExclusionsResponse, error) {
+	if req.Parent != "folders/123" {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+	return &loggingpb.ListExclusionsResponse{
+		Exclusions: []*loggingpb.LogExclusion{{Name: "gke-noise", Description: "Noisy containers", Filter: `resource.type="k8s_container"`}},
+	}, nil
+}
+
+func (f *fakeLoggingServer) SearchProjects(ctx context.Context, req *resourcemanagerpb.SearchProjectsRequest) (*resourcemanagerpb.SearchProjectsResponse, error) {
+	return &resourcemanagerpb.SearchProjectsResponse{
+		Projects: []*resourcemanagerpb.Project{
+			{ProjectId: "test-project", DisplayName: "Test Project", Parent: "folders/123", State: resourcemanagerpb.Project_ACTIVE},
+			{ProjectId: "deleted-project", State: resourcemanagerpb.Project_DELETE_REQUESTED},
+		},
+	}, nil
+}
+
+// fakeFoldersServer and fakeOrganizationsServer serve the resource hierarchy next to the
+// fake logging server. Their IAM methods clash with those of the projects server
+type fakeFoldersServer struct {
+	resourcemanagerpb.UnimplementedFoldersServer
+}
+
+type fakeOrganizationsServer struct {
+	resourcemanagerpb.UnimplementedOrganizationsServer
+}
+
+func (fakeFoldersServer) ListFolders(ctx context.Context, req *resourcemanagerpb.ListFoldersRequest) (*resourcemanagerpb.ListFoldersResponse, error) {
+	if req.Parent != "organizations/456" {
+		return nil, status.Error(codes.PermissionDenied, "The caller does not have permission")
+	}
+	return &resourcemanagerpb.ListFoldersResponse{
+		Folders: []*resourcemanagerpb.Folder{
+			{Name: "folders/123", DisplayName: "Team A", Parent: req.Parent, State: resourcemanagerpb.Folder_ACTIVE},
+			{Name: "folders/789", DisplayName: "Deleted", Parent: req.Parent, State: resourcemanagerpb.Folder_DELETE_REQUESTED},
+		},
+	}, nil
+}
+
+func (fakeOrganizationsServer) SearchOrganizations(ctx context.Context, req *resourcemanagerpb.SearchOrganizationsRequest) (*resourcemanagerpb.SearchOrganizationsResponse, error) {
+	return &resourcemanagerpb.SearchOrganizationsResponse{
+		Organizations: []*resourcemanagerpb.Organization{
+			{Name: "organizations/456", DisplayName: "example.com", State: resourcemanagerpb.Organization_ACTIVE},
+		},
+	}, nil
+}
+
+// serviceAccountKey returns a service account key whose tokens are requested from tokenURL
+func serviceAccountKey(t *testing.T, tokenURL string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test-project",
+		"private_key_id": "test-key",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "grafana@test-project.iam.gserviceaccount.com",
+		"token_uri":      tokenURL,
+	})
+	require.NoError(t, err)
+	return b
+}
+
+// tlsLoggingServer serves ListLogEntries over TLS, recording the authorization of each call
+type tlsLoggingServer struct {
+	loggingpb.UnimplementedLoggingServiceV2Server
+
+	addr string
+	// opts trust the certificate of the server
+	opts []option.ClientOption
+
+	mu             sync.Mutex
+	authorizations []string
+}
+
+func newTLSLoggingServer(t *testing.T) *tlsLoggingServer {
+	// Borrow the certificate of a TLS test server, valid for 127.0.0.1
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	cert, roots := certServer.TLS.Certificates[0], x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+	certServer.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fake := &tlsLoggingServer{
+		addr: lis.Addr().String(),
+		opts: []option.ClientOption{option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))},
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	loggingpb.RegisterLoggingServiceV2Server(server, fake)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return fake
+}
+
+func (f *tlsLoggingServer) ListLogEntries(ctx context.Context, req *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.authorizations = append(f.authorizations, strings.Join(md.Get("authorization"), ","))
+	return &loggingpb.ListLogEntriesResponse{}, nil
+}
+
+func TestNew_SelfSignedJWT(t *testing.T) {
+	var tokenRequests atomic.Int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "exchanged", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer tokenServer.Close()
+	fake := newTLSLoggingServer(t)
+
+	client, err := New(context.Background(), WithCredentialsJSON(serviceAccountKey(t, tokenServer.URL)), WithEndpoints(Endpoints{Logging: fake.addr}))
+	require.NoError(t, err)
+	defer client.Close()
+	client.opts = append(client.opts, fake.opts...)
+
+	_, err = client.ListLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 1})
+	require.NoError(t, err)
+
+	// Service account keys sign their own JWTs, without contacting the token endpoint
+	require.Zero(t, tokenRequests.Load())
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.Len(t, fake.authorizations, 1)
+	token, ok := strings.CutPrefix(fake.authorizations[0], "Bearer ")
+	require.True(t, ok)
+	require.Len(t, strings.Split(token, "."), 3)
+}
+
+func TestNew_PlaintextEndpoints(t *testing.T) {
+	fake := newFakeLoggingServer(t)
+
+	// Credential sources are ignored in plaintext mode
+	client, err := New(context.Background(), WithAccessToken("ignored"), WithPlaintext(), WithEndpoints(Endpoints{
+		Logging:         fake.addr,
+		ResourceManager: fake.addr,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	entries, err := client.ListLogs(context.Background(), &Query{ProjectID: "test-project", Filter: `severity="ERROR"`, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "hello", entries[0].GetTextPayload())
+	require.Equal(t, []string{"projects/test-project"}, fake.requests[0].ResourceNames)
+
+	require.NoError(t, client.TestConnection(context.Background(), "projects/test-project"))
+
+	buckets, err := client.ListBuckets(context.Background(), "projects/test-project")
+	require.NoError(t, err)
+	require.Equal(t, []LogBucket{{
+		ID:               "global/buckets/_Default",
+		Name:             "projects/test-project/locations/global/buckets/_Default",
+		RetentionDays:    30,
+		LifecycleState:   "ACTIVE",
+		AnalyticsEnabled: true,
+	}}, buckets)
+
+	views, err := client.ListBucketViews(context.Background(), "projects/test-project", "global/buckets/my-bucket")
+	require.NoError(t, err)
+	require.Equal(t, []LogView{{
+		ID:     "my-view",
+		Name:   "projects/test-project/locations/global/buckets/my-bucket/views/my-view",
+		Filter: `resource.type="k8s_container"`,
+	}}, views)
+
+	buckets, err = client.ListBuckets(context.Background(), "organizations/123")
+	require.NoError(t, err)
+	require.Equal(t, "global/buckets/_Default", buckets[0].ID)
+	require.Equal(t, "organizations/123/locations/global/buckets/_Default", buckets[0].Name)
+
+	projects, err := client.ListProjects(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []Project{{ID: "test-project", DisplayName: "Test Project", Parent: "folders/123"}}, projects)
+
+	// The config API defaults to the logging endpoint, and both share one connection
+	require.Len(t, client.conns, 1)
+}
+
+func TestListFoldersAndOrganizations(t *testing.T) {
+	fake := newFakeLoggingServer(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{ResourceManager: fake.addr}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	organizations, err := client.ListOrganizations(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []Organization{{Name: "organizations/456", DisplayName: "example.com"}}, organizations)
+
+	folders, err := client.ListFolders(context.Background(), "organizations/456")
+	require.NoError(t, err)
+	require.Equal(t, []Folder{{Name: "folders/123", DisplayName: "Team A", Parent: "organizations/456"}}, folders)
+
+	_, err = client.ListFolders(context.Background(), "folders/123")
+	require.ErrorContains(t, err, "The caller does not have permission")
+
+	// The projects, folders and organizations clients share one connection
+	_, err = client.ListProjects(context.Background())
+	require.NoError(t, err)
+	require.Len(t, client.conns, 1)
+}
+
+func TestImpersonation_Validate(t *testing.T) {
+	target := "grafana@my-project.iam.gserviceaccount.com"
+	for name, tc := range map[string]struct {
+		impersonation Impersonation
+		err           string
+	}{
+		"target only": {impersonation: Impersonation{TargetPrincipal: target}},
+		"full": {impersonation: Impersonation{
+			TargetPrincipal: target,
+			Delegates:       []string{"hop@other-org.iam.gserviceaccount.com"},
+			Scopes:          []string{"https://www.googleapis.com/auth/logging.read"},
+			Lifetime:        12 * time.Hour,
+		}},
+		"missing target":   {impersonation: Impersonation{}, err: "missing service account to impersonate"},
+		"invalid target":   {impersonation: Impersonation{TargetPrincipal: "grafana"}, err: `invalid service account to impersonate: "grafana"`},
+		"invalid delegate": {impersonation: Impersonation{TargetPrincipal: target, Delegates: []string{"projects/-/serviceAccounts/hop"}}, err: "invalid delegate service account"},
+		"short scope":      {impersonation: Impersonation{TargetPrincipal: target, Scopes: []string{"logging.read"}}, err: `invalid scope: "logging.read"`},
+		"lifetime too long": {
+			impersonation: Impersonation{TargetPrincipal: target, Lifetime: 13 * time.Hour},
+			err:           "invalid token lifetime 13h0m0s: it must be at most 12h0m0s",
+		},
+		"negative lifetime": {impersonation: Impersonation{TargetPrincipal: target, Lifetime: -time.Minute}, err: "invalid token lifetime"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tc.impersonation.Validate()
+			if tc.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tc.err)
+
+			_, err = New(context.Background(), WithImpersonationConfig(nil, tc.impersonation))
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+// rewriteTransport sends all requests to a local server
+type rewriteTransport struct {
+	target string
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.target
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestLifetimeTokenSource(t *testing.T) {
+	var requests []map[string]any
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, body)
+		// The token is about to expire, so the next call needs a new one
+		json.NewEncoder(w).Encode(map[string]string{
+			"accessToken": fmt.Sprintf("impersonated-%d", len(requests)),
+			"expireTime":  time.Now().Add(5 * time.Second).UTC().Format(time.RFC3339),
+		})
+	}))
+	defer iam.Close()
+
+	ts := oauth2.ReuseTokenSource(nil, &lifetimeTokenSource{
+		ctx: context.Background(),
+		config: impersonate.CredentialsConfig{
+			TargetPrincipal: "grafana@my-project.iam.gserviceaccount.com",
+			Delegates:       []string{"hop@other-org.iam.gserviceaccount.com"},
+			Scopes:          []string{"https://www.googleapis.com/auth/logging.read"},
+			Lifetime:        30 * time.Minute,
+		},
+		opts: []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: &rewriteTransport{target: iam.Listener.Addr().String()}})},
+	})
+
+	token, err := ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "impersonated-1", token.AccessToken)
+	token, err = ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "impersonated-2", token.AccessToken)
+
+	require.Equal(t, map[string]any{
+		"delegates": []any{"projects/-/serviceAccounts/hop@other-org.iam.gserviceaccount.com"},
+		"lifetime":  "1800s",
+		"scope":     []any{"https://www.googleapis.com/auth/logging.read"},
+	}, requests[0])
+}
+
+func TestListLogNames(t *testing.T) {
+	fake := newFakeLoggingServer(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	logNames, err := client.ListLogNames(context.Background(), "test-project", "", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"projects/test-project/logs/syslog",
+		"projects/test-project/logs/cloudaudit.googleapis.com%2Factivity",
+	}, logNames)
+	require.Equal(t, "projects/test-project", fake.logRequests[0].Parent)
+	require.Empty(t, fake.logRequests[0].ResourceNames)
+
+	_, err = client.ListLogNames(context.Background(), "test-project", "global/buckets/my-bucket", "my-view")
+	require.NoError(t, err)
+	require.Equal(t, []string{"projects/test-project/locations/global/buckets/my-bucket/views/my-view"}, fake.logRequests[2].ResourceNames)
+
+	_, err = client.ListLogNames(context.Background(), "test-project", "global/buckets/my-bucket", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"projects/test-project/locations/global/buckets/my-bucket/views/_AllLogs"}, fake.logRequests[4].ResourceNames)
+}
+
+func TestListMonitoredResourceDescriptors(t *testing.T) {
+	fake := newFakeLoggingServer(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	descriptors, err := client.ListMonitoredResourceDescriptors(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []MonitoredResourceDescriptor{
+		{
+			Type:        "k8s_container",
+			DisplayName: "Kubernetes Container",
+			Description: "A Kubernetes container instance.",
+			LabelKeys:   []string{"project_id", "namespace_name", "container_name"},
+		},
+		{Type: "global", DisplayName: "Global", LabelKeys: []string{}},
+	}, descriptors)
+}
+
+func TestQuery_String(t *testing.T) {
+	q := Query{Filter: `resource.type="k8s_container"`}
+	q.TimeRange.From = "2024-01-01T00:00:00Z"
+	q.TimeRange.To = "2024-01-01T01:00:00Z"
+	require.Equal(t, `resource.type="k8s_container" AND timestamp >= "2024-01-01T00:00:00Z" AND timestamp <= "2024-01-01T01:00:00Z"`, q.String())
+
+	for _, filter := range []string{"", " \n\t"} {
+		q.Filter = filter
+		require.Equal(t, `timestamp >= "2024-01-01T00:00:00Z" AND timestamp <= "2024-01-01T01:00:00Z"`, q.String())
+	}
+}
+
+func TestListSinksAndExclusions(t *testing.T) {
+	fake := newFakeLoggingServer(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	sinks, err := client.ListSinks(context.Background(), "projects/test-project")
+	require.NoError(t, err)
+	require.Equal(t, []Sink{
+		{
+			Name:           "_Default",
+			Destination:    "logging.googleapis.com/projects/test-project/locations/global/buckets/_Default",
+			Filter:         `NOT LOG_ID("cloudaudit.googleapis.com/activity")`,
+			Exclusions:     []Exclusion{{Name: "debug", Filter: "severity < INFO", Disabled: true}},
+			WriterIdentity: "serviceAccount:service-123@gcp-sa-logging.iam.gserviceaccount.com",
+		},
+	}, sinks)
+
+	exclusions, err := client.ListExclusions(context.Background(), "folders/123")
+	require.NoError(t, err)
+	require.Equal(t, []Exclusion{{Name: "gke-noise", Description: "Noisy containers", Filter: `resource.type="k8s_container"`}}, exclusions)
+
+	_, err = client.ListExclusions(context.Background(), "organizations/456")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -17,7 +17,12 @@ package cloudlogging
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"cloud.google.com/go/logging/apiv2/loggingpb"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
@@ -25,6 +30,8 @@ import (
 	rlpb "google.golang.org/genproto/googleapis/appengine/logging/v1"
 	alpb "google.golang.org/genproto/googleapis/cloud/audit"
 	ltype "google.golang.org/genproto/googleapis/logging/type"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -62,7 +69,7 @@ func GetLogEntryMessage(entry *loggingpb.LogEntry) (string, error) {
 	}
 }
 
-// GetLogLabels flattens a log entry's labels + resource labels into a map
+// GetLogLabels flattens a log entry's labels + resource labels + metadata into a map
 func GetLogLabels(entry *loggingpb.LogEntry) data.Labels {
 	labels := make(data.Labels)
 	for k, v := range entry.GetLabels() {
@@ -98,7 +105,7 @@ func GetLogLabels(entry *loggingpb.LogEntry) data.Labels {
 			if err := t.ProtoPayload.UnmarshalTo(&a); err != nil {
 				log.DefaultLogger.Error("Could not get AuditLog payload out of LogEntry: %v", err)
 			} else {
-				byteArr, _ := json.Marshal(a)
+				byteArr, _ := json.Marshal(&a)
 				var inInterface map[string]*structpb.Value
 				json.Unmarshal(byteArr, &inInterface)
 				for k, v := range inInterface {
@@ -110,7 +117,7 @@ func GetLogLabels(entry *loggingpb.LogEntry) data.Labels {
 			if err := t.ProtoPayload.UnmarshalTo(&r); err != nil {
 				log.DefaultLogger.Error("Could not get RequestLog payload out of LogEntry: %v", err)
 			} else {
-				byteArr, _ := json.Marshal(r)
+				byteArr, _ := json.Marshal(&r)
 				var inInterface map[string]*structpb.Value
 				json.Unmarshal(byteArr, &inInterface)
 				for k, v := range inInterface {
@@ -145,10 +152,75 @@ func GetLogLabels(entry *loggingpb.LogEntry) data.Labels {
 	if spanId != "" {
 		labels["spanId"] = entry.GetSpanId()
 	}
+	if entry.GetTraceSampled() {
+		labels["traceSampled"] = "true"
+	}
+
+	addLogEntryMetadata(labels, entry)
 
 	return labels
 }
 
+// addLogEntryMetadata adds the remaining LogEntry metadata (log name, receive time,
+// operation, source location and split information) to the labels
+func addLogEntryMetadata(labels data.Labels, entry *loggingpb.LogEntry) {
+	if logName := entry.GetLogName(); logName != "" {
+		labels["logName"] = logName
+	}
+	if entry.GetReceiveTimestamp() != nil {
+		labels["receiveTimestamp"] = entry.GetReceiveTimestamp().AsTime().Format(time.RFC3339Nano)
+	}
+
+	if operation := entry.GetOperation(); operation != nil {
+		if operation.GetId() != "" {
+			labels["operation.id"] = operation.GetId()
+		}
+		if operation.GetProducer() != "" {
+			labels["operation.producer"] = operation.GetProducer()
+		}
+		labels["operation.first"] = strconv.FormatBool(operation.GetFirst())
+		labels["operation.last"] = strconv.FormatBool(operation.GetLast())
+	}
+
+	if sourceLocation := entry.GetSourceLocation(); sourceLocation != nil {
+		if sourceLocation.GetFile() != "" {
+			labels["sourceLocation.file"] = sourceLocation.GetFile()
+		}
+		if sourceLocation.GetLine() != 0 {
+			labels["sourceLocation.line"] = strconv.FormatInt(sourceLocation.GetLine(), 10)
+		}
+		if sourceLocation.GetFunction() != "" {
+			labels["sourceLocation.function"] = sourceLocation.GetFunction()
+		}
+	}
+
+	if split := entry.GetSplit(); split != nil {
+		labels["split.uid"] = split.GetUid()
+		labels["split.index"] = strconv.Itoa(int(split.GetIndex()))
+		labels["split.totalSplits"] = strconv.Itoa(int(split.GetTotalSplits()))
+	}
+}
+
+// AddErrorGroupLabels adds the ids of the Error Reporting error groups of a log entry to its
+// labels, comma separated. The gRPC LogEntry has no error groups, which ListErrorGroups reads
+func AddErrorGroupLabels(labels data.Labels, groupIDs []string) {
+	if len(groupIDs) > 0 {
+		labels["errorGroups"] = strings.Join(groupIDs, ",")
+	}
+}
+
+// ErrorEntryIDs returns the insert IDs of the log entries with a severity of ERROR or above,
+// which are the ones Error Reporting groups
+func ErrorEntryIDs(entries []*loggingpb.LogEntry) []string {
+	ids := []string{}
+	for _, entry := range entries {
+		if entry.GetSeverity() >= ltype.LogSeverity_ERROR && entry.GetInsertId() != "" {
+			ids = append(ids, entry.GetInsertId())
+		}
+	}
+	return ids
+}
+
 // GetLogLevel maps the string value of a LogSeverity to one supported by Grafana
 func GetLogLevel(severity ltype.LogSeverity) string {
 	switch severity {
@@ -177,6 +249,185 @@ func fieldToLabels(labels data.Labels, fieldName string, field *structpb.Value)
 			fieldToLabels(labels, fmt.Sprintf("%s.%s", fieldName, key), value)
 		}
 	default:
-		labels[fieldName] = field.String()
+		labels[fieldName] = valueText(field)
+	}
+}
+
+// valueText returns the protobuf text format of a value, with single spaces between fields.
+// The protobuf library randomly adds spaces between fields, so that nothing relies on its output
+func valueText(value *structpb.Value) string {
+	switch t := value.GetKind().(type) {
+	case *structpb.Value_ListValue:
+		items := make([]string, 0, len(t.ListValue.GetValues()))
+		for _, item := range t.ListValue.GetValues() {
+			items = append(items, fmt.Sprintf("values:{%s}", valueText(item)))
+		}
+		return fmt.Sprintf("list_value:{%s}", strings.Join(items, " "))
+	case *structpb.Value_StructValue:
+		fields := t.StructValue.GetFields()
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]string, 0, len(keys))
+		for _, key := range keys {
+			items = append(items, fmt.Sprintf("fields:{key:%s value:{%s}}", strconv.Quote(key), valueText(fields[key])))
+		}
+		return fmt.Sprintf("struct_value:{%s}", strings.Join(items, " "))
+	default:
+		// Scalars are a single field, without spaces
+		return prototext.MarshalOptions{}.Format(value)
+	}
+}
+
+// IncompleteSplits returns the uids of split log entries for which not every piece is present
+func IncompleteSplits(entries []*loggingpb.LogEntry) []string {
+	pieces := map[string]map[int32]bool{}
+	totals := map[string]int32{}
+	uids := []string{}
+	for _, entry := range entries {
+		split := entry.GetSplit()
+		if split.GetUid() == "" {
+			continue
+		}
+		if _, ok := pieces[split.GetUid()]; !ok {
+			pieces[split.GetUid()] = map[int32]bool{}
+			uids = append(uids, split.GetUid())
+		}
+		pieces[split.GetUid()][split.GetIndex()] = true
+		totals[split.GetUid()] = split.GetTotalSplits()
+	}
+
+	incomplete := []string{}
+	for _, uid := range uids {
+		if int32(len(pieces[uid])) < totals[uid] {
+			incomplete = append(incomplete, uid)
+		}
+	}
+	return incomplete
+}
+
+// MergeSplitLogEntries reassembles split log entries into a single entry per split uid,
+// placed where the first piece of the split appeared. The payloads of the pieces are
+// concatenated in index order; splits with missing pieces are merged from the pieces available
+func MergeSplitLogEntries(entries []*loggingpb.LogEntry) []*loggingpb.LogEntry {
+	splits := map[string][]*loggingpb.LogEntry{}
+	for _, entry := range entries {
+		if uid := entry.GetSplit().GetUid(); uid != "" {
+			splits[uid] = append(splits[uid], entry)
+		}
+	}
+	if len(splits) == 0 {
+		return entries
+	}
+
+	merged := []*loggingpb.LogEntry{}
+	for _, entry := range entries {
+		uid := entry.GetSplit().GetUid()
+		if uid == "" {
+			merged = append(merged, entry)
+			continue
+		}
+		pieces, ok := splits[uid]
+		if !ok {
+			// Already merged into an earlier entry
+			continue
+		}
+		delete(splits, uid)
+		merged = append(merged, mergeSplitPieces(pieces))
+	}
+	return merged
+}
+
+// mergeSplitPieces combines the pieces of one split log entry, based on the first piece
+func mergeSplitPieces(pieces []*loggingpb.LogEntry) *loggingpb.LogEntry {
+	sort.SliceStable(pieces, func(i, j int) bool {
+		return pieces[i].GetSplit().GetIndex() < pieces[j].GetSplit().GetIndex()
+	})
+
+	seen := map[int32]bool{}
+	var sb strings.Builder
+	for _, piece := range pieces {
+		// The same piece may have been retrieved more than once
+		if seen[piece.GetSplit().GetIndex()] {
+			continue
+		}
+		seen[piece.GetSplit().GetIndex()] = true
+		sb.WriteString(splitPieceMessage(piece))
+	}
+
+	entry := proto.Clone(pieces[0]).(*loggingpb.LogEntry)
+	if jsonPayload := entry.GetJsonPayload(); jsonPayload != nil {
+		if _, ok := jsonPayload.GetFields()["message"]; ok {
+			jsonPayload.Fields["message"] = structpb.NewStringValue(sb.String())
+			return entry
+		}
+	}
+	entry.Payload = &loggingpb.LogEntry_TextPayload{TextPayload: sb.String()}
+	return entry
+}
+
+// splitPieceMessage gets the part of the message carried by one piece of a split log entry
+func splitPieceMessage(piece *loggingpb.LogEntry) string {
+	if msg, ok := piece.GetJsonPayload().GetFields()["message"]; ok {
+		return msg.GetStringValue()
+	}
+	msg, err := GetLogEntryMessage(piece)
+	if err != nil {
+		log.DefaultLogger.Warn("failed getting split log message", "warning", err)
+	}
+	return msg
+}
+
+// maxPatternLength is the length at which log patterns are truncated
+const maxPatternLength = 500
+
+// patternMasks replace the variable parts of log messages, in order, to get their pattern
+var patternMasks = []struct {
+	pattern *regexp.Regexp
+	replace func(string) string
+}{
+	{
+		pattern: regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`),
+		replace: func(string) string { return "<UUID>" },
+	},
+	{
+		pattern: regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}(?::\d+)?\b`),
+		replace: func(string) string { return "<IP>" },
+	},
+	{
+		pattern: regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){3,7}[0-9a-f]{1,4}\b`),
+		replace: func(string) string { return "<IP>" },
+	},
+	{
+		// Long tokens mixing letters and digits, such as request IDs and hashes
+		pattern: regexp.MustCompile(`[A-Za-z0-9_-]*[0-9][A-Za-z0-9_-]*`),
+		replace: func(token string) string {
+			if len(token) >= 8 && strings.IndexFunc(token, unicode.IsLetter) >= 0 {
+				return "<ID>"
+			}
+			return token
+		},
+	},
+	{
+		// Numbers, keeping short unit suffixes such as "30s" or "12ms"
+		pattern: regexp.MustCompile(`\b\d+(?:\.\d+)?[a-zA-Z]{0,3}\b`),
+		replace: func(token string) string { return "<NUM>" + strings.TrimLeft(token, "0123456789.") },
+	},
+}
+
+var whitespacePattern = regexp.MustCompile(`\s+`)
+
+// GetLogPattern gets the pattern of a log message by masking its variable tokens
+// (UUIDs, IP addresses, IDs and numbers), so similar messages share the same pattern
+func GetLogPattern(message string) string {
+	pattern := strings.TrimSpace(whitespacePattern.ReplaceAllString(message, " "))
+	for _, mask := range patternMasks {
+		pattern = mask.pattern.ReplaceAllStringFunc(pattern, mask.replace)
+	}
+	if runes := []rune(pattern); len(runes) > maxPatternLength {
+		pattern = string(runes[:maxPatternLength]) + "…"
 	}
+	return pattern
 }
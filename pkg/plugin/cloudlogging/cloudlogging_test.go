@@ -17,6 +17,7 @@ package cloudlogging_test
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/logging/apiv2/loggingpb"
 	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
@@ -26,6 +27,7 @@ import (
 	ltype "google.golang.org/genproto/googleapis/logging/type"
 	anypb "google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestGetLogEntryMessage(t *testing.T) {
@@ -376,6 +378,50 @@ func TestGetLogLabels(t *testing.T) {
 				"spanId":  "000000000000004a",
 			},
 		},
+		{
+			name: "LogEntry metadata",
+			entry: &loggingpb.LogEntry{
+				InsertId:         "insert-id10",
+				LogName:          "projects/my-project/logs/my-log",
+				ReceiveTimestamp: timestamppb.New(time.Date(2024, 5, 1, 12, 30, 0, 123000000, time.UTC)),
+				Trace:            "projects/my-project/traces/06796866738c859f2f19b7cfb3214824",
+				TraceSampled:     true,
+				Operation: &loggingpb.LogEntryOperation{
+					Id:       "operation-1",
+					Producer: "github.com/MyProject/MyApplication",
+					First:    true,
+				},
+				SourceLocation: &loggingpb.LogEntrySourceLocation{
+					File:     "main.go",
+					Line:     42,
+					Function: "main.run",
+				},
+				Split: &loggingpb.LogSplit{
+					Uid:         "split-uid",
+					Index:       1,
+					TotalSplits: 3,
+				},
+			},
+			expected: data.Labels{
+				"id":                      "insert-id10",
+				"level":                   "info",
+				"logName":                 "projects/my-project/logs/my-log",
+				"receiveTimestamp":        "2024-05-01T12:30:00.123Z",
+				"trace":                   "projects/my-project/traces/06796866738c859f2f19b7cfb3214824",
+				"traceId":                 "06796866738c859f2f19b7cfb3214824",
+				"traceSampled":            "true",
+				"operation.id":            "operation-1",
+				"operation.producer":      "github.com/MyProject/MyApplication",
+				"operation.first":         "true",
+				"operation.last":          "false",
+				"sourceLocation.file":     "main.go",
+				"sourceLocation.line":     "42",
+				"sourceLocation.function": "main.run",
+				"split.uid":               "split-uid",
+				"split.index":             "1",
+				"split.totalSplits":       "3",
+			},
+		},
 		{
 			name: "JSON payload with various field types",
 			entry: &loggingpb.LogEntry{
@@ -449,3 +495,129 @@ func TestGetLogLabels(t *testing.T) {
 		})
 	}
 }
+
+func splitEntry(insertID string, uid string, index int32, total int32, text string) *loggingpb.LogEntry {
+	return &loggingpb.LogEntry{
+		InsertId: insertID,
+		Split:    &loggingpb.LogSplit{Uid: uid, Index: index, TotalSplits: total},
+		Payload:  &loggingpb.LogEntry_TextPayload{TextPayload: text},
+	}
+}
+
+func TestIncompleteSplits(t *testing.T) {
+	entries := []*loggingpb.LogEntry{
+		{InsertId: "not-split"},
+		splitEntry("a-1", "a", 1, 2, "world"),
+		splitEntry("a-0", "a", 0, 2, "hello "),
+		splitEntry("b-0", "b", 0, 3, "first"),
+		splitEntry("b-2", "b", 2, 3, "third"),
+		splitEntry("c-1", "c", 1, 2, "second"),
+	}
+
+	require.Equal(t, []string{"b", "c"}, cloudlogging.IncompleteSplits(entries))
+	require.Empty(t, cloudlogging.IncompleteSplits(entries[:3]))
+}
+
+func TestMergeSplitLogEntries(t *testing.T) {
+	t.Run("text payloads", func(t *testing.T) {
+		entries := []*loggingpb.LogEntry{
+			{InsertId: "before"},
+			splitEntry("a-1", "a", 1, 3, "is "),
+			{InsertId: "between"},
+			splitEntry("a-2", "a", 2, 3, "split"),
+			splitEntry("a-0", "a", 0, 3, "this "),
+			splitEntry("a-2-dup", "a", 2, 3, "split"),
+		}
+
+		merged := cloudlogging.MergeSplitLogEntries(entries)
+		require.Len(t, merged, 3)
+		require.Equal(t, "before", merged[0].GetInsertId())
+		require.Equal(t, "a-0", merged[1].GetInsertId())
+		require.Equal(t, "this is split", merged[1].GetTextPayload())
+		require.Equal(t, "between", merged[2].GetInsertId())
+		// The original pieces are left untouched
+		require.Equal(t, "this ", entries[4].GetTextPayload())
+	})
+
+	t.Run("JSON payloads with message", func(t *testing.T) {
+		jsonEntry := func(insertID string, index int32, message string) *loggingpb.LogEntry {
+			return &loggingpb.LogEntry{
+				InsertId: insertID,
+				Split:    &loggingpb.LogSplit{Uid: "j", Index: index, TotalSplits: 2},
+				Payload: &loggingpb.LogEntry_JsonPayload{
+					JsonPayload: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							"message":  structpb.NewStringValue(message),
+							"severity": structpb.NewStringValue("ERROR"),
+						},
+					},
+				},
+			}
+		}
+
+		merged := cloudlogging.MergeSplitLogEntries([]*loggingpb.LogEntry{
+			jsonEntry("j-1", 1, "of a message"),
+			jsonEntry("j-0", 0, "the first part "),
+		})
+		require.Len(t, merged, 1)
+		message, err := cloudlogging.GetLogEntryMessage(merged[0])
+		require.NoError(t, err)
+		require.Equal(t, "the first part of a message", message)
+		require.Equal(t, "ERROR", merged[0].GetJsonPayload().GetFields()["severity"].GetStringValue())
+	})
+
+	t.Run("incomplete split", func(t *testing.T) {
+		merged := cloudlogging.MergeSplitLogEntries([]*loggingpb.LogEntry{
+			splitEntry("a-0", "a", 0, 3, "only "),
+			splitEntry("a-2", "a", 2, 3, "partial"),
+		})
+		require.Len(t, merged, 1)
+		require.Equal(t, "only partial", merged[0].GetTextPayload())
+	})
+}
+
+func TestGetLogPattern(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{
+			name:     "no variable tokens",
+			message:  "Starting Grafana",
+			expected: "Starting Grafana",
+		},
+		{
+			name:     "numbers",
+			message:  "Request took 253ms, retried 2 times with 0.5 backoff",
+			expected: "Request took <NUM>ms, retried <NUM> times with <NUM> backoff",
+		},
+		{
+			name:     "UUID",
+			message:  "Processing order b6f39be2-b298-44da-9001-1f04e5756fa0",
+			expected: "Processing order <UUID>",
+		},
+		{
+			name:     "IP addresses",
+			message:  "Connection from 10.0.12.4:5432 refused, retrying 2001:db8:85a3:0:0:8a2e:370:7334",
+			expected: "Connection from <IP> refused, retrying <IP>",
+		},
+		{
+			name:     "IDs",
+			message:  "Trace c0e331eab1515bbcd1b8306029902ff7 for user u-12345abc failed on v2",
+			expected: "Trace <ID> for user <ID> failed on v2",
+		},
+		{
+			name:     "whitespace",
+			message:  "  multi\n  line\tmessage  ",
+			expected: "multi line message",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, cloudlogging.GetLogPattern(tc.message))
+		})
+	}
+}
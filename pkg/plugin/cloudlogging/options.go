@@ -0,0 +1,469 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/auth/credentials"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	httptransport "google.golang.org/api/transport/http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const userAgent = "googlecloud-logging-datasource"
+
+// readOnlyScope is the default scope requested for impersonated service accounts
+const readOnlyScope = "https://www.googleapis.com/auth/cloud-platform.read-only"
+
+// maxImpersonationLifetime is the longest lifetime of the access tokens of impersonated service accounts
+const maxImpersonationLifetime = 12 * time.Hour
+
+var errMultipleCredentials = errors.New("only one credential source can be set")
+
+// ClientOption configures a Client created with New
+type ClientOption func(*clientSettings)
+
+// clientSettings is the configuration of a Client, built from its options
+type clientSettings struct {
+	// credentials returns the client options authenticating calls. It is nil for
+	// application default credentials
+	credentials     func(ctx context.Context, s *clientSettings) ([]option.ClientOption, error)
+	credentialCount int
+	universeDomain  string
+	dialOptions     []grpc.DialOption
+	endpoints       Endpoints
+	plaintext       bool
+	proxy           *Proxy
+	dialer          ContextDialer
+	retry           *RetryPolicy
+	rateLimiter     *RateLimiter
+	// onUnauthenticated is called when a call is rejected as unauthenticated
+	onUnauthenticated func()
+	// refreshableToken is the token source of WithRefreshableToken, if set, which REST calls
+	// rejected as unauthenticated are retried with
+	refreshableToken *RefreshableTokenSource
+}
+
+// Endpoints overrides the endpoints of the Google Cloud APIs, as host:port. Empty endpoints
+// are the default ones, except for the config API which defaults to the logging endpoint
+type Endpoints struct {
+	// Logging is the gRPC endpoint of the Logging API
+	Logging         string
+	Config          string
+	ResourceManager string
+	// LoggingREST is the endpoint of the REST API of Logging, used for the saved and recent
+	// queries, log scopes, error groups and SQL queries. It defaults to the logging endpoint, which serves
+	// both over TLS, but has to be set for plaintext connections to a gRPC emulator
+	LoggingREST string
+}
+
+func (s *clientSettings) setCredentials(credentials func(ctx context.Context, s *clientSettings) ([]option.ClientOption, error)) {
+	s.credentials = credentials
+	s.credentialCount++
+}
+
+// WithCredentialsJSON authenticates with a service account key or other JSON credentials
+func WithCredentialsJSON(jsonCreds []byte) ClientOption {
+	return func(s *clientSettings) {
+		s.setCredentials(func(ctx context.Context, s *clientSettings) ([]option.ClientOption, error) {
+			if err := validateCredentialsJSON(jsonCreds); err != nil {
+				return nil, err
+			}
+			if client := s.httpClient(); client != nil {
+				return proxiedCredentials(client, jsonCreds, s.universeDomain)
+			}
+			return []option.ClientOption{option.WithCredentialsJSON(jsonCreds)}, nil
+		})
+	}
+}
+
+// proxiedCredentials resolves the JSON credentials, or the application default credentials if
+// jsonCreds is nil, with their token requests sent through the proxy. Service account keys
+// still sign their own JWTs, and the GCE metadata server is always reached directly
+func proxiedCredentials(client *http.Client, jsonCreds []byte, universeDomain string) ([]option.ClientOption, error) {
+	creds, err := credentials.DetectDefault(&credentials.DetectOptions{
+		Scopes:           []string{cloudPlatformScope},
+		CredentialsJSON:  jsonCreds,
+		UseSelfSignedJWT: true,
+		Client:           client,
+		UniverseDomain:   universeDomain,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithAuthCredentials(creds)}, nil
+}
+
+// WithDefaultCredentials authenticates with the application default credentials, such as
+// the GCE metadata server. This is the default when no credential source is set
+func WithDefaultCredentials() ClientOption {
+	return func(s *clientSettings) {
+		s.setCredentials(nil)
+	}
+}
+
+// Impersonation is the service account impersonated, and the access tokens requested for it
+type Impersonation struct {
+	// TargetPrincipal is the email address of the impersonated service account
+	TargetPrincipal string
+	// Delegates is the delegation chain from the authenticated account to the target service
+	// account. Each service account must be allowed to create tokens for the next one
+	Delegates []string
+	// Scopes are the scopes of the access tokens, the cloud-platform.read-only scope if empty
+	Scopes []string
+	// Lifetime is how long the access tokens are valid, an hour if zero. Lifetimes over an
+	// hour require the iam.allowServiceAccountCredentialLifetimeExtension organization policy
+	Lifetime time.Duration
+}
+
+// Validate checks the service accounts, scopes and lifetime
+func (i Impersonation) Validate() error {
+	if i.TargetPrincipal == "" {
+		return errors.New("missing service account to impersonate")
+	}
+	if !isServiceAccount(i.TargetPrincipal) {
+		return fmt.Errorf("invalid service account to impersonate: %q", i.TargetPrincipal)
+	}
+	for _, delegate := range i.Delegates {
+		if !isServiceAccount(delegate) {
+			return fmt.Errorf("invalid delegate service account: %q", delegate)
+		}
+	}
+	for _, scope := range i.Scopes {
+		if u, err := url.Parse(scope); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid scope: %q", scope)
+		}
+	}
+	if i.Lifetime < 0 || i.Lifetime > maxImpersonationLifetime {
+		return fmt.Errorf("invalid token lifetime %s: it must be at most %s", i.Lifetime, maxImpersonationLifetime)
+	}
+	return nil
+}
+
+// isServiceAccount checks whether principal is a service account email address
+func isServiceAccount(principal string) bool {
+	name, domain, found := strings.Cut(principal, "@")
+	return found && name != "" && strings.Contains(domain, ".") && !strings.ContainsAny(principal, " /")
+}
+
+// WithImpersonation authenticates as the target service account, impersonated using the JSON
+// credentials, or the application default credentials if jsonCreds is nil
+func WithImpersonation(jsonCreds []byte, targetPrincipal string) ClientOption {
+	return WithImpersonationConfig(jsonCreds, Impersonation{TargetPrincipal: targetPrincipal})
+}
+
+// WithImpersonationConfig authenticates as an impersonated service account, through its
+// delegation chain, using the JSON credentials or the application default credentials if
+// jsonCreds is nil
+func WithImpersonationConfig(jsonCreds []byte, impersonation Impersonation) ClientOption {
+	return func(s *clientSettings) {
+		s.setCredentials(func(ctx context.Context, s *clientSettings) ([]option.ClientOption, error) {
+			if err := impersonation.Validate(); err != nil {
+				return nil, err
+			}
+			scopes := impersonation.Scopes
+			if len(scopes) == 0 {
+				scopes = []string{readOnlyScope}
+			}
+			impersonateOpts := universeDomainOpts(s.universeDomain)
+			if jsonCreds != nil {
+				impersonateOpts = append(impersonateOpts, option.WithCredentialsJSON(jsonCreds))
+			}
+			// The calls to the IAM credentials API, and the token requests of the credentials
+			// impersonating the service account, go through the proxy as well
+			if client := s.httpClient(); client != nil {
+				ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+				transportOpts := append([]option.ClientOption{option.WithScopes(cloudPlatformScope)}, impersonateOpts...)
+				transport, err := httptransport.NewTransport(ctx, client.Transport, transportOpts...)
+				if err != nil {
+					return nil, err
+				}
+				impersonateOpts = append(impersonateOpts, option.WithHTTPClient(&http.Client{Transport: transport}))
+			}
+			config := impersonate.CredentialsConfig{
+				TargetPrincipal: impersonation.TargetPrincipal,
+				Delegates:       impersonation.Delegates,
+				Scopes:          scopes,
+				Lifetime:        impersonation.Lifetime,
+			}
+			if config.Lifetime != 0 {
+				ts := &lifetimeTokenSource{ctx: context.WithoutCancel(ctx), config: config, opts: impersonateOpts}
+				return []option.ClientOption{option.WithTokenSource(oauth2.ReuseTokenSource(nil, ts))}, nil
+			}
+			ts, err := impersonate.CredentialsTokenSource(ctx, config, impersonateOpts...)
+			if err != nil {
+				return nil, err
+			}
+			return []option.ClientOption{option.WithTokenSource(ts)}, nil
+		})
+	}
+}
+
+// lifetimeTokenSource impersonates a service account with a custom token lifetime. The
+// impersonate package fetches a single token when a lifetime is set and never refreshes it,
+// so a new impersonated token source is created each time a token is needed
+type lifetimeTokenSource struct {
+	ctx    context.Context
+	config impersonate.CredentialsConfig
+	opts   []option.ClientOption
+}
+
+func (ts *lifetimeTokenSource) Token() (*oauth2.Token, error) {
+	impersonated, err := impersonate.CredentialsTokenSource(ts.ctx, ts.config, ts.opts...)
+	if err != nil {
+		return nil, err
+	}
+	return impersonated.Token()
+}
+
+// WithAccessToken authenticates with a static access token
+func WithAccessToken(accessToken string) ClientOption {
+	return WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+}
+
+// WithPassThrough authenticates with the OAuth token of the signed in user, from the
+// Authorization header of a Grafana request
+func WithPassThrough(headers map[string]string) ClientOption {
+	return func(s *clientSettings) {
+		s.setCredentials(func(ctx context.Context, s *clientSettings) ([]option.ClientOption, error) {
+			token, found := strings.CutPrefix(headers["Authorization"], "Bearer ")
+			if !found || token == "" {
+				return nil, errors.New("missing or invalid Authorization header")
+			}
+			return []option.ClientOption{
+				option.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})),
+			}, nil
+		})
+	}
+}
+
+// WithTokenSource authenticates with the tokens of a token source
+func WithTokenSource(ts oauth2.TokenSource) ClientOption {
+	return func(s *clientSettings) {
+		s.setCredentials(func(ctx context.Context, s *clientSettings) ([]option.ClientOption, error) {
+			return []option.ClientOption{option.WithTokenSource(ts)}, nil
+		})
+	}
+}
+
+// WithRefreshableToken authenticates with an access token read from a file or a credential
+// helper command. Calls rejected as unauthenticated are retried once with a new token
+func WithRefreshableToken(ts *RefreshableTokenSource) ClientOption {
+	return func(s *clientSettings) {
+		s.refreshableToken = ts
+		s.setCredentials(func(ctx context.Context, s *clientSettings) ([]option.ClientOption, error) {
+			return []option.ClientOption{
+				option.WithTokenSource(ts),
+				option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(ts.unaryInterceptor)),
+			}, nil
+		})
+	}
+}
+
+// WithExternalAccount authenticates with an external account (workload identity federation)
+// credential configuration. The configuration is used as is: callers taking it from untrusted
+// users must check its credential source files and URLs, and its token URLs
+func WithExternalAccount(jsonCreds []byte) ClientOption {
+	return func(s *clientSettings) {
+		s.setCredentials(func(ctx context.Context, s *clientSettings) ([]option.ClientOption, error) {
+			// The token exchange goes through the proxy as well
+			if client := s.httpClient(); client != nil {
+				ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+			}
+			ts, err := externalAccountTokenSource(ctx, jsonCreds)
+			if err != nil {
+				return nil, err
+			}
+			return []option.ClientOption{option.WithTokenSource(ts)}, nil
+		})
+	}
+}
+
+// WithUniverseDomain sets the universe domain of the Google Cloud APIs, if not empty
+func WithUniverseDomain(universeDomain string) ClientOption {
+	return func(s *clientSettings) {
+		s.universeDomain = universeDomain
+	}
+}
+
+// WithEndpoints connects to custom endpoints, such as Private Service Connect endpoints
+func WithEndpoints(endpoints Endpoints) ClientOption {
+	return func(s *clientSettings) {
+		s.endpoints = endpoints
+	}
+}
+
+// WithPlaintext connects over plaintext gRPC without authentication, to a local emulator or
+// fake server at custom endpoints. Credential sources are ignored
+func WithPlaintext() ClientOption {
+	return func(s *clientSettings) {
+		s.plaintext = true
+	}
+}
+
+// WithProxy connects to the Google Cloud APIs through an HTTP CONNECT proxy
+func WithProxy(proxy Proxy) ClientOption {
+	return func(s *clientSettings) {
+		s.proxy = &proxy
+	}
+}
+
+// WithDialer connects to the Google Cloud APIs, or to the proxy set with WithProxy, with
+// the dialer, such as the dialer of the Grafana secure socks proxy
+func WithDialer(dialer ContextDialer) ClientOption {
+	return func(s *clientSettings) {
+		s.dialer = dialer
+	}
+}
+
+// WithRetryPolicy sets how calls to the Cloud Logging API are retried, and their deadlines
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(s *clientSettings) {
+		s.retry = &policy
+	}
+}
+
+// WithRateLimiter limits the rate of the log entry requests with a limiter, which can be shared
+// by several clients
+func WithRateLimiter(limiter *RateLimiter) ClientOption {
+	return func(s *clientSettings) {
+		s.rateLimiter = limiter
+	}
+}
+
+// WithUnauthenticatedHandler calls fn when a call is rejected as unauthenticated, such as when
+// the OAuth token of a passthrough client has expired
+func WithUnauthenticatedHandler(fn func()) ClientOption {
+	return func(s *clientSettings) {
+		s.onUnauthenticated = fn
+	}
+}
+
+// WithGRPCDialOptions adds options used to dial the Google Cloud APIs
+func WithGRPCDialOptions(opts ...grpc.DialOption) ClientOption {
+	return func(s *clientSettings) {
+		s.dialOptions = append(s.dialOptions, opts...)
+	}
+}
+
+// clientOptions resolves the settings into the options of the Google Cloud API clients
+func (s *clientSettings) clientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	if s.credentialCount > 1 {
+		return nil, errMultipleCredentials
+	}
+
+	opts := []option.ClientOption{option.WithUserAgent(userAgent)}
+	if s.plaintext {
+		opts = append(opts, option.WithoutAuthentication())
+	} else if s.credentials != nil {
+		credentials, err := s.credentials(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, credentials...)
+	} else if client := s.httpClient(); client != nil {
+		// The token requests of the application default credentials go through the proxy
+		credentials, err := proxiedCredentials(client, nil, s.universeDomain)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, credentials...)
+	}
+	opts = append(opts, universeDomainOpts(s.universeDomain)...)
+	if dialer := newDialer(s.proxy, s.dialer); dialer != nil {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		})))
+	}
+	for _, dialOption := range s.dialOptions {
+		opts = append(opts, option.WithGRPCDialOption(dialOption))
+	}
+	if s.onUnauthenticated != nil {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(unauthenticatedInterceptor(s.onUnauthenticated))))
+	}
+	return opts, nil
+}
+
+// unauthenticatedInterceptor calls fn for the calls rejected as unauthenticated
+func unauthenticatedInterceptor(fn func()) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if status.Code(err) == codes.Unauthenticated {
+			fn()
+		}
+		return err
+	}
+}
+
+// httpClient returns an HTTP client connecting through the configured proxy, or nil if there is none
+func (s *clientSettings) httpClient() *http.Client {
+	dialer := newDialer(s.proxy, s.dialer)
+	if dialer == nil {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport}
+}
+
+func universeDomainOpts(universeDomain string) []option.ClientOption {
+	if universeDomain == "" {
+		return nil
+	}
+	return []option.ClientOption{option.WithUniverseDomain(universeDomain)}
+}
+
+// validateCredentialsJSON checks the private key of service account credentials, which is
+// otherwise only parsed once the first sub-client is created
+func validateCredentialsJSON(jsonCreds []byte) error {
+	var creds struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(jsonCreds, &creds); err != nil {
+		return fmt.Errorf("parse credentials: %w", err)
+	}
+	if creds.Type != string(google.ServiceAccount) {
+		return nil
+	}
+	if _, err := google.JWTAccessTokenSourceWithScope(jsonCreds, cloudPlatformScope); err != nil {
+		return fmt.Errorf("service account credentials: %w", err)
+	}
+	return nil
+}
+
+// externalAccountTokenSource creates a token source which exchanges the subject token of an
+// external_account credential configuration for a Google access token through STS
+func externalAccountTokenSource(ctx context.Context, jsonCreds []byte) (oauth2.TokenSource, error) {
+	creds, err := google.CredentialsFromJSONWithType(ctx, jsonCreds, google.ExternalAccount, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("external account credentials: %w", err)
+	}
+	return creds.TokenSource, nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// proxyDialTimeout is how long connecting through the proxy may take, unless the context has a deadline
+const proxyDialTimeout = 30 * time.Second
+
+// Proxy is an HTTP CONNECT proxy the connections to the Google Cloud APIs go through
+type Proxy struct {
+	// URL is the proxy URL, such as http://proxy.example.com:3128. Credentials can be
+	// given in the URL or as Username and Password
+	URL      *url.URL
+	Username string
+	Password string
+	// NoProxy lists the hosts connected to directly: host names, domain suffixes such
+	// as .example.com, IP addresses, CIDR ranges, or * for all hosts
+	NoProxy []string
+}
+
+// ContextDialer dials network connections, such as the dialer of the Grafana secure socks proxy
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// ProxyError is returned when connecting through the proxy fails
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %s", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// proxyDialer dials through an HTTP CONNECT proxy, itself reached with the base dialer
+type proxyDialer struct {
+	proxy Proxy
+	base  ContextDialer
+}
+
+// DialContext connects to addr, through the proxy unless addr is in the no-proxy list
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.proxy.URL == nil || d.bypass(addr) {
+		return d.base.DialContext(ctx, network, addr)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, proxyDialTimeout)
+		defer cancel()
+	}
+
+	proxyAddr := d.proxy.URL.Host
+	if d.proxy.URL.Port() == "" {
+		port := "80"
+		if d.proxy.URL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxy.URL.Hostname(), port)
+	}
+	proxyName := d.proxy.URL.Redacted()
+
+	conn, err := d.base.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, &ProxyError{Proxy: proxyName, Err: err}
+	}
+	if d.proxy.URL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.URL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, &ProxyError{Proxy: proxyName, Err: err}
+		}
+		conn = tlsConn
+	}
+
+	tunnel, err := d.connect(ctx, conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, &ProxyError{Proxy: proxyName, Err: err}
+	}
+	return tunnel, nil
+}
+
+// connect asks the proxy for a tunnel to addr
+func (d *proxyDialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	username, password := d.proxy.Username, d.proxy.Password
+	if username == "" && d.proxy.URL.User != nil {
+		username = d.proxy.URL.User.Username()
+		password, _ = d.proxy.URL.User.Password()
+	}
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("send CONNECT request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+
+	// The server may already have sent data through the tunnel, such as the HTTP/2 settings
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// bypass checks whether addr is connected to directly
+func (d *proxyDialer) bypass(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range d.proxy.NoProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		case ip != nil && strings.Contains(entry, "/"):
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+		case ip != nil:
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+		default:
+			domain := strings.TrimPrefix(entry, ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// socksDialer wraps the errors of a proxy dialer, such as the Grafana secure socks proxy
+type socksDialer struct {
+	dialer ContextDialer
+}
+
+func (d *socksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &ProxyError{Proxy: "secure socks proxy", Err: err}
+	}
+	return conn, nil
+}
+
+// newDialer combines the configured proxies into one dialer. It returns nil if no proxy is configured
+func newDialer(proxy *Proxy, dialer ContextDialer) ContextDialer {
+	if proxy == nil && dialer == nil {
+		return nil
+	}
+
+	var base ContextDialer = &net.Dialer{}
+	if dialer != nil {
+		base = &socksDialer{dialer: dialer}
+	}
+	if proxy == nil || proxy.URL == nil {
+		return base
+	}
+	return &proxyDialer{proxy: *proxy, base: base}
+}
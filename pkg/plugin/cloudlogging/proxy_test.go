@@ -0,0 +1,327 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	httptransport "google.golang.org/api/transport/http"
+)
+
+// connectProxy is a local HTTP CONNECT proxy requiring basic authentication
+type connectProxy struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	tunnels []string
+}
+
+func newConnectProxy(t *testing.T, username, password string) *connectProxy {
+	p := &connectProxy{}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != expected {
+			http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		p.mu.Lock()
+		p.tunnels = append(p.tunnels, r.Host)
+		p.mu.Unlock()
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() {
+			io.Copy(target, buf)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *connectProxy) proxyURL() *url.URL {
+	u, _ := url.Parse(p.URL)
+	return u
+}
+
+func TestWithProxy(t *testing.T) {
+	fake := newFakeLoggingServer(t)
+	proxy := newConnectProxy(t, "grafana", "secret")
+
+	t.Run("connects through the proxy", func(t *testing.T) {
+		client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithProxy(Proxy{
+			URL:      proxy.proxyURL(),
+			Username: "grafana",
+			Password: "secret",
+		}))
+		require.NoError(t, err)
+		defer client.Close()
+
+		require.NoError(t, client.TestProxy(context.Background()))
+		entries, err := client.ListLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 10})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		proxy.mu.Lock()
+		defer proxy.mu.Unlock()
+		require.Contains(t, proxy.tunnels, fake.addr)
+	})
+
+	t.Run("credentials in the URL", func(t *testing.T) {
+		proxyURL := proxy.proxyURL()
+		proxyURL.User = url.UserPassword("grafana", "secret")
+		client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithProxy(Proxy{URL: proxyURL}))
+		require.NoError(t, err)
+		defer client.Close()
+		require.NoError(t, client.TestProxy(context.Background()))
+	})
+
+	t.Run("proxy rejects the credentials", func(t *testing.T) {
+		client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithProxy(Proxy{
+			URL:      proxy.proxyURL(),
+			Username: "grafana",
+			Password: "wrong",
+		}))
+		require.NoError(t, err)
+		defer client.Close()
+
+		err = client.TestProxy(context.Background())
+		var proxyErr *ProxyError
+		require.ErrorAs(t, err, &proxyErr)
+		require.ErrorContains(t, err, "407 Proxy Authentication Required")
+		require.NotContains(t, err.Error(), "wrong")
+	})
+
+	t.Run("unreachable proxy", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := lis.Addr().String()
+		lis.Close()
+
+		client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithProxy(Proxy{
+			URL: &url.URL{Scheme: "http", Host: addr},
+		}))
+		require.NoError(t, err)
+		defer client.Close()
+
+		var proxyErr *ProxyError
+		require.ErrorAs(t, client.TestProxy(context.Background()), &proxyErr)
+	})
+
+	t.Run("no proxy", func(t *testing.T) {
+		client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}))
+		require.NoError(t, err)
+		defer client.Close()
+		require.NoError(t, client.TestProxy(context.Background()))
+	})
+}
+
+func TestWithDialer(t *testing.T) {
+	fake := newFakeLoggingServer(t)
+
+	var mu sync.Mutex
+	var dialed []string
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithDialer(dialer))
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.ListLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 10})
+	require.NoError(t, err)
+	mu.Lock()
+	require.Contains(t, dialed, fake.addr)
+	mu.Unlock()
+
+	failing := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("socks connect failed")
+	})
+	client, err = New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithDialer(failing))
+	require.NoError(t, err)
+	defer client.Close()
+
+	err = client.TestProxy(context.Background())
+	var proxyErr *ProxyError
+	require.ErrorAs(t, err, &proxyErr)
+	require.ErrorContains(t, err, "secure socks proxy: socks connect failed")
+}
+
+func TestWithDialer_Impersonation(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	failing := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return nil, errors.New("socks connect failed")
+	})
+	creds := []byte(`{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "refresh"}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	for name, impersonation := range map[string]Impersonation{
+		"default lifetime": {TargetPrincipal: "reader@my-project.iam.gserviceaccount.com"},
+		"custom lifetime":  {TargetPrincipal: "reader@my-project.iam.gserviceaccount.com", Lifetime: 2 * time.Hour},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mu.Lock()
+			dialed = nil
+			mu.Unlock()
+
+			settings := &clientSettings{}
+			WithImpersonationConfig(creds, impersonation)(settings)
+			WithDialer(failing)(settings)
+			opts, err := settings.credentials(context.Background(), settings)
+			require.NoError(t, err)
+
+			// The token requests of the impersonation go through the dialer, rather than directly to Google
+			transport, err := httptransport.NewTransport(context.Background(), http.DefaultTransport, opts...)
+			require.NoError(t, err)
+			_, err = (&http.Client{Transport: transport}).Get(server.URL)
+			require.ErrorContains(t, err, "socks connect failed")
+			mu.Lock()
+			require.Contains(t, dialed, "oauth2.googleapis.com:443")
+			mu.Unlock()
+		})
+	}
+}
+
+func TestWithDialer_Credentials(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	failing := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return nil, errors.New("socks connect failed")
+	})
+	userCreds := []byte(`{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "refresh"}`)
+	credsFile := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(credsFile, userCreds, 0600))
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	// credentialOptions resolves the credentials the way New does, with the failing dialer
+	credentialOptions := func(t *testing.T, opt ClientOption) []option.ClientOption {
+		mu.Lock()
+		dialed = nil
+		mu.Unlock()
+		settings := &clientSettings{}
+		if opt != nil {
+			opt(settings)
+		}
+		WithDialer(failing)(settings)
+		opts, err := settings.clientOptions(context.Background())
+		require.NoError(t, err)
+		return opts
+	}
+
+	for name, opt := range map[string]ClientOption{
+		"JSON credentials":    WithCredentialsJSON(userCreds),
+		"default credentials": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credsFile)
+			opts := credentialOptions(t, opt)
+
+			// The token requests go through the dialer, rather than directly to Google
+			transport, err := httptransport.NewTransport(context.Background(), http.DefaultTransport, opts...)
+			require.NoError(t, err)
+			_, err = (&http.Client{Transport: transport}).Get(server.URL)
+			require.ErrorContains(t, err, "socks connect failed")
+			mu.Lock()
+			require.Contains(t, dialed, "oauth2.googleapis.com:443")
+			mu.Unlock()
+		})
+	}
+
+	t.Run("service account key", func(t *testing.T) {
+		opts := credentialOptions(t, WithCredentialsJSON(serviceAccountKey(t, "https://oauth2.googleapis.com/token")))
+
+		// Service account keys sign their own JWTs, without any token request
+		transport, err := httptransport.NewTransport(context.Background(), http.DefaultTransport, opts...)
+		require.NoError(t, err)
+		_, err = (&http.Client{Transport: transport}).Get(server.URL)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(authorization, "Bearer "))
+		mu.Lock()
+		require.Empty(t, dialed)
+		mu.Unlock()
+	})
+}
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestProxyDialer_Bypass(t *testing.T) {
+	d := &proxyDialer{proxy: Proxy{NoProxy: []string{" internal.example.com", ".corp.example.com", "10.0.0.0/8", "192.168.1.1", ""}}}
+
+	for addr, expected := range map[string]bool{
+		"internal.example.com:443":     true,
+		"api.internal.example.com:443": true,
+		"corp.example.com:443":         true,
+		"logs.corp.example.com:443":    true,
+		"10.1.2.3:443":                 true,
+		"192.168.1.1:443":              true,
+		"192.168.1.2:443":              false,
+		"logging.googleapis.com:443":   false,
+		"notinternal.example.com:443":  false,
+	} {
+		require.Equal(t, expected, d.bypass(addr), addr)
+	}
+
+	all := &proxyDialer{proxy: Proxy{NoProxy: []string{"*"}}}
+	require.True(t, all.bypass("logging.googleapis.com:443"))
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxProjectLimiters is the number of per project limiters above which idle ones are dropped
+const maxProjectLimiters = 1000
+
+// ErrRateLimited is returned when a request would wait longer than the queue timeout of the rate limiter
+var ErrRateLimited = errors.New("rate limited by plugin")
+
+// ErrQuotaExceeded is returned when Cloud Logging refuses a request because the read quota of
+// the project is exhausted
+var ErrQuotaExceeded = errors.New("Cloud Logging read quota exceeded")
+
+// RateLimiter limits the rate of the log entry requests of the clients sharing it, with a
+// token bucket for all projects or one per project
+type RateLimiter struct {
+	limit        rate.Limit
+	burst        int
+	queueTimeout time.Duration
+	perProject   bool
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewRateLimiter creates a rate limiter allowing requestsPerMinute requests on average, and
+// bursts of up to burst requests. Requests wait for up to queueTimeout for their turn. With
+// perProject, each project has its own limit
+func NewRateLimiter(requestsPerMinute float64, burst int, queueTimeout time.Duration, perProject bool) (*RateLimiter, error) {
+	if requestsPerMinute <= 0 {
+		return nil, errors.New("the rate must be positive")
+	}
+	if burst < 1 {
+		return nil, errors.New("the burst must be at least 1")
+	}
+	if queueTimeout < 0 {
+		return nil, errors.New("the queue timeout must not be negative")
+	}
+	return &RateLimiter{
+		limit:        rate.Limit(requestsPerMinute / 60),
+		burst:        burst,
+		queueTimeout: queueTimeout,
+		perProject:   perProject,
+		limiters:     map[string]*rate.Limiter{},
+	}, nil
+}
+
+// limiter returns the token bucket of a project
+func (l *RateLimiter) limiter(projectID string) *rate.Limiter {
+	if !l.perProject {
+		projectID = ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limiter, ok := l.limiters[projectID]; ok {
+		return limiter
+	}
+	if len(l.limiters) >= maxProjectLimiters {
+		// Full buckets are in the same state as new ones
+		now := time.Now()
+		for key, limiter := range l.limiters {
+			if limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.limiters, key)
+			}
+		}
+	}
+	limiter := rate.NewLimiter(l.limit, l.burst)
+	l.limiters[projectID] = limiter
+	return limiter
+}
+
+// wait blocks until a request to the project is allowed. It fails right away with
+// ErrRateLimited if that would take longer than the queue timeout or the context deadline
+func (l *RateLimiter) wait(ctx context.Context, projectID string) error {
+	if l == nil {
+		return nil
+	}
+
+	reservation := l.limiter(projectID).Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if delay > l.queueTimeout || (hasDeadline && time.Now().Add(delay).After(deadline)) {
+		reservation.Cancel()
+		return l.rateLimitedError(projectID)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
+
+// backOffOnQuota spends the burst of the token bucket of a project when err is Cloud Logging
+// reporting its quota as exhausted, so that the next requests wait for the bucket to refill
+// instead of failing against the quota too
+func (l *RateLimiter) backOffOnQuota(projectID string, err error) {
+	if l == nil || status.Code(err) != codes.ResourceExhausted {
+		return
+	}
+	l.limiter(projectID).ReserveN(time.Now(), l.burst)
+}
+
+// quotaError wraps the ResourceExhausted errors of Cloud Logging with ErrQuotaExceeded
+func quotaError(err error) error {
+	if status.Code(err) != codes.ResourceExhausted {
+		return err
+	}
+	return fmt.Errorf("%w, try again later: %s", ErrQuotaExceeded, status.Convert(err).Message())
+}
+
+func (l *RateLimiter) rateLimitedError(projectID string) error {
+	perMinute := float64(l.limit) * 60
+	if l.perProject {
+		return fmt.Errorf("%w: more than %g requests per minute to project %s, try again later", ErrRateLimited, perMinute, projectID)
+	}
+	return fmt.Errorf("%w: more than %g requests per minute, try again later", ErrRateLimited, perMinute)
+}
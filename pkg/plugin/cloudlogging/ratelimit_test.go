@@ -0,0 +1,140 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	_, err := NewRateLimiter(0, 1, time.Second, false)
+	require.EqualError(t, err, "the rate must be positive")
+	_, err = NewRateLimiter(60, 0, time.Second, false)
+	require.EqualError(t, err, "the burst must be at least 1")
+	_, err = NewRateLimiter(60, 1, -time.Second, false)
+	require.EqualError(t, err, "the queue timeout must not be negative")
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("rejects requests over the queue timeout", func(t *testing.T) {
+		limiter, err := NewRateLimiter(60, 2, 0, false)
+		require.NoError(t, err)
+		require.NoError(t, limiter.wait(ctx, "project-a"))
+		require.NoError(t, limiter.wait(ctx, "project-b"))
+		err = limiter.wait(ctx, "project-a")
+		require.ErrorIs(t, err, ErrRateLimited)
+		require.EqualError(t, err, "rate limited by plugin: more than 60 requests per minute, try again later")
+	})
+
+	t.Run("queues requests", func(t *testing.T) {
+		// One request every 10ms
+		limiter, err := NewRateLimiter(6000, 1, time.Second, false)
+		require.NoError(t, err)
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			require.NoError(t, limiter.wait(ctx, "project-a"))
+		}
+		require.GreaterOrEqual(t, time.Since(start), 25*time.Millisecond)
+	})
+
+	t.Run("rejects requests past the context deadline", func(t *testing.T) {
+		limiter, err := NewRateLimiter(60, 1, time.Minute, false)
+		require.NoError(t, err)
+		require.NoError(t, limiter.wait(ctx, "project-a"))
+
+		deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, limiter.wait(deadlineCtx, "project-a"), ErrRateLimited)
+	})
+
+	t.Run("limits projects separately", func(t *testing.T) {
+		limiter, err := NewRateLimiter(60, 1, 0, true)
+		require.NoError(t, err)
+		require.NoError(t, limiter.wait(ctx, "project-a"))
+		require.NoError(t, limiter.wait(ctx, "project-b"))
+		require.EqualError(t, limiter.wait(ctx, "project-a"), "rate limited by plugin: more than 60 requests per minute to project project-a, try again later")
+	})
+
+	t.Run("drops idle project limiters", func(t *testing.T) {
+		limiter, err := NewRateLimiter(60, 1, 0, true)
+		require.NoError(t, err)
+		require.NoError(t, limiter.wait(ctx, "busy"))
+		for i := 1; i < maxProjectLimiters; i++ {
+			limiter.limiter(fmt.Sprintf("idle-%d", i))
+		}
+		require.NoError(t, limiter.wait(ctx, "new"))
+		require.Len(t, limiter.limiters, 2)
+		require.ErrorIs(t, limiter.wait(ctx, "busy"), ErrRateLimited)
+	})
+}
+
+func TestListLogs_RateLimit(t *testing.T) {
+	fake := newScriptedLoggingServer(t)
+	fake.script(page("", "1"))
+
+	limiter, err := NewRateLimiter(60, 1, 0, false)
+	require.NoError(t, err)
+	// Clients sharing the limiter share its limit
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithRateLimiter(limiter))
+		require.NoError(t, err)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	_, err = clients[0].ListLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 10})
+	require.NoError(t, err)
+	_, err = clients[1].ListLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 10})
+	require.ErrorIs(t, err, ErrRateLimited)
+	require.ErrorIs(t, clients[1].TestConnection(context.Background(), "projects/test-project"), ErrRateLimited)
+	require.Equal(t, 1, fake.requestCount())
+}
+
+func TestListLogs_QuotaExceeded(t *testing.T) {
+	fake := newScriptedLoggingServer(t)
+	fake.script(fail(codes.ResourceExhausted))
+
+	limiter, err := NewRateLimiter(60, 5, 0, false)
+	require.NoError(t, err)
+	policy := DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithRateLimiter(limiter), WithRetryPolicy(policy))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// The exhausted quota spends the burst, so the retry is refused by the plugin
+	_, err = client.ListLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 10})
+	require.ErrorIs(t, err, ErrRateLimited)
+	require.Equal(t, 1, fake.requestCount())
+}
+
+func TestQuotaError(t *testing.T) {
+	err := quotaError(status.Error(codes.ResourceExhausted, "Quota exceeded for quota metric 'Read requests'"))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.EqualError(t, err, "Cloud Logging read quota exceeded, try again later: Quota exceeded for quota metric 'Read requests'")
+
+	other := status.Error(codes.Unavailable, "unavailable")
+	require.Equal(t, other, quotaError(other))
+}
@@ -0,0 +1,364 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+	httptransport "google.golang.org/api/transport/http"
+)
+
+// errNoRESTEndpoint is returned for REST calls over plaintext connections without a REST endpoint
+var errNoRESTEndpoint = errors.New("plaintext connections require a custom REST endpoint")
+
+// maxSavedQueries is the number of saved or recent queries listed at most
+const maxSavedQueries = 1000
+
+// maxLogScopes is the number of log scopes listed at most
+const maxLogScopes = 1000
+
+// maxErrorGroupEntries is the number of log entries whose error groups are looked up at once
+const maxErrorGroupEntries = 100
+
+// restClientLocked returns the HTTP client authenticating REST calls, creating it on first use
+func (c *Client) restClientLocked(ctx context.Context) (*http.Client, error) {
+	if c.closed {
+		return nil, errClientClosed
+	}
+	if c.httpClient != nil {
+		return c.httpClient, nil
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	if c.dialer != nil {
+		base.Proxy = nil
+		base.DialContext = c.dialer.DialContext
+	}
+	// The REST client is used for the methods which the generated gRPC clients lack, with the
+	// same self-signed JWTs for service account keys
+	opts := append([]option.ClientOption{
+		internaloption.WithDefaultUniverseDomain("googleapis.com"),
+		internaloption.WithDefaultScopes(cloudPlatformScope),
+		internaloption.EnableJwtWithScope(),
+	}, c.opts...)
+	transport, err := httptransport.NewTransport(context.WithoutCancel(ctx), base, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.refreshableToken != nil && !c.plaintext {
+		transport = c.refreshableToken.roundTripper(transport)
+	}
+	c.httpClient = &http.Client{Transport: transport}
+	return c.httpClient, nil
+}
+
+// restURL returns the URL of a REST method of an API, such as logging, at the given endpoint,
+// or its default endpoint if empty. Plaintext connections only go to custom endpoints
+func (c *Client) restURL(service, endpoint, path string) (string, error) {
+	if c.plaintext {
+		if endpoint == "" {
+			return "", fmt.Errorf("%w: the %s REST API has no endpoint", errNoRESTEndpoint, service)
+		}
+		return fmt.Sprintf("http://%s/%s", endpoint, path), nil
+	}
+	if endpoint == "" {
+		endpoint = c.serviceHost(service)
+	}
+	return fmt.Sprintf("https://%s/%s", endpoint, path), nil
+}
+
+// loggingRESTURL returns the URL of a REST method of the Logging API. Over TLS, the REST API
+// is served by the logging endpoint as well, but a plaintext emulator only serves gRPC there
+func (c *Client) loggingRESTURL(path string) (string, error) {
+	endpoint := c.endpoints.LoggingREST
+	if endpoint == "" && !c.plaintext {
+		endpoint = c.endpoints.Logging
+	}
+	return c.restURL("logging", endpoint, path)
+}
+
+// getJSON calls a REST method and decodes its JSON response into out
+func (c *Client) getJSON(ctx context.Context, methodURL string, out any) error {
+	return c.doJSON(ctx, http.MethodGet, methodURL, nil, out)
+}
+
+// postJSON calls a REST method with the JSON encoding of in, and decodes its JSON response into out
+func (c *Client) postJSON(ctx context.Context, methodURL string, in, out any) error {
+	return c.doJSON(ctx, http.MethodPost, methodURL, in, out)
+}
+
+func (c *Client) doJSON(ctx context.Context, method, methodURL string, in, out any) error {
+	c.mu.Lock()
+	client, err := c.restClientLocked(ctx)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, methodURL, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		if resp.StatusCode == http.StatusUnauthorized && c.onUnauthenticated != nil {
+			c.onUnauthenticated()
+		}
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// listPages calls a REST list method until it has no more pages or limit items are listed.
+// Each page is decoded by decode, which returns the number of items and the next page token
+func (c *Client) listPages(ctx context.Context, listURL string, limit int, decode func(page []byte) (int, string, error)) error {
+	listed, pageToken := 0, ""
+	for {
+		pageURL := listURL
+		if pageToken != "" {
+			pageURL += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		var page json.RawMessage
+		if err := c.getJSON(ctx, pageURL, &page); err != nil {
+			return err
+		}
+		n, next, err := decode(page)
+		if err != nil {
+			return err
+		}
+		listed += n
+		if next == "" || listed >= limit {
+			return nil
+		}
+		pageToken = next
+	}
+}
+
+// SavedQuery is a query saved in the Logs Explorer
+type SavedQuery struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	Description string `json:"description"`
+	Filter      string `json:"filter"`
+	// Visibility is SHARED for queries shared with the project, or PRIVATE
+	Visibility string    `json:"visibility"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+// RecentQuery is a query recently run in the Logs Explorer
+type RecentQuery struct {
+	Name        string    `json:"name"`
+	Filter      string    `json:"filter"`
+	LastRunTime time.Time `json:"lastRunTime"`
+}
+
+// loggingQuery is the Logging query language part of saved and recent queries. Log Analytics
+// queries have none
+type loggingQuery struct {
+	Filter string `json:"filter"`
+}
+
+// ListSavedQueries returns the Logs Explorer queries saved in all locations of a project
+func (c *Client) ListSavedQueries(ctx context.Context, projectID string) ([]SavedQuery, error) {
+	queries := []SavedQuery{}
+	listURL, err := c.loggingRESTURL(fmt.Sprintf("v2/projects/%s/locations/-/savedQueries?pageSize=100", url.PathEscape(projectID)))
+	if err != nil {
+		return nil, err
+	}
+	err = c.listPages(ctx, listURL, maxSavedQueries, func(page []byte) (int, string, error) {
+		var resp struct {
+			SavedQueries []struct {
+				Name         string        `json:"name"`
+				DisplayName  string        `json:"displayName"`
+				Description  string        `json:"description"`
+				Visibility   string        `json:"visibility"`
+				UpdateTime   time.Time     `json:"updateTime"`
+				LoggingQuery *loggingQuery `json:"loggingQuery"`
+			} `json:"savedQueries"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(page, &resp); err != nil {
+			return 0, "", err
+		}
+		for _, q := range resp.SavedQueries {
+			if q.LoggingQuery == nil {
+				continue
+			}
+			queries = append(queries, SavedQuery{
+				Name:        q.Name,
+				DisplayName: q.DisplayName,
+				Description: q.Description,
+				Filter:      q.LoggingQuery.Filter,
+				Visibility:  q.Visibility,
+				UpdateTime:  q.UpdateTime,
+			})
+		}
+		return len(resp.SavedQueries), resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return queries[:min(len(queries), maxSavedQueries)], nil
+}
+
+// ListRecentQueries returns the Logs Explorer queries recently run in all locations of a project
+func (c *Client) ListRecentQueries(ctx context.Context, projectID string) ([]RecentQuery, error) {
+	queries := []RecentQuery{}
+	listURL, err := c.loggingRESTURL(fmt.Sprintf("v2/projects/%s/locations/-/recentQueries?pageSize=100", url.PathEscape(projectID)))
+	if err != nil {
+		return nil, err
+	}
+	err = c.listPages(ctx, listURL, maxSavedQueries, func(page []byte) (int, string, error) {
+		var resp struct {
+			RecentQueries []struct {
+				Name         string        `json:"name"`
+				LastRunTime  time.Time     `json:"lastRunTime"`
+				LoggingQuery *loggingQuery `json:"loggingQuery"`
+			} `json:"recentQueries"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(page, &resp); err != nil {
+			return 0, "", err
+		}
+		for _, q := range resp.RecentQueries {
+			if q.LoggingQuery == nil {
+				continue
+			}
+			queries = append(queries, RecentQuery{Name: q.Name, Filter: q.LoggingQuery.Filter, LastRunTime: q.LastRunTime})
+		}
+		return len(resp.RecentQueries), resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return queries[:min(len(queries), maxSavedQueries)], nil
+}
+
+// LogScope is a group of projects and log views which can be queried together
+type LogScope struct {
+	// ID is the last part of the name of the log scope
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// ResourceNames are the projects and views of the log scope, such as projects/my-project
+	// or projects/my-project/locations/global/buckets/my-bucket/views/my-view
+	ResourceNames []string `json:"resourceNames"`
+}
+
+// ListLogScopes returns the log scopes of a project. Log scopes only exist in the global location
+func (c *Client) ListLogScopes(ctx context.Context, projectID string) ([]LogScope, error) {
+	scopes := []LogScope{}
+	listURL, err := c.loggingRESTURL(fmt.Sprintf("v2/projects/%s/locations/global/logScopes?pageSize=100", url.PathEscape(projectID)))
+	if err != nil {
+		return nil, err
+	}
+	err = c.listPages(ctx, listURL, maxLogScopes, func(page []byte) (int, string, error) {
+		var resp struct {
+			LogScopes     []LogScope `json:"logScopes"`
+			NextPageToken string     `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(page, &resp); err != nil {
+			return 0, "", err
+		}
+		for _, scope := range resp.LogScopes {
+			scope.ID = scope.Name[strings.LastIndex(scope.Name, "/")+1:]
+			if scope.ResourceNames == nil {
+				scope.ResourceNames = []string{}
+			}
+			scopes = append(scopes, scope)
+		}
+		return len(resp.LogScopes), resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scopes[:min(len(scopes), maxLogScopes)], nil
+}
+
+// ListErrorGroups returns the Error Reporting error groups of the log entries matching a query
+// with the given insert IDs, by insert ID. Error groups are only returned by the REST API, so
+// the entries are listed again, with only their insert IDs and error groups. At most
+// maxErrorGroupEntries entries are looked up, and entries without error groups are left out
+func (c *Client) ListErrorGroups(ctx context.Context, q *Query, insertIDs []string) (map[string][]string, error) {
+	groups := map[string][]string{}
+	if len(insertIDs) == 0 {
+		return groups, nil
+	}
+	insertIDs = insertIDs[:min(len(insertIDs), maxErrorGroupEntries)]
+
+	filters := make([]string, 0, len(insertIDs))
+	for _, id := range insertIDs {
+		// Quoted as insert IDs are read from the log entries
+		filters = append(filters, "insertId="+strconv.Quote(id))
+	}
+	parent, resourceNames := q.resourceNames()
+	body := map[string]any{
+		"resourceNames": resourceNames,
+		"filter":        fmt.Sprintf("%s AND (%s)", q.String(), strings.Join(filters, " OR ")),
+		"pageSize":      len(insertIDs),
+	}
+	listURL, err := c.loggingRESTURL("v2/entries:list?fields=" + url.QueryEscape("entries(insertId,errorGroups),nextPageToken"))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.rateLimiter.wait(ctx, rateLimitKey(parent)); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Entries []struct {
+			InsertID    string `json:"insertId"`
+			ErrorGroups []struct {
+				ID string `json:"id"`
+			} `json:"errorGroups"`
+		} `json:"entries"`
+	}
+	if err := c.postJSON(ctx, listURL, body, &resp); err != nil {
+		return nil, err
+	}
+	for _, entry := range resp.Entries {
+		for _, group := range entry.ErrorGroups {
+			groups[entry.InsertID] = append(groups[entry.InsertID], group.ID)
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// queriesStandIn serves the saved and recent queries and the log scopes of test-project over REST
+func queriesStandIn(t *testing.T) (*httptest.Server, *[]string) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v2/projects/test-project/locations/-/savedQueries":
+			if r.URL.Query().Get("pageToken") == "" {
+				w.Write([]byte(`{
+					"savedQueries": [
+						{
+							"name": "projects/test-project/locations/global/savedQueries/errors",
+							"displayName": "Errors",
+							"description": "All errors",
+							"visibility": "SHARED",
+							"updateTime": "2024-01-01T00:00:00Z",
+							"loggingQuery": {"filter": "severity >= ERROR"}
+						},
+						{
+							"name": "projects/test-project/locations/global/savedQueries/sql",
+							"displayName": "SQL",
+							"opsAnalyticsQuery": {"sqlQueryText": "SELECT 1"}
+						}
+					],
+					"nextPageToken": "page/2"
+				}`))
+				return
+			}
+			require.Equal(t, "page/2", r.URL.Query().Get("pageToken"))
+			w.Write([]byte(`{"savedQueries": [{"name": "projects/test-project/locations/global/savedQueries/mine", "displayName": "Mine", "visibility": "PRIVATE", "loggingQuery": {"filter": "logName:syslog"}}]}`))
+		case "/v2/projects/test-project/locations/-/recentQueries":
+			w.Write([]byte(`{"recentQueries": [{"name": "projects/test-project/locations/global/recentQueries/1", "lastRunTime": "2024-01-02T00:00:00Z", "loggingQuery": {"filter": "resource.type=\"gce_instance\""}}]}`))
+		case "/v2/projects/test-project/locations/global/logScopes":
+			w.Write([]byte(`{"logScopes": [{
+				"name": "projects/test-project/locations/global/logScopes/payments",
+				"description": "Payments services",
+				"resourceNames": ["projects/test-project", "projects/billing/locations/global/buckets/audit/views/_AllLogs"]
+			}]}`))
+		case "/v2/projects/expired-token/locations/-/savedQueries":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"code": 401, "message": "Request had invalid authentication credentials", "status": "UNAUTHENTICATED"}}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": {"code": 403, "message": "The caller does not have permission", "status": "PERMISSION_DENIED"}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestListSavedQueries(t *testing.T) {
+	server, requests := queriesStandIn(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{LoggingREST: server.Listener.Addr().String()}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	queries, err := client.ListSavedQueries(context.Background(), "test-project")
+	require.NoError(t, err)
+	require.Equal(t, []SavedQuery{
+		{
+			Name:        "projects/test-project/locations/global/savedQueries/errors",
+			DisplayName: "Errors",
+			Description: "All errors",
+			Filter:      "severity >= ERROR",
+			Visibility:  "SHARED",
+			UpdateTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:        "projects/test-project/locations/global/savedQueries/mine",
+			DisplayName: "Mine",
+			Filter:      "logName:syslog",
+			Visibility:  "PRIVATE",
+		},
+	}, queries)
+	require.Equal(t, []string{
+		"/v2/projects/test-project/locations/-/savedQueries?pageSize=100",
+		"/v2/projects/test-project/locations/-/savedQueries?pageSize=100&pageToken=page%2F2",
+	}, *requests)
+
+	_, err = client.ListSavedQueries(context.Background(), "other-project")
+	require.ErrorContains(t, err, "The caller does not have permission")
+}
+
+func TestUnauthenticatedHandler_REST(t *testing.T) {
+	server, _ := queriesStandIn(t)
+	rejected := 0
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{LoggingREST: server.Listener.Addr().String()}),
+		WithUnauthenticatedHandler(func() { rejected++ }))
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.ListSavedQueries(context.Background(), "other-project")
+	require.Error(t, err)
+	require.Zero(t, rejected)
+	_, err = client.ListSavedQueries(context.Background(), "expired-token")
+	require.ErrorContains(t, err, "invalid authentication credentials")
+	require.Equal(t, 1, rejected)
+}
+
+func TestListRecentQueries(t *testing.T) {
+	server, _ := queriesStandIn(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{LoggingREST: server.Listener.Addr().String()}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	queries, err := client.ListRecentQueries(context.Background(), "test-project")
+	require.NoError(t, err)
+	require.Equal(t, []RecentQuery{
+		{
+			Name:        "projects/test-project/locations/global/recentQueries/1",
+			Filter:      `resource.type="gce_instance"`,
+			LastRunTime: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+	}, queries)
+}
+
+func TestListLogScopes(t *testing.T) {
+	server, _ := queriesStandIn(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{LoggingREST: server.Listener.Addr().String()}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	scopes, err := client.ListLogScopes(context.Background(), "test-project")
+	require.NoError(t, err)
+	require.Equal(t, []LogScope{
+		{
+			ID:            "payments",
+			Name:          "projects/test-project/locations/global/logScopes/payments",
+			Description:   "Payments services",
+			ResourceNames: []string{"projects/test-project", "projects/billing/locations/global/buckets/audit/views/_AllLogs"},
+		},
+	}, scopes)
+
+	_, err = client.ListLogScopes(context.Background(), "other-project")
+	require.ErrorContains(t, err, "The caller does not have permission")
+}
+
+func TestLoggingRESTURL(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts []ClientOption
+		want string
+		err  error
+	}{
+		"default endpoint": {want: "https://logging.googleapis.com/v2/entries:list"},
+		"universe domain": {
+			opts: []ClientOption{WithUniverseDomain("example-universe.com")},
+			want: "https://logging.example-universe.com/v2/entries:list",
+		},
+		"custom endpoint serving both APIs over TLS": {
+			opts: []ClientOption{WithEndpoints(Endpoints{Logging: "logging-myendpoint.p.googleapis.com:443"})},
+			want: "https://logging-myendpoint.p.googleapis.com:443/v2/entries:list",
+		},
+		"custom REST endpoint": {
+			opts: []ClientOption{WithEndpoints(Endpoints{Logging: "logging-myendpoint.p.googleapis.com:443", LoggingREST: "rest.example.com:8443"})},
+			want: "https://rest.example.com:8443/v2/entries:list",
+		},
+		"plaintext REST endpoint": {
+			opts: []ClientOption{WithPlaintext(), WithEndpoints(Endpoints{Logging: "localhost:8081", LoggingREST: "localhost:8080"})},
+			want: "http://localhost:8080/v2/entries:list",
+		},
+		"plaintext without REST endpoint": {
+			opts: []ClientOption{WithPlaintext(), WithEndpoints(Endpoints{Logging: "localhost:8081"})},
+			err:  errNoRESTEndpoint,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, err := New(context.Background(), append(tc.opts, WithAccessToken("token"))...)
+			require.NoError(t, err)
+			defer client.Close()
+
+			got, err := client.loggingRESTURL("v2/entries:list")
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestREST_PlaintextEmulator(t *testing.T) {
+	// The emulator serves gRPC on the logging endpoint, and REST on its own endpoint
+	grpcFake := newScriptedLoggingServer(t)
+	server, requests := queriesStandIn(t)
+
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{
+		Logging:     grpcFake.addr,
+		LoggingREST: server.Listener.Addr().String(),
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+	queries, err := client.ListRecentQueries(context.Background(), "test-project")
+	require.NoError(t, err)
+	require.Len(t, queries, 1)
+	require.Len(t, *requests, 1)
+
+	// Without a REST endpoint, nothing is sent to the gRPC port
+	client, err = New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: server.Listener.Addr().String()}))
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.ListSavedQueries(context.Background(), "test-project")
+	require.ErrorIs(t, err, errNoRESTEndpoint)
+	require.Len(t, *requests, 1)
+}
+
+func TestListErrorGroups(t *testing.T) {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/v2/entries:list", r.URL.Path)
+		require.Equal(t, "entries(insertId,errorGroups),nextPageToken", r.URL.Query().Get("fields"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"entries": [
+			{"insertId": "a", "errorGroups": [{"id": "COShysOX0r_51QE"}, {"id": "CNSgkpnppqKCUw"}]},
+			{"insertId": "b"}
+		]}`))
+	}))
+	defer server.Close()
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{LoggingREST: server.Listener.Addr().String()}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	q := &Query{ProjectID: "test-project", BucketId: "global/buckets/audit", Filter: "severity>=ERROR"}
+	q.TimeRange.From = "2024-01-01T00:00:00Z"
+	q.TimeRange.To = "2024-01-01T01:00:00Z"
+	groups, err := client.ListErrorGroups(context.Background(), q, []string{"a", "b"})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"a": {"COShysOX0r_51QE", "CNSgkpnppqKCUw"}}, groups)
+	require.Equal(t, map[string]any{
+		"resourceNames": []any{"projects/test-project/locations/global/buckets/audit/views/_AllLogs"},
+		"filter":        `severity>=ERROR AND timestamp >= "2024-01-01T00:00:00Z" AND timestamp <= "2024-01-01T01:00:00Z" AND (insertId="a" OR insertId="b")`,
+		"pageSize":      float64(2),
+	}, body)
+
+	// Nothing is requested without entries to look up
+	groups, err = client.ListErrorGroups(context.Background(), q, nil)
+	require.NoError(t, err)
+	require.Empty(t, groups)
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy is how calls to the Cloud Logging API are retried, and how long they may take
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of each page request, including the first one.
+	// 1 disables retries
+	MaxAttempts int
+	// InitialBackoff is the longest wait before the first retry. Each retry waits a random
+	// duration up to the backoff, which doubles after each retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// PageTimeout is the deadline of each page request
+	PageTimeout time.Duration
+	// TotalTimeout is the deadline of a query, over all its pages and retries
+	TotalTimeout time.Duration
+}
+
+// DefaultRetryPolicy returns the retry policy of clients created without WithRetryPolicy
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		PageTimeout:    30 * time.Second,
+		TotalTimeout:   time.Minute,
+	}
+}
+
+// Validate checks that the attempts and durations are positive
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.MaxAttempts < 1:
+		return errors.New("max attempts must be at least 1")
+	case p.InitialBackoff <= 0 || p.MaxBackoff <= 0:
+		return errors.New("backoffs must be positive")
+	case p.MaxBackoff < p.InitialBackoff:
+		return errors.New("max backoff must not be shorter than the initial backoff")
+	case p.PageTimeout <= 0 || p.TotalTimeout <= 0:
+		return errors.New("timeouts must be positive")
+	}
+	return nil
+}
+
+// retryable checks whether a failed call may succeed if retried
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// do calls f until it succeeds, fails with an error that is not retryable, or runs out of
+// attempts or time. Each attempt has its own deadline. An exhausted quota is only retried
+// once, as it usually lasts until the quota refills
+func (p RetryPolicy) do(ctx context.Context, f func(ctx context.Context) error) error {
+	backoff := p.InitialBackoff
+	exhausted := false
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, p.PageTimeout)
+		err := f(attemptCtx)
+		cancel()
+		if err == nil || !retryable(err) || attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		if status.Code(err) == codes.ResourceExhausted {
+			if exhausted {
+				return err
+			}
+			exhausted = true
+		}
+
+		// Full jitter spreads out the retries of concurrent queries
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		statsFromContext(ctx).addRetry()
+
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// CallStats counts what happened during the calls made with a context
+type CallStats struct {
+	mu      sync.Mutex
+	retries int
+}
+
+// Retries returns the number of retried requests
+func (s *CallStats) Retries() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retries
+}
+
+func (s *CallStats) addRetry() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+}
+
+type callStatsKey struct{}
+
+// WithCallStats returns a context collecting the statistics of the calls made with it into stats
+func WithCallStats(ctx context.Context, stats *CallStats) context.Context {
+	return context.WithValue(ctx, callStatsKey{}, stats)
+}
+
+func statsFromContext(ctx context.Context) *CallStats {
+	stats, _ := ctx.Value(callStatsKey{}).(*CallStats)
+	return stats
+}
@@ -0,0 +1,332 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scriptedLoggingServer answers each ListLogEntries request with the next scripted response
+type scriptedLoggingServer struct {
+	loggingpb.UnimplementedLoggingServiceV2Server
+
+	addr string
+
+	mu        sync.Mutex
+	responses []func(ctx context.Context, req *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error)
+	requests  []*loggingpb.ListLogEntriesRequest
+}
+
+func newScriptedLoggingServer(t *testing.T) *scriptedLoggingServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	fake := &scriptedLoggingServer{addr: lis.Addr().String()}
+	server := grpc.NewServer()
+	loggingpb.RegisterLoggingServiceV2Server(server, fake)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return fake
+}
+
+func (f *scriptedLoggingServer) script(responses ...func(ctx context.Context, req *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = responses
+	f.requests = nil
+}
+
+func (f *scriptedLoggingServer) ListLogEntries(ctx context.Context, req *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	if len(f.responses) == 0 {
+		f.mu.Unlock()
+		return nil, status.Error(codes.Internal, "unexpected request")
+	}
+	respond := f.responses[0]
+	if len(f.responses) > 1 {
+		f.responses = f.responses[1:]
+	}
+	f.mu.Unlock()
+	return respond(ctx, req)
+}
+
+func (f *scriptedLoggingServer) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func fail(code codes.Code) func(context.Context, *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+	return func(context.Context, *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+		return nil, status.Error(code, code.String())
+	}
+}
+
+func page(nextPageToken string, insertIDs ...string) func(context.Context, *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+	return func(context.Context, *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+		resp := &loggingpb.ListLogEntriesResponse{NextPageToken: nextPageToken}
+		for _, id := range insertIDs {
+			resp.Entries = append(resp.Entries, &loggingpb.LogEntry{InsertId: id})
+		}
+		return resp, nil
+	}
+}
+
+func hang(ctx context.Context, req *loggingpb.ListLogEntriesRequest) (*loggingpb.ListLogEntriesResponse, error) {
+	<-ctx.Done()
+	return nil, status.FromContextError(ctx.Err()).Err()
+}
+
+func TestListLogs_Retry(t *testing.T) {
+	fake := newScriptedLoggingServer(t)
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		PageTimeout:    200 * time.Millisecond,
+		TotalTimeout:   2 * time.Second,
+	}
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithRetryPolicy(policy))
+	require.NoError(t, err)
+	defer client.Close()
+
+	list := func(limit int64) ([]*loggingpb.LogEntry, int, error) {
+		stats := &CallStats{}
+		entries, err := client.ListLogs(WithCallStats(context.Background(), stats), &Query{ProjectID: "test-project", Limit: limit})
+		return entries, stats.Retries(), err
+	}
+
+	t.Run("retries transient errors", func(t *testing.T) {
+		fake.script(fail(codes.Unavailable), fail(codes.ResourceExhausted), page("", "1"))
+		entries, retries, err := list(10)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, 2, retries)
+	})
+
+	t.Run("retries pages past their deadline", func(t *testing.T) {
+		fake.script(hang, page("", "1"))
+		entries, retries, err := list(10)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, 1, retries)
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		fake.script(fail(codes.PermissionDenied))
+		_, retries, err := list(10)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+		require.Equal(t, 0, retries)
+		require.Equal(t, 1, fake.requestCount())
+	})
+
+	t.Run("retries an exhausted quota once", func(t *testing.T) {
+		fake.script(fail(codes.ResourceExhausted))
+		entries, retries, err := list(10)
+		require.Nil(t, entries)
+		require.ErrorIs(t, err, ErrQuotaExceeded)
+		require.Equal(t, 1, retries)
+		require.Equal(t, 2, fake.requestCount())
+	})
+
+	t.Run("surfaces the error once out of attempts", func(t *testing.T) {
+		fake.script(fail(codes.Unavailable))
+		entries, retries, err := list(10)
+		require.Nil(t, entries)
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Equal(t, 2, retries)
+		require.Equal(t, 3, fake.requestCount())
+	})
+
+	t.Run("returns the pages fetched before an error", func(t *testing.T) {
+		fake.script(page("page-2", "1", "2"), fail(codes.PermissionDenied))
+		entries, _, err := list(10)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+		require.Len(t, entries, 2)
+		require.Equal(t, "2", entries[1].GetInsertId())
+	})
+
+	t.Run("makes one call per page, even for empty pages", func(t *testing.T) {
+		fake.script(page("page-2"), fail(codes.Unavailable), page("page-3"), page("", "1"))
+		entries, retries, err := list(10)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, 1, retries)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		tokens := []string{}
+		for _, req := range fake.requests {
+			tokens = append(tokens, req.PageToken)
+		}
+		// The failed call of the second page is retried alone
+		require.Equal(t, []string{"", "page-2", "page-2", "page-3"}, tokens)
+	})
+
+	t.Run("retries each page", func(t *testing.T) {
+		fake.script(page("page-2", "1", "2"), fail(codes.Unavailable), page("page-3", "3", "4"), page("", "5"))
+		entries, retries, err := list(4)
+		require.NoError(t, err)
+		require.Len(t, entries, 4)
+		require.Equal(t, "4", entries[3].GetInsertId())
+		require.Equal(t, 1, retries)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		tokens := []string{}
+		sizes := []int32{}
+		for _, req := range fake.requests {
+			tokens = append(tokens, req.PageToken)
+			sizes = append(sizes, req.PageSize)
+		}
+		require.Equal(t, []string{"", "page-2", "page-2"}, tokens)
+		require.Equal(t, []int32{4, 2, 2}, sizes)
+	})
+}
+
+func TestListLogs_TotalTimeout(t *testing.T) {
+	fake := newScriptedLoggingServer(t)
+	fake.script(hang)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    100,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		PageTimeout:    50 * time.Millisecond,
+		TotalTimeout:   300 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	start := time.Now()
+	_, err = client.ListLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 10})
+	require.ErrorContains(t, err, "list entries: no response within 300ms")
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	err = client.TestConnection(context.Background(), "projects/test-project")
+	require.EqualError(t, err, "list entries: timeout")
+}
+
+func TestListLogs_ResourceNames(t *testing.T) {
+	fake := newScriptedLoggingServer(t)
+	fake.script(page(""))
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, tc := range []struct {
+		query Query
+		want  string
+	}{
+		{query: Query{ProjectID: "test-project"}, want: "projects/test-project"},
+		{query: Query{ProjectID: "test-project", BucketId: "global/buckets/audit"}, want: "projects/test-project/locations/global/buckets/audit/views/_AllLogs"},
+		{query: Query{ProjectID: "test-project", BucketId: "global/buckets/audit", ViewId: "recent"}, want: "projects/test-project/locations/global/buckets/audit/views/recent"},
+		{query: Query{ProjectID: "test-project", BucketId: "global/buckets/audit", LogScope: "payments"}, want: "projects/test-project/locations/global/logScopes/payments"},
+		{query: Query{Parent: "organizations/123"}, want: "organizations/123"},
+		{query: Query{Parent: "billingAccounts/0A1B2C-3D4E5F-6A7B8C", BucketId: "global/buckets/audit"}, want: "billingAccounts/0A1B2C-3D4E5F-6A7B8C/locations/global/buckets/audit/views/_AllLogs"},
+	} {
+		_, err := client.ListLogs(context.Background(), &tc.query)
+		require.NoError(t, err)
+
+		fake.mu.Lock()
+		require.Equal(t, []string{tc.want}, fake.requests[len(fake.requests)-1].ResourceNames)
+		fake.mu.Unlock()
+	}
+}
+
+func TestStreamLogs(t *testing.T) {
+	fake := newScriptedLoggingServer(t)
+	client, err := New(context.Background(), WithPlaintext(), WithEndpoints(Endpoints{Logging: fake.addr}), WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		PageTimeout:    200 * time.Millisecond,
+		TotalTimeout:   time.Second,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	t.Run("calls fn with each page up to the limit", func(t *testing.T) {
+		fake.script(page("page-2", "1", "2"), fail(codes.Unavailable), page("page-3", "3"), page("", "4"))
+		pages := [][]string{}
+		err := client.StreamLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 3}, func(entries []*loggingpb.LogEntry) error {
+			ids := []string{}
+			for _, e := range entries {
+				ids = append(ids, e.GetInsertId())
+			}
+			pages = append(pages, ids)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, [][]string{{"1", "2"}, {"3"}}, pages)
+		require.Equal(t, 3, fake.requestCount())
+	})
+
+	t.Run("stops on errors of fn", func(t *testing.T) {
+		ids := make([]string, 1000)
+		for i := range ids {
+			ids[i] = strconv.Itoa(i)
+		}
+		fake.script(page("page-2", ids...), page("", "1000"))
+		stop := fmt.Errorf("write failed")
+		err := client.StreamLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 2000}, func([]*loggingpb.LogEntry) error {
+			return stop
+		})
+		require.Equal(t, stop, err)
+		require.Equal(t, 1, fake.requestCount())
+	})
+
+	t.Run("wraps errors listing entries", func(t *testing.T) {
+		fake.script(fail(codes.PermissionDenied))
+		err := client.StreamLogs(context.Background(), &Query{ProjectID: "test-project", Limit: 10}, func([]*loggingpb.LogEntry) error {
+			return nil
+		})
+		require.ErrorContains(t, err, "list entries: ")
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+}
+
+func TestRetryPolicy_Validate(t *testing.T) {
+	require.NoError(t, DefaultRetryPolicy().Validate())
+
+	for _, tc := range []struct {
+		change func(p *RetryPolicy)
+		err    string
+	}{
+		{func(p *RetryPolicy) { p.MaxAttempts = 0 }, "max attempts must be at least 1"},
+		{func(p *RetryPolicy) { p.InitialBackoff = 0 }, "backoffs must be positive"},
+		{func(p *RetryPolicy) { p.MaxBackoff = p.InitialBackoff / 2 }, "max backoff must not be shorter than the initial backoff"},
+		{func(p *RetryPolicy) { p.TotalTimeout = -time.Second }, "timeouts must be positive"},
+	} {
+		policy := DefaultRetryPolicy()
+		tc.change(&policy)
+		require.EqualError(t, policy.Validate(), tc.err)
+
+		_, err := New(context.Background(), WithRetryPolicy(policy))
+		require.EqualError(t, err, fmt.Sprintf("retry policy: %s", tc.err))
+	}
+}
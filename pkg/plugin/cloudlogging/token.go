@@ -0,0 +1,254 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// tokenExpiryDelta is how long before its expiry a token is read again
+	tokenExpiryDelta = time.Minute
+	// commandTokenLifetime is how long a token printed by a command without an expiry is used
+	commandTokenLifetime = 5 * time.Minute
+	// defaultCommandTimeout is how long a credential helper command may run
+	defaultCommandTimeout = 30 * time.Second
+)
+
+// RefreshableTokenSource is an oauth2.TokenSource which reads an access token from a file
+// or a credential helper command, and reads it again when it expires or is rejected
+type RefreshableTokenSource struct {
+	// read gets a new token. The modification time of the token file, if any, is returned
+	// to detect when the file is rewritten
+	read func(ctx context.Context) (*oauth2.Token, time.Time, error)
+
+	mu      sync.Mutex
+	token   *oauth2.Token
+	modTime time.Time
+	path    string
+}
+
+// NewFileTokenSource creates a token source reading the access token from a file. The file holds
+// either the bare token, or a JSON object with an access token and its expiry
+func NewFileTokenSource(path string) *RefreshableTokenSource {
+	return &RefreshableTokenSource{
+		path: path,
+		read: func(ctx context.Context) (*oauth2.Token, time.Time, error) {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("access token file: %w", err)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("access token file: %w", err)
+			}
+			token, err := parseAccessToken(content)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("access token file: %w", err)
+			}
+			return token, info.ModTime(), nil
+		},
+	}
+}
+
+// NewCommandTokenSource creates a token source running a credential helper command, such as
+// `gcloud auth print-access-token`, which prints either the bare token or a JSON object with
+// an access token and its expiry. The command is not run through a shell
+func NewCommandTokenSource(command string, timeout time.Duration) *RefreshableTokenSource {
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	args := strings.Fields(command)
+
+	return &RefreshableTokenSource{
+		read: func(ctx context.Context) (*oauth2.Token, time.Time, error) {
+			if len(args) == 0 {
+				return nil, time.Time{}, errors.New("access token command: empty command")
+			}
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			var stdout, stderr bytes.Buffer
+			cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			if err := cmd.Run(); err != nil {
+				return nil, time.Time{}, fmt.Errorf("access token command: %w: %s", err, strings.TrimSpace(stderr.String()))
+			}
+
+			token, err := parseAccessToken(stdout.Bytes())
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("access token command: %w", err)
+			}
+			if token.Expiry.IsZero() {
+				token.Expiry = time.Now().Add(commandTokenLifetime)
+			}
+			return token, time.Time{}, nil
+		},
+	}
+}
+
+// Token returns the current access token, reading a new one if it is about to expire or the
+// token file has changed
+func (s *RefreshableTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && !s.expired() && !s.fileChanged() {
+		return s.token, nil
+	}
+
+	token, modTime, err := s.read(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	s.modTime = modTime
+	return token, nil
+}
+
+// Invalidate discards the current token, so the next call to Token reads a new one
+func (s *RefreshableTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = nil
+}
+
+// Expiry returns the expiry of the current token, reading one if needed. It is zero if the
+// expiry of the token is unknown
+func (s *RefreshableTokenSource) Expiry() (time.Time, error) {
+	token, err := s.Token()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return token.Expiry, nil
+}
+
+func (s *RefreshableTokenSource) expired() bool {
+	return !s.token.Expiry.IsZero() && time.Now().Add(tokenExpiryDelta).After(s.token.Expiry)
+}
+
+func (s *RefreshableTokenSource) fileChanged() bool {
+	if s.path == "" {
+		return false
+	}
+	info, err := os.Stat(s.path)
+	return err != nil || !info.ModTime().Equal(s.modTime)
+}
+
+// unaryInterceptor retries calls rejected as unauthenticated once with a newly read token
+func (s *RefreshableTokenSource) unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if status.Code(err) != codes.Unauthenticated {
+		return err
+	}
+	log.DefaultLogger.Debug("Access token rejected, reading a new one", "method", method)
+	s.Invalidate()
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// roundTripper wraps the authenticating transport of REST calls to retry requests rejected as
+// unauthenticated once with a newly read token, as unaryInterceptor does for gRPC calls
+func (s *RefreshableTokenSource) roundTripper(base http.RoundTripper) http.RoundTripper {
+	return &refreshingTransport{source: s, base: base}
+}
+
+type refreshingTransport struct {
+	source *RefreshableTokenSource
+	base   http.RoundTripper
+}
+
+func (t *refreshingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// Requests whose body cannot be read again are not retried
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	log.DefaultLogger.Debug("Access token rejected, reading a new one", "url", req.URL.Redacted())
+	t.source.Invalidate()
+	return t.base.RoundTrip(retry)
+}
+
+// accessTokenJSON is the JSON output accepted from token files and credential helper commands
+type accessTokenJSON struct {
+	AccessToken string     `json:"access_token"`
+	Token       string     `json:"token"`
+	ExpiresIn   int64      `json:"expires_in"`
+	Expiry      *time.Time `json:"expiry"`
+	ExpireTime  *time.Time `json:"expire_time"`
+}
+
+// parseAccessToken parses a bare access token, or a JSON object with an access token and its expiry
+func parseAccessToken(content []byte) (*oauth2.Token, error) {
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return nil, errors.New("empty access token")
+	}
+	if content[0] != '{' {
+		return &oauth2.Token{AccessToken: string(content)}, nil
+	}
+
+	var parsed accessTokenJSON
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		return nil, fmt.Errorf("parse access token: %w", err)
+	}
+	token := &oauth2.Token{AccessToken: parsed.AccessToken}
+	if token.AccessToken == "" {
+		token.AccessToken = parsed.Token
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("no access_token or token field")
+	}
+
+	switch {
+	case parsed.Expiry != nil:
+		token.Expiry = *parsed.Expiry
+	case parsed.ExpireTime != nil:
+		token.Expiry = *parsed.ExpireTime
+	case parsed.ExpiresIn > 0:
+		token.Expiry = time.Now().Add(time.Duration(parsed.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudlogging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseAccessToken(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for name, tc := range map[string]struct {
+		content string
+		token   string
+		expiry  time.Time
+		// expiresIn is checked approximately, as it is relative to now
+		expiresIn time.Duration
+		err       string
+	}{
+		"bare token":        {content: "ya29.token\n", token: "ya29.token"},
+		"access_token":      {content: `{"access_token": "ya29.token", "expiry": "2030-01-02T03:04:05Z"}`, token: "ya29.token", expiry: expiry},
+		"token":             {content: `{"token": "ya29.token", "expire_time": "2030-01-02T03:04:05Z"}`, token: "ya29.token", expiry: expiry},
+		"expires_in":        {content: `{"access_token": "ya29.token", "expires_in": 3600}`, token: "ya29.token", expiresIn: time.Hour},
+		"empty":             {content: "  \n", err: "empty access token"},
+		"no token field":    {content: `{"expires_in": 3600}`, err: "no access_token or token field"},
+		"invalid JSON":      {content: `{"access_token": `, err: "parse access token"},
+		"invalid expiry":    {content: `{"access_token": "ya29.token", "expiry": "tomorrow"}`, err: "parse access token"},
+		"no expiry in JSON": {content: `{"access_token": "ya29.token"}`, token: "ya29.token"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			token, err := parseAccessToken([]byte(tc.content))
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.token, token.AccessToken)
+			if tc.expiresIn > 0 {
+				require.WithinDuration(t, time.Now().Add(tc.expiresIn), token.Expiry, time.Minute)
+			} else {
+				require.True(t, tc.expiry.Equal(token.Expiry), "expiry %s, expected %s", token.Expiry, tc.expiry)
+			}
+		})
+	}
+}
+
+func TestFileTokenSource(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("first-token"), 0600))
+
+	ts := NewFileTokenSource(tokenFile)
+	token, err := ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "first-token", token.AccessToken)
+
+	// The token is read again once the file is rewritten
+	require.NoError(t, os.WriteFile(tokenFile, []byte(`{"access_token": "second-token", "expires_in": 3600}`), 0600))
+	require.NoError(t, os.Chtimes(tokenFile, time.Now(), time.Now().Add(time.Minute)))
+	token, err = ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "second-token", token.AccessToken)
+
+	expiry, err := ts.Expiry()
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), expiry, time.Minute)
+
+	// Expired tokens are read again even if the file did not change
+	info, err := os.Stat(tokenFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tokenFile, []byte(`{"access_token": "expired-token", "expires_in": 30}`), 0600))
+	require.NoError(t, os.Chtimes(tokenFile, time.Now(), info.ModTime().Add(time.Minute)))
+	token, err = ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "expired-token", token.AccessToken)
+	require.NoError(t, os.WriteFile(tokenFile, []byte("third-token"), 0600))
+	require.NoError(t, os.Chtimes(tokenFile, time.Now(), info.ModTime().Add(time.Minute)))
+	token, err = ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "third-token", token.AccessToken)
+
+	require.NoError(t, os.Remove(tokenFile))
+	_, err = ts.Token()
+	require.ErrorContains(t, err, "access token file")
+}
+
+func TestCommandTokenSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell script")
+	}
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "count")
+	script := filepath.Join(dir, "token.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho x >> "+counter+"\necho \"token-$(wc -l < "+counter+" | tr -d ' ')\"\n"), 0700))
+
+	ts := NewCommandTokenSource(script, 0)
+	token, err := ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token.AccessToken)
+	require.WithinDuration(t, time.Now().Add(commandTokenLifetime), token.Expiry, time.Minute)
+
+	// The command is not run again while the token is valid
+	token, err = ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token.AccessToken)
+
+	ts.Invalidate()
+	token, err = ts.Token()
+	require.NoError(t, err)
+	require.Equal(t, "token-2", token.AccessToken)
+
+	t.Run("failing command", func(t *testing.T) {
+		failing := filepath.Join(dir, "fail.sh")
+		require.NoError(t, os.WriteFile(failing, []byte("#!/bin/sh\necho 'not logged in' >&2\nexit 1\n"), 0700))
+		_, err := NewCommandTokenSource(failing, 0).Token()
+		require.ErrorContains(t, err, "not logged in")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, err := NewCommandTokenSource("sleep 5", 50*time.Millisecond).Token()
+		require.ErrorContains(t, err, "access token command")
+	})
+
+	t.Run("empty command", func(t *testing.T) {
+		_, err := NewCommandTokenSource(" ", 0).Token()
+		require.ErrorContains(t, err, "empty command")
+	})
+}
+
+func TestRefreshableTokenSource_RetryUnauthenticated(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(`{"access_token": "stale-token", "expires_in": 3600}`), 0600))
+	ts := NewFileTokenSource(tokenFile)
+
+	// The invoker stands in for a server which only accepts the fresh token
+	var seen []string
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		token, err := ts.Token()
+		if err != nil {
+			return err
+		}
+		seen = append(seen, token.AccessToken)
+		if token.AccessToken != "fresh-token" {
+			return status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return nil
+	}
+
+	_, err := ts.Token()
+	require.NoError(t, err)
+	// Rewrite the file keeping its modification time, so only the rejection causes a new read
+	info, err := os.Stat(tokenFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tokenFile, []byte(`{"access_token": "fresh-token", "expires_in": 3600}`), 0600))
+	require.NoError(t, os.Chtimes(tokenFile, time.Now(), info.ModTime()))
+
+	err = ts.unaryInterceptor(context.Background(), "/test", nil, nil, nil, invoker)
+	require.NoError(t, err)
+	require.Equal(t, []string{"stale-token", "fresh-token"}, seen)
+
+	// Other errors are not retried
+	seen = nil
+	permissionDenied := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		seen = append(seen, method)
+		return status.Error(codes.PermissionDenied, "denied")
+	}
+	err = ts.unaryInterceptor(context.Background(), "/test", nil, nil, nil, permissionDenied)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Len(t, seen, 1)
+}
+
+func TestRefreshableTokenSource_RetryUnauthorizedREST(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(`{"access_token": "stale-token", "expires_in": 3600}`), 0600))
+	ts := NewFileTokenSource(tokenFile)
+
+	// The server only accepts the fresh token, and checks that the body is sent again
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		seen = append(seen, r.Header.Get("Authorization")+" "+string(body))
+		switch {
+		case r.URL.Path == "/denied":
+			w.WriteHeader(http.StatusForbidden)
+		case r.Header.Get("Authorization") != "Bearer fresh-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	// The same authenticating transport as the REST client, which asks for a token per request
+	client := &http.Client{Transport: ts.roundTripper(&oauth2.Transport{Source: ts, Base: http.DefaultTransport})}
+
+	_, err := ts.Token()
+	require.NoError(t, err)
+	// Rewrite the file keeping its modification time, so only the rejection causes a new read
+	info, err := os.Stat(tokenFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tokenFile, []byte(`{"access_token": "fresh-token", "expires_in": 3600}`), 0600))
+	require.NoError(t, os.Chtimes(tokenFile, time.Now(), info.ModTime()))
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/query", bytes.NewReader([]byte(`{"query":"SELECT 1"}`)))
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []string{`Bearer stale-token {"query":"SELECT 1"}`, `Bearer fresh-token {"query":"SELECT 1"}`}, seen)
+
+	// Other errors are not retried
+	seen = nil
+	resp, err = client.Get(server.URL + "/denied")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Len(t, seen, 1)
+}
+
+func TestNewClientWithRefreshableToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("file-token"), 0600))
+
+	client, err := NewClientWithRefreshableToken(context.Background(), NewFileTokenSource(tokenFile), "")
+	require.NoError(t, err)
+
+	// REST calls are retried with a new token as well
+	client.mu.Lock()
+	httpClient, err := client.restClientLocked(context.Background())
+	client.mu.Unlock()
+	require.NoError(t, err)
+	require.IsType(t, &refreshingTransport{}, httpClient.Transport)
+	require.NoError(t, client.Close())
+}
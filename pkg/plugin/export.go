@@ -0,0 +1,399 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// defaultMaxExportEntries is the number of log entries exported at most by default
+	defaultMaxExportEntries = 50000
+	// ndjsonExportFormat exports the log entries as they are returned by the API, one per line
+	ndjsonExportFormat = "ndjson"
+	// csvExportFormat exports the log entries as CSV, with a column per label
+	csvExportFormat = "csv"
+)
+
+// exportConfig limits the exports of log entries
+type exportConfig struct {
+	// MaxEntries is the number of log entries exported at most, 50000 by default
+	MaxEntries int64 `json:"maxEntries"`
+}
+
+// maxEntries returns the number of log entries exported at most
+func (e exportConfig) maxEntries() (int64, error) {
+	switch {
+	case e.MaxEntries < 0:
+		return 0, fmt.Errorf("export: invalid maximum number of entries %d", e.MaxEntries)
+	case e.MaxEntries == 0:
+		return defaultMaxExportEntries, nil
+	default:
+		return e.MaxEntries, nil
+	}
+}
+
+// exportRequest is the body of export calls
+type exportRequest struct {
+	Query queryModel `json:"query"`
+	// From and To are the time range of the export, as RFC 3339 times
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Format is ndjson, the default, or csv
+	Format string `json:"format"`
+	// Limit lowers the number of exported entries below the configured maximum
+	Limit int64 `json:"limit"`
+}
+
+// entriesWriter writes exported log entries
+type entriesWriter interface {
+	// write writes a page of log entries
+	write(entries []*loggingpb.LogEntry) error
+	// writeError reports an error that cut the export short
+	writeError(message string) error
+	// close writes anything buffered
+	close() error
+}
+
+// handleExport streams the log entries of a query, without the limits of data frames, as
+// NDJSON or CSV. Entries are written as each page is fetched, up to the configured maximum
+func (d *CloudLoggingDatasource) handleExport(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	q := req.Query
+	parent, err := parentName(q.ParentType, q.ParentID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: query.parentType or query.parentId")
+		return
+	}
+	if q.ProjectID == "" && parent == "" {
+		writeError(w, http.StatusBadRequest, "Missing required parameter: query.projectId")
+		return
+	}
+	if parent != "" && q.LogScope != "" {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: query.logScope is only available for projects")
+		return
+	}
+	if q.ViewId != "" && q.BucketId == "" {
+		writeError(w, http.StatusBadRequest, "Missing required parameter: query.bucketId")
+		return
+	}
+	if req.Format == "" {
+		req.Format = ndjsonExportFormat
+	}
+	if req.Format != ndjsonExportFormat && req.Format != csvExportFormat {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: format")
+		return
+	}
+	if req.Limit < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: limit")
+		return
+	}
+	from, err := time.Parse(time.RFC3339, req.From)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: from")
+		return
+	}
+	to, err := time.Parse(time.RFC3339, req.To)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: to")
+		return
+	}
+	switch {
+	case q.LogScope != "":
+		err = d.checkLogScope(r.Context(), client, q.ProjectID, q.LogScope)
+	case parent != "":
+		err = d.allowlist.checkParentView(parent, q.BucketId, q.ViewId)
+	default:
+		err = d.allowlist.checkView(q.ProjectID, q.BucketId, q.ViewId)
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	filter := q.QueryText
+	if filter == "" {
+		filter = q.Query
+	}
+	limit := d.maxExportEntries
+	if limit == 0 {
+		limit = defaultMaxExportEntries
+	}
+	if req.Limit > 0 {
+		limit = min(limit, req.Limit)
+	}
+	query := &cloudlogging.Query{
+		ProjectID: q.ProjectID,
+		BucketId:  q.BucketId,
+		ViewId:    q.ViewId,
+		LogScope:  q.LogScope,
+		Parent:    parent,
+		Filter:    filter,
+		Limit:     limit,
+	}
+	query.TimeRange.From = from.UTC().Format(time.RFC3339)
+	query.TimeRange.To = to.UTC().Format(time.RFC3339)
+
+	var writer entriesWriter
+	contentType := "application/x-ndjson"
+	if req.Format == csvExportFormat {
+		writer = newCSVWriter(w, d.redactor)
+		contentType = "text/csv; charset=utf-8"
+	} else {
+		writer = &ndjsonWriter{w: w, redactor: d.redactor}
+	}
+	flusher, _ := w.(http.Flusher)
+	// Files are named after the project, or the folder, organization or billing account, such as organizations-123
+	name := q.ProjectID
+	if parent != "" {
+		name = strings.ReplaceAll(parent, "/", "-")
+	}
+
+	// The status is sent with the first page, so that errors listing it are still reported
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="logs-%s-%s.%s"`,
+			name, from.UTC().Format("20060102T150405Z"), req.Format))
+		w.WriteHeader(http.StatusOK)
+	}
+	exported := 0
+	err = client.StreamLogs(r.Context(), query, func(entries []*loggingpb.LogEntry) error {
+		start()
+		if err := writer.write(entries); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		exported += len(entries)
+		return nil
+	})
+	if err != nil && !started {
+		log.DefaultLogger.Warn("problem exporting logs", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	start()
+	if err != nil {
+		// The entries already sent cannot be taken back, so the export ends with the error
+		log.DefaultLogger.Warn("problem exporting logs", "error", err, "exported", exported)
+		if err := writer.writeError(sanitizeErrorMessage(err)); err != nil {
+			return
+		}
+	}
+	if err := writer.close(); err != nil {
+		log.DefaultLogger.Warn("problem exporting logs", "error", err)
+	}
+}
+
+// ndjsonWriter writes log entries as JSON, one per line, with their strings and keys redacted
+type ndjsonWriter struct {
+	w        io.Writer
+	redactor *redactor
+}
+
+func (n *ndjsonWriter) write(entries []*loggingpb.LogEntry) error {
+	for _, entry := range entries {
+		line, err := protojson.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if n.redactor != nil {
+			var value any
+			if err := json.Unmarshal(line, &value); err != nil {
+				return err
+			}
+			if line, err = json.Marshal(redactValue(n.redactor, value)); err != nil {
+				return err
+			}
+		}
+		if _, err := n.w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ndjsonWriter) writeError(message string) error {
+	line, err := json.Marshal(map[string]string{"error": message})
+	if err != nil {
+		return err
+	}
+	_, err = n.w.Write(append(line, '\n'))
+	return err
+}
+
+func (n *ndjsonWriter) close() error {
+	return nil
+}
+
+// redactValue redacts the strings and object keys of a decoded JSON value
+func redactValue(redactor *redactor, value any) any {
+	switch v := value.(type) {
+	case string:
+		redacted, _ := redactor.redact(v)
+		return redacted
+	case map[string]any:
+		redactMap(redactor, v, func(item any) (any, int) {
+			return redactValue(redactor, item), 0
+		})
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(redactor, item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// csvWriter writes log entries as CSV rows of their time, message and labels, as flattened by
+// GetLogLabels. As the entries are streamed, the label columns are those of the first page of
+// entries, and the labels only found in later pages are written as JSON in a last column
+type csvWriter struct {
+	w        *csv.Writer
+	redactor *redactor
+	// labels are the label columns, set once the header is written
+	labels []string
+	// columns are the indexes of the label columns
+	columns map[string]int
+}
+
+// csvFixedColumns are the columns written before the labels
+var csvFixedColumns = []string{"timestamp", "message"}
+
+// csvOtherLabelsColumn is the last column, with the labels which have no column of their own
+const csvOtherLabelsColumn = "otherLabels"
+
+func newCSVWriter(w io.Writer, redactor *redactor) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w), redactor: redactor}
+}
+
+func (c *csvWriter) writeHeader(entries []*loggingpb.LogEntry) error {
+	c.columns = map[string]int{}
+	for _, entry := range entries {
+		// The columns are named after the redacted labels, as written in the rows
+		labels := cloudlogging.GetLogLabels(entry)
+		c.redactor.redactLabels(labels)
+		for k := range labels {
+			if _, ok := c.columns[k]; !ok {
+				c.columns[k] = 0
+				c.labels = append(c.labels, k)
+			}
+		}
+	}
+	sort.Strings(c.labels)
+	for i, k := range c.labels {
+		c.columns[k] = i
+	}
+
+	header := append(append(append([]string{}, csvFixedColumns...), c.labels...), csvOtherLabelsColumn)
+	return c.w.Write(header)
+}
+
+func (c *csvWriter) write(entries []*loggingpb.LogEntry) error {
+	if c.columns == nil {
+		if err := c.writeHeader(entries); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		message, err := cloudlogging.GetLogEntryMessage(entry)
+		if err != nil {
+			// Entries without a payload are still exported, with their labels
+			log.DefaultLogger.Debug("failed getting log message", "warning", err)
+		}
+		message, _ = c.redactor.redact(message)
+		labels := cloudlogging.GetLogLabels(entry)
+		c.redactor.redactLabels(labels)
+
+		row := make([]string, len(csvFixedColumns)+len(c.labels)+1)
+		row[0] = entry.GetTimestamp().AsTime().UTC().Format(time.RFC3339Nano)
+		row[1] = message
+		others := map[string]string{}
+		for k, v := range labels {
+			if i, ok := c.columns[k]; ok {
+				row[len(csvFixedColumns)+i] = v
+			} else {
+				others[k] = v
+			}
+		}
+		if len(others) > 0 {
+			encoded, err := json.Marshal(others)
+			if err != nil {
+				return err
+			}
+			row[len(row)-1] = string(encoded)
+		}
+		if err := c.w.Write(row); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) writeError(message string) error {
+	if c.columns == nil {
+		if err := c.writeHeader(nil); err != nil {
+			return err
+		}
+	}
+	row := make([]string, len(csvFixedColumns)+len(c.labels)+1)
+	row[1] = "error: " + message
+	if err := c.w.Write(row); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) close() error {
+	// Exports without entries still have a header
+	if c.columns == nil {
+		if err := c.writeHeader(nil); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+)
+
+const (
+	// defaultFieldValuesSampleSize is the number of log entries sampled for field values by default
+	defaultFieldValuesSampleSize = 200
+	// maxFieldValuesSampleSize caps the number of log entries sampled for field values
+	maxFieldValuesSampleSize = 1000
+	// defaultFieldValuesLimit is the number of field values returned by default
+	defaultFieldValuesLimit = 20
+	// maxFieldValuesLimit caps the number of field values returned
+	maxFieldValuesLimit = 100
+	// defaultFieldValuesWindow is how far back log entries are sampled without a time range
+	defaultFieldValuesWindow = time.Hour
+	// fieldValuesCacheTTL is how long sampled field values are reused
+	fieldValuesCacheTTL = time.Minute
+	// maxFieldValuesCacheEntries is the number of samples kept per data source
+	maxFieldValuesCacheEntries = 100
+)
+
+// fieldValue is a distinct value of a field in the sampled log entries
+type fieldValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// fieldValuesRequest is a request for the values of a field in the log entries matching a filter
+type fieldValuesRequest struct {
+	query      cloudlogging.Query
+	field      string
+	credential string
+}
+
+// cacheKey identifies the request, including the credentials of OAuth passthrough users
+// so that users never see values sampled with the credentials of another user
+func (r fieldValuesRequest) cacheKey() string {
+	return strings.Join([]string{
+		r.credential, r.query.ProjectID, r.query.BucketId, r.query.ViewId, r.query.Filter,
+		r.query.TimeRange.From, r.query.TimeRange.To, fmt.Sprint(r.query.Limit), r.field,
+	}, "\x00")
+}
+
+// labelKey returns the key of the field in the labels of a log entry. User labels are
+// quoted in the labels, and can be given with or without quotes
+func labelKey(field string) string {
+	if key, ok := strings.CutPrefix(field, "labels."); ok && !strings.HasPrefix(key, `"`) {
+		return fmt.Sprintf("labels.%q", key)
+	}
+	if field == "severity" {
+		return "level"
+	}
+	return field
+}
+
+// countFieldValues counts the values of the field in the entries, after redaction, and returns
+// them the most frequent first
+func countFieldValues(entries []*loggingpb.LogEntry, field string, redactor *redactor) []fieldValue {
+	key := labelKey(field)
+	counts := map[string]int{}
+	for _, entry := range entries {
+		value, ok := cloudlogging.GetLogLabels(entry)[key]
+		if !ok || value == "" {
+			continue
+		}
+		value, _ = redactor.redact(value)
+		counts[value]++
+	}
+
+	values := make([]fieldValue, 0, len(counts))
+	for value, count := range counts {
+		values = append(values, fieldValue{Value: value, Count: count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	return values
+}
+
+// newFieldValuesCache returns a cache of sampled field values, as the query editor asks for
+// them again on every keystroke
+func newFieldValuesCache() *ttlCache[[]fieldValue] {
+	return newTTLCache[[]fieldValue](fieldValuesCacheTTL, maxFieldValuesCacheEntries)
+}
@@ -0,0 +1,183 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// parentCollections are the resources that sinks, exclusions, log buckets and logs can belong to
+var parentCollections = []string{"projects", "folders", "organizations", "billingAccounts"}
+
+// parentTypeCollections are the collections of the parent types of queries other than projects
+var parentTypeCollections = map[string]string{
+	"folder":         "folders",
+	"organization":   "organizations",
+	"billingAccount": "billingAccounts",
+}
+
+// validateParent checks that parent is a project, folder, organization or billing account, such as folders/123
+func validateParent(parent string) error {
+	collection, id, ok := strings.Cut(parent, "/")
+	if ok && id != "" && !strings.Contains(id, "/") {
+		for _, c := range parentCollections {
+			if collection == c {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid parent %q: it must be projects/ID, folders/ID, organizations/ID or billingAccounts/ID", parent)
+}
+
+// parentName returns the resource name of a folder, organization or billing account, such as
+// organizations/123, or "" for the project parent type, the default
+func parentName(parentType, parentID string) (string, error) {
+	if parentType == "" || parentType == "project" {
+		return "", nil
+	}
+	collection, ok := parentTypeCollections[parentType]
+	if !ok {
+		return "", fmt.Errorf("invalid parent type %q: it must be project, folder, organization or billingAccount", parentType)
+	}
+	if parentID == "" {
+		return "", fmt.Errorf("missing %s ID", parentType)
+	}
+	parent := collection + "/" + parentID
+	if err := validateParent(parent); err != nil {
+		return "", err
+	}
+	return parent, nil
+}
+
+// logParent returns the project, folder, organization or billing account whose logs a query
+// reads, such as projects/my-project
+func (q queryModel) logParent() (string, error) {
+	parent, err := parentName(q.ParentType, q.ParentID)
+	if err != nil || parent != "" {
+		return parent, err
+	}
+	return "projects/" + q.ProjectID, nil
+}
+
+// inventoryQuery lists the sinks or exclusions of the parent of the query, or of the parent
+// of its logs
+func (d *CloudLoggingDatasource) inventoryQuery(ctx context.Context, queryType string, q queryModel, client cloudlogging.API) backend.DataResponse {
+	parent := q.Parent
+	if parent == "" {
+		var err error
+		if parent, err = q.logParent(); err != nil {
+			return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+		}
+	}
+	if err := validateParent(parent); err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	if err := d.allowlist.checkParent(parent); err != nil {
+		return allowlistErrorResponse(err)
+	}
+
+	var frame *data.Frame
+	switch queryType {
+	case sinksQueryType:
+		sinks, err := client.ListSinks(ctx, parent)
+		if err != nil {
+			return backend.ErrDataResponse(backend.StatusBadGateway, fmt.Sprintf("list sinks: %s", sanitizeErrorMessage(err)))
+		}
+		frame = sinksFrame(sinks)
+	default:
+		exclusions, err := client.ListExclusions(ctx, parent)
+		if err != nil {
+			return backend.ErrDataResponse(backend.StatusBadGateway, fmt.Sprintf("list exclusions: %s", sanitizeErrorMessage(err)))
+		}
+		frame = exclusionsFrame(exclusions)
+	}
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTable}
+	return backend.DataResponse{Frames: data.Frames{frame}}
+}
+
+// sinksFrame returns the sinks as a table. The exclusions of each sink are listed one per
+// line as name: filter
+func sinksFrame(sinks []cloudlogging.Sink) *data.Frame {
+	frame := data.NewFrame("sinks",
+		data.NewField("name", nil, []string{}),
+		data.NewField("destination", nil, []string{}),
+		data.NewField("filter", nil, []string{}),
+		data.NewField("exclusions", nil, []string{}),
+		data.NewField("writerIdentity", nil, []string{}),
+		data.NewField("includeChildren", nil, []bool{}),
+		data.NewField("disabled", nil, []bool{}),
+		data.NewField("description", nil, []string{}),
+	)
+	for _, sink := range sinks {
+		exclusions := make([]string, 0, len(sink.Exclusions))
+		for _, e := range sink.Exclusions {
+			exclusions = append(exclusions, fmt.Sprintf("%s: %s", e.Name, e.Filter))
+		}
+		frame.AppendRow(sink.Name, sink.Destination, sink.Filter, strings.Join(exclusions, "\n"),
+			sink.WriterIdentity, sink.IncludeChildren, sink.Disabled, sink.Description)
+	}
+	return frame
+}
+
+// exclusionsFrame returns the exclusions as a table
+func exclusionsFrame(exclusions []cloudlogging.Exclusion) *data.Frame {
+	frame := data.NewFrame("exclusions",
+		data.NewField("name", nil, []string{}),
+		data.NewField("filter", nil, []string{}),
+		data.NewField("disabled", nil, []bool{}),
+		data.NewField("description", nil, []string{}),
+	)
+	for _, e := range exclusions {
+		frame.AppendRow(e.Name, e.Filter, e.Disabled, e.Description)
+	}
+	return frame
+}
+
+// logBucketsQuery lists the log buckets of the project, folder, organization or billing
+// account of the query
+func (d *CloudLoggingDatasource) logBucketsQuery(ctx context.Context, q queryModel, client cloudlogging.API) backend.DataResponse {
+	parent, err := q.logParent()
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	if err := d.allowlist.checkParent(parent); err != nil {
+		return allowlistErrorResponse(err)
+	}
+	buckets, err := client.ListBuckets(ctx, parent)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadGateway, fmt.Sprintf("list log buckets: %s", sanitizeErrorMessage(err)))
+	}
+
+	frame := data.NewFrame("logBuckets",
+		data.NewField("id", nil, []string{}),
+		data.NewField("retentionDays", nil, []int32{}),
+		data.NewField("lifecycleState", nil, []string{}),
+		data.NewField("locked", nil, []bool{}),
+		data.NewField("analyticsEnabled", nil, []bool{}),
+		data.NewField("kmsKeyName", nil, []string{}),
+		data.NewField("description", nil, []string{}),
+	)
+	for _, b := range d.allowlist.filterBuckets(parent, buckets) {
+		frame.AppendRow(b.ID, b.RetentionDays, b.LifecycleState, b.Locked, b.AnalyticsEnabled, b.KmsKeyName, b.Description)
+	}
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTable}
+	return backend.DataResponse{Frames: data.Frames{frame}}
+}
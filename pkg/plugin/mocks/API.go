@@ -68,16 +68,76 @@ func (_m *API) ListLogs(_a0 context.Context, _a1 *cloudlogging.Query) ([]*loggin
 	return r0, r1
 }
 
+// StreamLogs provides a mock function with given fields: ctx, q, fn
+func (_m *API) StreamLogs(ctx context.Context, q *cloudlogging.Query, fn func([]*logging.LogEntry) error) error {
+	ret := _m.Called(ctx, q, fn)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, *cloudlogging.Query, func([]*logging.LogEntry) error) error); ok {
+		r0 = rf(ctx, q, fn)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ListErrorGroups provides a mock function with given fields: ctx, q, insertIDs
+func (_m *API) ListErrorGroups(ctx context.Context, q *cloudlogging.Query, insertIDs []string) (map[string][]string, error) {
+	ret := _m.Called(ctx, q, insertIDs)
+
+	var r0 map[string][]string
+	if rf, ok := ret.Get(0).(func(context.Context, *cloudlogging.Query, []string) map[string][]string); ok {
+		r0 = rf(ctx, q, insertIDs)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string][]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *cloudlogging.Query, []string) error); ok {
+		r1 = rf(ctx, q, insertIDs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListLogScopes provides a mock function with given fields: ctx, projectID
+func (_m *API) ListLogScopes(ctx context.Context, projectID string) ([]cloudlogging.LogScope, error) {
+	ret := _m.Called(ctx, projectID)
+
+	var r0 []cloudlogging.LogScope
+	if rf, ok := ret.Get(0).(func(context.Context, string) []cloudlogging.LogScope); ok {
+		r0 = rf(ctx, projectID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.LogScope)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, projectID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ListProjects provides a mock function with given fields: _a0
-func (_m *API) ListProjects(_a0 context.Context) ([]string, error) {
+func (_m *API) ListProjects(_a0 context.Context) ([]cloudlogging.Project, error) {
 	ret := _m.Called(_a0)
 
-	var r0 []string
-	if rf, ok := ret.Get(0).(func(context.Context) []string); ok {
+	var r0 []cloudlogging.Project
+	if rf, ok := ret.Get(0).(func(context.Context) []cloudlogging.Project); ok {
 		r0 = rf(_a0)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]string)
+			r0 = ret.Get(0).([]cloudlogging.Project)
 		}
 	}
 
@@ -91,16 +151,62 @@ func (_m *API) ListProjects(_a0 context.Context) ([]string, error) {
 	return r0, r1
 }
 
-// ListProjectBuckets provides a mock function with given fields: ctx, projectID
-func (_m *API) ListProjectBuckets(ctx context.Context, projectID string) ([]string, error) {
-	ret := _m.Called(ctx, projectID)
+// QueryAnalytics provides a mock function with given fields: ctx, view, sql, maxRows
+func (_m *API) QueryAnalytics(ctx context.Context, view string, sql string, maxRows int) (*cloudlogging.AnalyticsResult, error) {
+	ret := _m.Called(ctx, view, sql, maxRows)
 
-	var r0 []string
-	if rf, ok := ret.Get(0).(func(context.Context) []string); ok {
+	var r0 *cloudlogging.AnalyticsResult
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int) *cloudlogging.AnalyticsResult); ok {
+		r0 = rf(ctx, view, sql, maxRows)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*cloudlogging.AnalyticsResult)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, int) error); ok {
+		r1 = rf(ctx, view, sql, maxRows)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListFolders provides a mock function with given fields: ctx, parent
+func (_m *API) ListFolders(ctx context.Context, parent string) ([]cloudlogging.Folder, error) {
+	ret := _m.Called(ctx, parent)
+
+	var r0 []cloudlogging.Folder
+	if rf, ok := ret.Get(0).(func(context.Context, string) []cloudlogging.Folder); ok {
+		r0 = rf(ctx, parent)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.Folder)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, parent)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListOrganizations provides a mock function with given fields: ctx
+func (_m *API) ListOrganizations(ctx context.Context) ([]cloudlogging.Organization, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []cloudlogging.Organization
+	if rf, ok := ret.Get(0).(func(context.Context) []cloudlogging.Organization); ok {
 		r0 = rf(ctx)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]string)
+			r0 = ret.Get(0).([]cloudlogging.Organization)
 		}
 	}
 
@@ -114,19 +220,111 @@ func (_m *API) ListProjectBuckets(ctx context.Context, projectID string) ([]stri
 	return r0, r1
 }
 
-// ListProjectBucketViews provides a mock function with given fields: ctx, bucketID
-func (_m *API) ListProjectBucketViews(ctx context.Context, projectId string, bucketID string) ([]string, error) {
-	ret := _m.Called(ctx, projectId, bucketID)
+// ListBuckets provides a mock function with given fields: ctx, parent
+func (_m *API) ListBuckets(ctx context.Context, parent string) ([]cloudlogging.LogBucket, error) {
+	ret := _m.Called(ctx, parent)
 
-	var r0 []string
-	if rf, ok := ret.Get(0).(func(context.Context) []string); ok {
+	var r0 []cloudlogging.LogBucket
+	if rf, ok := ret.Get(0).(func(context.Context) []cloudlogging.LogBucket); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.LogBucket)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListBucketViews provides a mock function with given fields: ctx, parent, bucketID
+func (_m *API) ListBucketViews(ctx context.Context, parent string, bucketID string) ([]cloudlogging.LogView, error) {
+	ret := _m.Called(ctx, parent, bucketID)
+
+	var r0 []cloudlogging.LogView
+	if rf, ok := ret.Get(0).(func(context.Context) []cloudlogging.LogView); ok {
 		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.LogView)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListExclusions provides a mock function with given fields: ctx, parent
+func (_m *API) ListExclusions(ctx context.Context, parent string) ([]cloudlogging.Exclusion, error) {
+	ret := _m.Called(ctx, parent)
+
+	var r0 []cloudlogging.Exclusion
+	if rf, ok := ret.Get(0).(func(context.Context, string) []cloudlogging.Exclusion); ok {
+		r0 = rf(ctx, parent)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.Exclusion)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, parent)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListLogNames provides a mock function with given fields: ctx, projectID, bucketID, viewID
+func (_m *API) ListLogNames(ctx context.Context, projectID string, bucketID string, viewID string) ([]string, error) {
+	ret := _m.Called(ctx, projectID, bucketID, viewID)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, string) []string); ok {
+		r0 = rf(ctx, projectID, bucketID, viewID)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]string)
 		}
 	}
 
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, string) error); ok {
+		r1 = rf(ctx, projectID, bucketID, viewID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListMonitoredResourceDescriptors provides a mock function with given fields: ctx
+func (_m *API) ListMonitoredResourceDescriptors(ctx context.Context) ([]cloudlogging.MonitoredResourceDescriptor, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []cloudlogging.MonitoredResourceDescriptor
+	if rf, ok := ret.Get(0).(func(context.Context) []cloudlogging.MonitoredResourceDescriptor); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.MonitoredResourceDescriptor)
+		}
+	}
+
 	var r1 error
 	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
 		r1 = rf(ctx)
@@ -137,13 +335,96 @@ func (_m *API) ListProjectBucketViews(ctx context.Context, projectId string, buc
 	return r0, r1
 }
 
-// TestConnection provides a mock function with given fields: ctx, projectID
-func (_m *API) TestConnection(ctx context.Context, projectID string) error {
+// ListRecentQueries provides a mock function with given fields: ctx, projectID
+func (_m *API) ListRecentQueries(ctx context.Context, projectID string) ([]cloudlogging.RecentQuery, error) {
+	ret := _m.Called(ctx, projectID)
+
+	var r0 []cloudlogging.RecentQuery
+	if rf, ok := ret.Get(0).(func(context.Context, string) []cloudlogging.RecentQuery); ok {
+		r0 = rf(ctx, projectID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.RecentQuery)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, projectID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListSavedQueries provides a mock function with given fields: ctx, projectID
+func (_m *API) ListSavedQueries(ctx context.Context, projectID string) ([]cloudlogging.SavedQuery, error) {
 	ret := _m.Called(ctx, projectID)
 
+	var r0 []cloudlogging.SavedQuery
+	if rf, ok := ret.Get(0).(func(context.Context, string) []cloudlogging.SavedQuery); ok {
+		r0 = rf(ctx, projectID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.SavedQuery)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, projectID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListSinks provides a mock function with given fields: ctx, parent
+func (_m *API) ListSinks(ctx context.Context, parent string) ([]cloudlogging.Sink, error) {
+	ret := _m.Called(ctx, parent)
+
+	var r0 []cloudlogging.Sink
+	if rf, ok := ret.Get(0).(func(context.Context, string) []cloudlogging.Sink); ok {
+		r0 = rf(ctx, parent)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cloudlogging.Sink)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, parent)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// TestConnection provides a mock function with given fields: ctx, parent
+func (_m *API) TestConnection(ctx context.Context, parent string) error {
+	ret := _m.Called(ctx, parent)
+
 	var r0 error
 	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
-		r0 = rf(ctx, projectID)
+		r0 = rf(ctx, parent)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// TestProxy provides a mock function with given fields: ctx
+func (_m *API) TestProxy(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
 	} else {
 		r0 = ret.Error(0)
 	}
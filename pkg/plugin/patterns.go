@@ -0,0 +1,120 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// maxSparklineBuckets is the maximum number of intervals in the sparkline of a pattern
+const maxSparklineBuckets = 100
+
+// logPattern is a group of log messages sharing the same pattern
+type logPattern struct {
+	pattern string
+	count   int64
+	sample  string
+	series  []int64
+}
+
+// patternsFrame clusters the messages of the logs into patterns, and returns them as a table
+// of pattern, count, most recent sample and the count per interval of the time range
+func patternsFrame(logs []*loggingpb.LogEntry, timeRange backend.TimeRange, interval time.Duration, redactor *redactor) (*data.Frame, error) {
+	span := timeRange.To.Sub(timeRange.From)
+	if interval <= 0 || span/interval > maxSparklineBuckets {
+		interval = span / maxSparklineBuckets
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	buckets := int(span/interval) + 1
+
+	patterns := map[string]*logPattern{}
+	redactions := 0
+	for _, entry := range logs {
+		message, err := cloudlogging.GetLogEntryMessage(entry)
+		if err != nil {
+			log.DefaultLogger.Warn("failed getting log message", "warning", err)
+			continue
+		}
+		message, n := redactor.redact(message)
+		redactions += n
+
+		key := cloudlogging.GetLogPattern(message)
+		p, ok := patterns[key]
+		if !ok {
+			// Logs are ordered by timestamp descending, so the first one seen is the most recent
+			p = &logPattern{pattern: key, sample: message, series: make([]int64, buckets)}
+			patterns[key] = p
+		}
+		p.count++
+		if bucket := int(entry.GetTimestamp().AsTime().Sub(timeRange.From) / interval); bucket >= 0 && bucket < buckets {
+			p.series[bucket]++
+		}
+	}
+
+	sorted := make([]*logPattern, 0, len(patterns))
+	for _, p := range patterns {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].pattern < sorted[j].pattern
+	})
+
+	patternValues := make([]string, 0, len(sorted))
+	counts := make([]int64, 0, len(sorted))
+	samples := make([]string, 0, len(sorted))
+	sparklines := make([]json.RawMessage, 0, len(sorted))
+	for _, p := range sorted {
+		series, err := json.Marshal(p.series)
+		if err != nil {
+			return nil, err
+		}
+		patternValues = append(patternValues, p.pattern)
+		counts = append(counts, p.count)
+		samples = append(samples, p.sample)
+		sparklines = append(sparklines, series)
+	}
+
+	frame := data.NewFrame("patterns",
+		data.NewField("pattern", nil, patternValues),
+		data.NewField("count", nil, counts),
+		data.NewField("sample", nil, samples),
+		data.NewField("sparkline", nil, sparklines),
+	)
+	custom := map[string]any{
+		"sparklineFrom":     timeRange.From.UnixMilli(),
+		"sparklineInterval": interval.Milliseconds(),
+	}
+	if redactor != nil {
+		custom["redactions"] = redactions
+	}
+	frame.Meta = &data.FrameMeta{
+		PreferredVisualization: data.VisTypeTable,
+		Custom:                 custom,
+	}
+	return frame, nil
+}
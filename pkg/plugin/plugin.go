@@ -19,12 +19,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"cloud.google.com/go/logging/apiv2/loggingpb"
 	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
 	"github.com/grafana/grafana-google-sdk-go/pkg/utils"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -35,11 +41,20 @@ import (
 
 // Make sure CloudLoggingDatasource implements required interfaces
 var (
-	_                     backend.QueryDataHandler      = (*CloudLoggingDatasource)(nil)
-	_                     backend.CheckHealthHandler    = (*CloudLoggingDatasource)(nil)
-	_                     instancemgmt.InstanceDisposer = (*CloudLoggingDatasource)(nil)
-	errMissingCredentials                               = errors.New("missing credentials")
-	errMissingAccessToken                               = errors.New("missing access token")
+	_                            backend.QueryDataHandler      = (*CloudLoggingDatasource)(nil)
+	_                            backend.CheckHealthHandler    = (*CloudLoggingDatasource)(nil)
+	_                            instancemgmt.InstanceDisposer = (*CloudLoggingDatasource)(nil)
+	errMissingCredentials                                      = errors.New("missing credentials")
+	errMissingAccessToken                                      = errors.New("missing access token")
+	errMissingExternalAccount                                  = errors.New("missing external account audience or subject token type")
+	errInvalidCredentialSource                                 = errors.New("exactly one external account credential source (file, url or executable) is required")
+	errTokenFileDisabled                                       = errors.New("access token files are disabled: set access_token_file_dir to the directory of the files in the [plugin.googlecloud-logging-datasource] section of the Grafana configuration to enable them")
+	errCredentialURLDisabled                                   = errors.New("external account url credential sources are disabled: set allow_external_account_url = true in the [plugin.googlecloud-logging-datasource] section of the Grafana configuration to enable them")
+	errMissingAccessTokenFile                                  = errors.New("missing access token file")
+	errMissingAccessTokenCommand                               = errors.New("missing access token command")
+	errTokenCommandDisabled                                    = errors.New("access token commands are disabled: set allow_access_token_command = true in the [plugin.googlecloud-logging-datasource] section of the Grafana configuration to enable them")
+	errPlaintextWithoutEndpoint                                = errors.New("plaintext connections require a custom logging endpoint")
+	errInvalidProxyURL                                         = errors.New("invalid proxy URL: an http or https URL with a host is required")
 )
 
 const (
@@ -48,19 +63,317 @@ const (
 	jwtAuthentication              = "jwt"
 	accessTokenAuthentication      = "accessToken"
 	accessTokenKey                 = "accessToken"
+	proxyPasswordKey               = "proxyPassword"
 	oauthpassthroughAuthentication = "oauthPassthrough"
+	externalAccountAuthentication  = "externalAccount"
+	accessTokenSourceStatic        = "static"
+	accessTokenSourceFile          = "file"
+	accessTokenSourceCommand       = "command"
+	patternsQueryType              = "patterns"
+	sinksQueryType                 = "sinks"
+	exclusionsQueryType            = "exclusions"
+	logBucketsQueryType            = "logBuckets"
+	sqlQueryType                   = "sql"
+	// defaultRateLimitQueueTimeout is how long a rate limited request waits for its turn by default
+	defaultRateLimitQueueTimeout = 10 * time.Second
+	// maxSplitFetches is the number of incomplete split log entries whose missing pieces are fetched per query
+	maxSplitFetches = 20
+	// maxSplitPieces is the number of pieces fetched for each incomplete split log entry
+	maxSplitPieces = 100
+	// splitPieceMargin is how far before the first and after the last known piece of the
+	// incomplete split log entries their missing pieces are searched for
+	splitPieceMargin = time.Minute
+	// accessTokenFileDirEnv is the only directory access token files are read from. Grafana
+	// sets it from the access_token_file_dir setting of the plugin section of its configuration
+	accessTokenFileDirEnv = "GF_PLUGIN_ACCESS_TOKEN_FILE_DIR"
+	// allowExternalAccountURLEnv enables the url credential sources of external accounts, which
+	// are fetched from the Grafana host. Grafana sets it from the allow_external_account_url setting
+	allowExternalAccountURLEnv = "GF_PLUGIN_ALLOW_EXTERNAL_ACCOUNT_URL"
+	// externalAccountHostsEnv is a comma separated list of the hosts, other than the STS and IAM
+	// credentials hosts of the universe domain, that external accounts may send tokens to.
+	// Grafana sets it from the external_account_hosts setting
+	externalAccountHostsEnv = "GF_PLUGIN_EXTERNAL_ACCOUNT_HOSTS"
+	// defaultUniverseDomain is the universe domain of the Google Cloud APIs if none is configured
+	defaultUniverseDomain = "googleapis.com"
+	// allowAccessTokenCommandEnv enables access token commands. Grafana sets it from the
+	// allow_access_token_command setting of the plugin section of its configuration, which data
+	// source editors cannot change
+	allowAccessTokenCommandEnv = "GF_PLUGIN_ALLOW_ACCESS_TOKEN_COMMAND"
 )
 
+// checkAccessTokenFile returns an error unless the access token file is in the directory
+// set by the Grafana administrators. Symbolic links are followed, so that they cannot lead
+// out of the directory
+func checkAccessTokenFile(file string) error {
+	dir := os.Getenv(accessTokenFileDirEnv)
+	if dir == "" {
+		return errTokenFileDisabled
+	}
+	dir, err := resolvePath(dir)
+	if err != nil {
+		return fmt.Errorf("access token file directory: %w", err)
+	}
+	path, err := resolvePath(file)
+	if err != nil {
+		return fmt.Errorf("access token file: %w", err)
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("access token file %q is outside of the access token file directory %s", file, dir)
+	}
+	return nil
+}
+
+// checkExternalAccountURL returns an error unless the token or impersonation URL of an
+// external account is an https URL of the default host of the universe domain, such as
+// sts.googleapis.com, or of a host allowed by the Grafana administrators. The subject token
+// and the exchanged tokens are sent to these URLs
+func checkExternalAccountURL(name, rawURL, defaultHost string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid external account %s: an https URL is required", name)
+	}
+	host := strings.ToLower(u.Host)
+	if host == defaultHost || host == defaultHost+":443" {
+		return nil
+	}
+	for _, allowed := range strings.Split(os.Getenv(externalAccountHostsEnv), ",") {
+		if allowed = strings.ToLower(strings.TrimSpace(allowed)); allowed != "" && host == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("external account %s host %s is not allowed: only %s, or the hosts set in external_account_hosts in the [plugin.googlecloud-logging-datasource] section of the Grafana configuration, are", name, u.Host, defaultHost)
+}
+
+// resolvePath returns the absolute path of a file, following symbolic links if it exists
+func resolvePath(file string) (string, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return path, nil
+	}
+	return resolved, err
+}
+
 // config is the fields parsed from the front end
 type config struct {
-	AuthType                    string `json:"authenticationType"`
-	ClientEmail                 string `json:"clientEmail"`
-	DefaultProject              string `json:"defaultProject"`
-	TokenURI                    string `json:"tokenUri"`
-	ServiceAccountToImpersonate string `json:"serviceAccountToImpersonate"`
-	UsingImpersonation          bool   `json:"usingImpersonation"`
-	OAuthPassThru               bool   `json:"oauthPassThru"`
-	UniverseDomain              string `json:"universeDomain"`
+	AuthType                    string          `json:"authenticationType"`
+	ClientEmail                 string          `json:"clientEmail"`
+	DefaultProject              string          `json:"defaultProject"`
+	TokenURI                    string          `json:"tokenUri"`
+	ServiceAccountToImpersonate string          `json:"serviceAccountToImpersonate"`
+	UsingImpersonation          bool            `json:"usingImpersonation"`
+	OAuthPassThru               bool            `json:"oauthPassThru"`
+	UniverseDomain              string          `json:"universeDomain"`
+	RedactionRules              []redactionRule `json:"redactionRules"`
+	ExternalAccount             externalAccount `json:"externalAccount"`
+	AccessTokenSource           string          `json:"accessTokenSource"`
+	AccessTokenFile             string          `json:"accessTokenFile"`
+	AccessTokenCommand          string          `json:"accessTokenCommand"`
+	Endpoints                   endpoints       `json:"endpoints"`
+	Proxy                       proxyConfig     `json:"proxy"`
+	ImpersonationDelegates      []string        `json:"impersonationDelegates"`
+	ImpersonationScopes         []string        `json:"impersonationScopes"`
+	// ImpersonationLifetime is the lifetime of the impersonated access tokens, such as 30m
+	ImpersonationLifetime string          `json:"impersonationLifetime"`
+	Allowlist             allowlistConfig `json:"allowlist"`
+	Retry                 retryConfig     `json:"retry"`
+	RateLimit             rateLimitConfig `json:"rateLimit"`
+	Export                exportConfig    `json:"export"`
+	// DefaultParentType and DefaultParentID are the folder, organization or billing account
+	// that the health check queries instead of the default project, such as organization and 123
+	DefaultParentType string `json:"defaultParentType"`
+	DefaultParentID   string `json:"defaultParentId"`
+}
+
+// rateLimitConfig limits the rate of log entry requests of the data source
+type rateLimitConfig struct {
+	// RequestsPerMinute is the average rate of requests. Zero disables rate limiting
+	RequestsPerMinute float64 `json:"requestsPerMinute"`
+	// Burst is the number of requests that can be sent at once, 1 by default
+	Burst int `json:"burst"`
+	// QueueTimeout is how long a request may wait for its turn, such as 10s
+	QueueTimeout string `json:"queueTimeout"`
+	// PerProject limits the requests to each project separately
+	PerProject bool `json:"perProject"`
+}
+
+// clientOptions returns the client option limiting the rate of requests, or nil if the rate is not limited
+func (r rateLimitConfig) clientOptions() ([]cloudlogging.ClientOption, error) {
+	if r.RequestsPerMinute == 0 {
+		return nil, nil
+	}
+
+	burst := r.Burst
+	if burst == 0 {
+		burst = 1
+	}
+	queueTimeout := defaultRateLimitQueueTimeout
+	if r.QueueTimeout != "" {
+		var err error
+		queueTimeout, err = time.ParseDuration(r.QueueTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit: invalid queue timeout %q", r.QueueTimeout)
+		}
+	}
+	limiter, err := cloudlogging.NewRateLimiter(r.RequestsPerMinute, burst, queueTimeout, r.PerProject)
+	if err != nil {
+		return nil, fmt.Errorf("rate limit: %w", err)
+	}
+	return []cloudlogging.ClientOption{cloudlogging.WithRateLimiter(limiter)}, nil
+}
+
+// retryConfig overrides the default retry policy. Durations are strings such as 500ms or 2m
+type retryConfig struct {
+	MaxAttempts    int    `json:"maxAttempts"`
+	InitialBackoff string `json:"initialBackoff"`
+	MaxBackoff     string `json:"maxBackoff"`
+	PageTimeout    string `json:"pageTimeout"`
+	TotalTimeout   string `json:"totalTimeout"`
+}
+
+// clientOptions returns the client option setting the retry policy, or nil if the default
+// policy is not overridden
+func (r retryConfig) clientOptions() ([]cloudlogging.ClientOption, error) {
+	if r == (retryConfig{}) {
+		return nil, nil
+	}
+
+	policy := cloudlogging.DefaultRetryPolicy()
+	if r.MaxAttempts != 0 {
+		policy.MaxAttempts = r.MaxAttempts
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"initialBackoff", r.InitialBackoff, &policy.InitialBackoff},
+		{"maxBackoff", r.MaxBackoff, &policy.MaxBackoff},
+		{"pageTimeout", r.PageTimeout, &policy.PageTimeout},
+		{"totalTimeout", r.TotalTimeout, &policy.TotalTimeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("retry policy: invalid %s %q", d.name, d.value)
+		}
+		*d.dest = duration
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("retry policy: %w", err)
+	}
+	return []cloudlogging.ClientOption{cloudlogging.WithRetryPolicy(policy)}, nil
+}
+
+// impersonation returns the impersonation settings, and whether they are invalid
+func (c *config) impersonation() (cloudlogging.Impersonation, error) {
+	impersonation := cloudlogging.Impersonation{
+		TargetPrincipal: c.ServiceAccountToImpersonate,
+		Delegates:       c.ImpersonationDelegates,
+		Scopes:          c.ImpersonationScopes,
+	}
+	if c.ImpersonationLifetime != "" {
+		lifetime, err := time.ParseDuration(c.ImpersonationLifetime)
+		if err != nil {
+			return impersonation, fmt.Errorf("invalid impersonation configuration: invalid token lifetime %q", c.ImpersonationLifetime)
+		}
+		impersonation.Lifetime = lifetime
+	}
+	if err := impersonation.Validate(); err != nil {
+		return impersonation, fmt.Errorf("invalid impersonation configuration: %w", err)
+	}
+	return impersonation, nil
+}
+
+// proxyConfig is the HTTP CONNECT proxy the clients connect through. The password is
+// stored in the secure JSON data
+type proxyConfig struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	// NoProxy is a comma separated list of hosts connected to directly
+	NoProxy string `json:"noProxy"`
+}
+
+// clientOptions returns the client options connecting through the HTTP proxy and the Grafana
+// secure socks proxy, if they are configured
+func (p proxyConfig) clientOptions(ctx context.Context, settings backend.DataSourceInstanceSettings) ([]cloudlogging.ClientOption, error) {
+	var opts []cloudlogging.ClientOption
+
+	if p.URL != "" {
+		proxyURL, err := url.Parse(p.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %s", sanitizeErrorMessage(err))
+		}
+		if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+			return nil, errInvalidProxyURL
+		}
+		opts = append(opts, cloudlogging.WithProxy(cloudlogging.Proxy{
+			URL:      proxyURL,
+			Username: p.Username,
+			Password: settings.DecryptedSecureJSONData[proxyPasswordKey],
+			NoProxy:  strings.Split(p.NoProxy, ","),
+		}))
+	}
+
+	proxyClient, err := settings.ProxyClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("secure socks proxy: %w", err)
+	}
+	if proxyClient.SecureSocksProxyEnabled() {
+		dialer, err := proxyClient.NewSecureSocksProxyContextDialer()
+		if err != nil {
+			return nil, fmt.Errorf("secure socks proxy: %w", err)
+		}
+		contextDialer, ok := dialer.(cloudlogging.ContextDialer)
+		if !ok {
+			return nil, errors.New("secure socks proxy: dialer does not support contexts")
+		}
+		opts = append(opts, cloudlogging.WithDialer(contextDialer))
+	}
+	return opts, nil
+}
+
+// endpoints are custom API endpoints, as host:port
+type endpoints struct {
+	Logging         string `json:"logging"`
+	Config          string `json:"config"`
+	ResourceManager string `json:"resourceManager"`
+	// LoggingREST is the endpoint of the Logging REST API, the logging endpoint by default. A
+	// plaintext emulator needs it, as it serves gRPC only on the logging endpoint
+	LoggingREST string `json:"loggingRest"`
+	// Plaintext connects without TLS nor authentication, to a local emulator
+	Plaintext bool `json:"plaintext"`
+}
+
+// externalAccount is the workload identity federation credential configuration
+type externalAccount struct {
+	Audience                       string                          `json:"audience"`
+	SubjectTokenType               string                          `json:"subjectTokenType"`
+	TokenURL                       string                          `json:"tokenUrl"`
+	ServiceAccountImpersonationURL string                          `json:"serviceAccountImpersonationUrl"`
+	CredentialSource               externalAccountCredentialSource `json:"credentialSource"`
+}
+
+// externalAccountCredentialSource is where the subject token exchanged for Google credentials comes from
+type externalAccountCredentialSource struct {
+	File       string            `json:"file"`
+	URL        string            `json:"url"`
+	Headers    map[string]string `json:"headers"`
+	Executable struct {
+		Command       string `json:"command"`
+		TimeoutMillis int    `json:"timeoutMillis"`
+		OutputFile    string `json:"outputFile"`
+	} `json:"executable"`
+	Format struct {
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subjectTokenFieldName"`
+	} `json:"format"`
 }
 
 // toServiceAccountJSON creates the serviceAccountJSON bytes from the config fields
@@ -75,6 +388,99 @@ func (c config) toServiceAccountJSON(privateKey string) ([]byte, error) {
 	})
 }
 
+// toExternalAccountJSON creates the external_account credential configuration bytes from the config fields
+func (c config) toExternalAccountJSON() ([]byte, error) {
+	ea := c.ExternalAccount
+	if ea.Audience == "" || ea.SubjectTokenType == "" {
+		return nil, errMissingExternalAccount
+	}
+
+	// The subject token and the tokens exchanged for it are only sent to the Google token
+	// endpoints, or to the endpoints the Grafana administrators allow
+	universeDomain := c.UniverseDomain
+	if universeDomain == "" {
+		universeDomain = defaultUniverseDomain
+	}
+	if ea.TokenURL != "" {
+		if err := checkExternalAccountURL("token URL", ea.TokenURL, "sts."+universeDomain); err != nil {
+			return nil, err
+		}
+	}
+	if ea.ServiceAccountImpersonationURL != "" {
+		if err := checkExternalAccountURL("service account impersonation URL", ea.ServiceAccountImpersonationURL, "iamcredentials."+universeDomain); err != nil {
+			return nil, err
+		}
+	}
+
+	source := map[string]any{}
+	sources := 0
+	if ea.CredentialSource.File != "" {
+		source["file"] = ea.CredentialSource.File
+		sources++
+	}
+	if ea.CredentialSource.URL != "" {
+		source["url"] = ea.CredentialSource.URL
+		if len(ea.CredentialSource.Headers) > 0 {
+			source["headers"] = ea.CredentialSource.Headers
+		}
+		sources++
+	}
+	if executable := ea.CredentialSource.Executable; executable.Command != "" {
+		e := map[string]any{"command": executable.Command}
+		if executable.TimeoutMillis != 0 {
+			e["timeout_millis"] = executable.TimeoutMillis
+		}
+		if executable.OutputFile != "" {
+			e["output_file"] = executable.OutputFile
+		}
+		source["executable"] = e
+		sources++
+	}
+	if sources != 1 {
+		return nil, errInvalidCredentialSource
+	}
+	// Files are read on the Grafana host, so only from the directory its administrators allow
+	if file := ea.CredentialSource.File; file != "" {
+		if err := checkAccessTokenFile(file); err != nil {
+			return nil, fmt.Errorf("external account credential source: %w", err)
+		}
+	}
+	// URLs are fetched from the Grafana host, which may reach its metadata server or internal
+	// services, so only its administrators may enable them
+	if ea.CredentialSource.URL != "" {
+		if allowed, _ := strconv.ParseBool(os.Getenv(allowExternalAccountURLEnv)); !allowed {
+			return nil, errCredentialURLDisabled
+		}
+	}
+	if format := ea.CredentialSource.Format; format.Type != "" {
+		source["format"] = map[string]string{
+			"type":                     format.Type,
+			"subject_token_field_name": format.SubjectTokenFieldName,
+		}
+	}
+
+	return json.Marshal(externalAccountJSON{
+		Type:                           "external_account",
+		Audience:                       ea.Audience,
+		SubjectTokenType:               ea.SubjectTokenType,
+		TokenURL:                       ea.TokenURL,
+		ServiceAccountImpersonationURL: ea.ServiceAccountImpersonationURL,
+		CredentialSource:               source,
+		UniverseDomain:                 c.UniverseDomain,
+	})
+}
+
+// externalAccountJSON is the structure of a GCP external account credential configuration file
+type externalAccountJSON struct {
+	Type                           string         `json:"type"`
+	Audience                       string         `json:"audience"`
+	SubjectTokenType               string         `json:"subject_token_type"`
+	TokenURL                       string         `json:"token_url,omitempty"`
+	ServiceAccountImpersonationURL string         `json:"service_account_impersonation_url,omitempty"`
+	CredentialSource               map[string]any `json:"credential_source"`
+	UniverseDomain                 string         `json:"universe_domain,omitempty"`
+}
+
 // serviceAccountJSON is the expected structure of a GCP Service Account credentials file
 // We mainly want to be able to pull out ProjectID to use as a default
 type serviceAccountJSON struct {
@@ -97,6 +503,19 @@ func NewCloudLoggingDatasource(ctx context.Context, settings backend.DataSourceI
 		conf.AuthType = jwtAuthentication
 	}
 
+	redactor, err := newRedactor(conf.RedactionRules)
+	if err != nil {
+		return nil, fmt.Errorf("redaction rules: %w", err)
+	}
+	allowlist, err := newAllowlist(conf.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+	maxExportEntries, err := conf.Export.maxEntries()
+	if err != nil {
+		return nil, err
+	}
+
 	// Only auto-switch to accessToken if the auth type is jwt (the default) and
 	// no JWT private key was provided. This preserves backward compat for
 	// pre-dropdown users (v1.5.0) who only set an access token, without hijacking
@@ -112,8 +531,45 @@ func NewCloudLoggingDatasource(ctx context.Context, settings backend.DataSourceI
 
 	oauthPassThrough := false
 
-	var client_err error
-	var client *cloudlogging.Client
+	if conf.Endpoints.Plaintext && conf.Endpoints.Logging == "" {
+		return nil, errPlaintextWithoutEndpoint
+	}
+	clientOptions := []cloudlogging.ClientOption{
+		cloudlogging.WithUniverseDomain(conf.UniverseDomain),
+		cloudlogging.WithEndpoints(cloudlogging.Endpoints{
+			Logging:         conf.Endpoints.Logging,
+			Config:          conf.Endpoints.Config,
+			ResourceManager: conf.Endpoints.ResourceManager,
+			LoggingREST:     conf.Endpoints.LoggingREST,
+		}),
+	}
+	if conf.Endpoints.Plaintext {
+		clientOptions = append(clientOptions, cloudlogging.WithPlaintext())
+	}
+
+	proxyOptions, err := conf.Proxy.clientOptions(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+	clientOptions = append(clientOptions, proxyOptions...)
+
+	retryOptions, err := conf.Retry.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	clientOptions = append(clientOptions, retryOptions...)
+
+	// The limiter is shared by all the clients of the data source
+	rateLimitOptions, err := conf.RateLimit.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	clientOptions = append(clientOptions, rateLimitOptions...)
+
+	var credentials cloudlogging.ClientOption
+	var tokenSource *cloudlogging.RefreshableTokenSource
+	// configErr is reported by the health check, as Grafana does not show errors creating the data source
+	var configErr error
 
 	switch conf.AuthType {
 	case jwtAuthentication:
@@ -128,37 +584,95 @@ func NewCloudLoggingDatasource(ctx context.Context, settings backend.DataSourceI
 		}
 
 		if conf.UsingImpersonation {
-			client, client_err = cloudlogging.NewClientWithImpersonation(context.TODO(), serviceAccount, conf.ServiceAccountToImpersonate, conf.UniverseDomain)
+			var impersonation cloudlogging.Impersonation
+			impersonation, configErr = conf.impersonation()
+			credentials = cloudlogging.WithImpersonationConfig(serviceAccount, impersonation)
 		} else {
-			client, client_err = cloudlogging.NewClient(context.TODO(), serviceAccount, conf.UniverseDomain)
+			credentials = cloudlogging.WithCredentialsJSON(serviceAccount)
 		}
 	case gceAuthentication:
 		if conf.UsingImpersonation {
-			client, client_err = cloudlogging.NewClientWithImpersonation(context.TODO(), nil, conf.ServiceAccountToImpersonate, conf.UniverseDomain)
+			var impersonation cloudlogging.Impersonation
+			impersonation, configErr = conf.impersonation()
+			credentials = cloudlogging.WithImpersonationConfig(nil, impersonation)
 		} else {
-			client, client_err = cloudlogging.NewClientWithGCE(context.TODO(), conf.UniverseDomain)
+			credentials = cloudlogging.WithDefaultCredentials()
 		}
 	case accessTokenAuthentication:
-		accessToken, ok := settings.DecryptedSecureJSONData[accessTokenKey]
-		if !ok || accessToken == "" {
-			return nil, errMissingAccessToken
+		switch conf.AccessTokenSource {
+		case "", accessTokenSourceStatic:
+			accessToken, ok := settings.DecryptedSecureJSONData[accessTokenKey]
+			if !ok || accessToken == "" {
+				return nil, errMissingAccessToken
+			}
+			credentials = cloudlogging.WithAccessToken(accessToken)
+		case accessTokenSourceFile:
+			if conf.AccessTokenFile == "" {
+				return nil, errMissingAccessTokenFile
+			}
+			// Files are read on the Grafana host, so only from the directory its administrators allow
+			if err := checkAccessTokenFile(conf.AccessTokenFile); err != nil {
+				return nil, err
+			}
+			tokenSource = cloudlogging.NewFileTokenSource(conf.AccessTokenFile)
+			credentials = cloudlogging.WithRefreshableToken(tokenSource)
+		case accessTokenSourceCommand:
+			if strings.TrimSpace(conf.AccessTokenCommand) == "" {
+				return nil, errMissingAccessTokenCommand
+			}
+			// The command runs on the Grafana host, so only its administrators may enable it
+			if allowed, _ := strconv.ParseBool(os.Getenv(allowAccessTokenCommandEnv)); !allowed {
+				return nil, errTokenCommandDisabled
+			}
+			tokenSource = cloudlogging.NewCommandTokenSource(conf.AccessTokenCommand, 0)
+			credentials = cloudlogging.WithRefreshableToken(tokenSource)
+		default:
+			return nil, fmt.Errorf("unknown access token source: %s", conf.AccessTokenSource)
 		}
-		client, client_err = cloudlogging.NewClientWithAccessToken(context.TODO(), accessToken, conf.UniverseDomain)
+	case externalAccountAuthentication:
+		externalAccount, err := conf.toExternalAccountJSON()
+		if err != nil {
+			return nil, fmt.Errorf("create credentials: %s", sanitizeErrorMessage(err))
+		}
+		credentials = cloudlogging.WithExternalAccount(externalAccount)
 	case oauthpassthroughAuthentication:
 		oauthPassThrough = true
 	default:
 		return nil, fmt.Errorf("unknown authentication type: %s", conf.AuthType)
 	}
 
-	if client_err != nil {
-		return nil, fmt.Errorf("create client: %s", sanitizeErrorMessage(client_err))
-	}
-
-	return &CloudLoggingDatasource{
-		client:           client,
+	ds := &CloudLoggingDatasource{
 		oauthPassThrough: oauthPassThrough,
 		universeDomain:   conf.UniverseDomain,
-	}, nil
+		clientOptions:    clientOptions,
+		proxyConfigured:  len(proxyOptions) > 0,
+		redactor:         redactor,
+		allowlist:        allowlist,
+		maxExportEntries: maxExportEntries,
+		tokenSource:      tokenSource,
+		configErr:        configErr,
+	}
+	// Passthrough data sources and invalid configurations have no shared client
+	if !oauthPassThrough && configErr == nil {
+		client, err := cloudlogging.New(context.TODO(), append(clientOptions, credentials)...)
+		if err != nil {
+			return nil, fmt.Errorf("create client: %s", sanitizeErrorMessage(err))
+		}
+		ds.client = client
+		if allowlist != nil {
+			ds.logScopesCache = newLogScopesCache()
+		}
+	}
+	if oauthPassThrough {
+		ds.clientCache = newPassthroughClientCache(func(ctx context.Context, headers map[string]string, onUnauthenticated func()) (cloudlogging.API, error) {
+			client, err := ds.CreateOauthClient(ctx, headers, cloudlogging.WithUnauthenticatedHandler(onUnauthenticated))
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		})
+	}
+	return ds, nil
 }
 
 // CloudLoggingDatasource is an example datasource which can respond to data queries, reports
@@ -167,6 +681,34 @@ type CloudLoggingDatasource struct {
 	client           cloudlogging.API
 	oauthPassThrough bool
 	universeDomain   string
+	// clientOptions are the options of the clients, except for their credentials
+	clientOptions []cloudlogging.ClientOption
+	// proxyConfigured is set when the clients connect through a proxy, which the health check tests
+	proxyConfigured bool
+	redactor        *redactor
+	// allowlist restricts the projects, buckets and views that can be queried
+	allowlist *allowlist
+	// maxExportEntries is the number of log entries exported at most
+	maxExportEntries int64
+	// tokenSource is set when the access token is read from a file or a command
+	tokenSource *cloudlogging.RefreshableTokenSource
+	// clientCache keeps the clients of OAuth passthrough users open between calls
+	clientCache *passthroughClientCache
+	// configErr is set when the configuration is invalid, and returned by all calls
+	configErr error
+	// fieldValuesCache keeps the field values sampled for the query editor
+	fieldValuesCache *ttlCache[[]fieldValue]
+	// projectsCache keeps the projects of the data source credentials. It is not used with
+	// OAuth passthrough, where each user sees their own projects
+	projectsCache *projectsCache
+	// userProjectsCache keeps the projects of each user briefly with OAuth passthrough
+	userProjectsCache *userProjectsCache
+	// logScopesCache keeps the log scopes checked against the allowlist with the data source
+	// credentials. It is not used with OAuth passthrough, where each user sees their own
+	logScopesCache *ttlCache[[]cloudlogging.LogScope]
+
+	resourceHandlerOnce sync.Once
+	callResourceHandler backend.CallResourceHandler
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -178,148 +720,24 @@ func (d *CloudLoggingDatasource) Dispose() {
 			log.DefaultLogger.Error("failed closing client", "error", err)
 		}
 	}
+	if d.clientCache != nil {
+		d.clientCache.close()
+	}
+	if d.projectsCache != nil {
+		d.projectsCache.close()
+	}
 }
 
-// CallResource fetches some resource from GCP using the data source's credentials
-// Currently limited resources are fetched, other requests receive a 404
+// CallResource fetches some resource from GCP using the data source's credentials.
+// The resources are routed in resourceHandler, other requests receive a 404
 func (d *CloudLoggingDatasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
-	// log.DefaultLogger.Info("CallResource called")
-
-	client := d.client
-
-	if d.oauthPassThrough {
-		headers := make(map[string]string)
-		for k, v := range req.Headers {
-			if strings.EqualFold(k, "Authorization") {
-				headers["Authorization"] = v[0]
-				break
-			}
-		}
-		oauthClient, err := d.CreateOauthClient(ctx, headers)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusBadGateway,
-				Body:   []byte(sanitizeErrorMessage(err)),
-			})
-		}
-
-		client = oauthClient
-		defer client.Close()
-	}
-
-	var body []byte
-
-	// Right now we only support calls to the following:
-	//`/gceDefaultProject`
-	//`/projects`
-	//`/logBuckets`
-	//`/logViews`
-	resource := strings.ToLower(req.Path)
-
-	if resource == "gcedefaultproject" {
-		proj, err := utils.GCEDefaultProject(ctx, "")
-		if err != nil {
-			log.DefaultLogger.Warn("problem getting GCE default project", "error", err)
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusBadGateway,
-				Body:   []byte(sanitizeErrorMessage(err)),
-			})
-		}
-		body, err = json.Marshal(proj)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body:   []byte(`Unable to create response`),
-			})
-		}
-	} else if resource == "projects" {
-		projects, err := client.ListProjects(ctx)
-		if err != nil {
-			log.DefaultLogger.Warn("problem listing projects", "error", err)
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusBadGateway,
-				Body:   []byte(sanitizeErrorMessage(err)),
-			})
-		}
-
-		body, err = json.Marshal(projects)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body:   []byte(`Unable to create response`),
-			})
-		}
-	} else if resource == "logbuckets" {
-		reqUrl, _ := url.Parse(req.URL)
-		params, _ := url.ParseQuery(reqUrl.RawQuery)
-
-		if params.Get("ProjectId") == "" {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusBadRequest,
-				Body:   []byte(`Missing required parameter: ProjectId`),
-			})
-		}
-
-		bucketNames, err := client.ListProjectBuckets(ctx, params.Get("ProjectId"))
-		if err != nil {
-			log.DefaultLogger.Warn("problem listing log buckets", "error", err)
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusBadGateway,
-				Body:   []byte(sanitizeErrorMessage(err)),
-			})
-		}
-
-		body, err = json.Marshal(bucketNames)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body:   []byte(`Unable to create response`),
-			})
-		}
-	} else if resource == "logviews" {
-		reqUrl, _ := url.Parse(req.URL)
-		params, _ := url.ParseQuery(reqUrl.RawQuery)
-
-		if params.Get("ProjectId") == "" {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusBadRequest,
-				Body:   []byte(`Missing required parameter: ProjectId`),
-			})
-		}
-		if params.Get("BucketId") == "" {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusBadRequest,
-				Body:   []byte(`Missing required parameter: BucketId`),
-			})
-		}
-
-		views, err := client.ListProjectBucketViews(ctx, params.Get("ProjectId"), params.Get("BucketId"))
-		if err != nil {
-			log.DefaultLogger.Warn("problem listing log views", "error", err)
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusBadGateway,
-				Body:   []byte(sanitizeErrorMessage(err)),
-			})
-		}
-
-		body, err = json.Marshal(views)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body:   []byte(`Unable to create response`),
-			})
-		}
-	} else {
+	if d.configErr != nil {
 		return sender.Send(&backend.CallResourceResponse{
-			Status: http.StatusNotFound,
-			Body:   []byte(`No such path`),
+			Status: http.StatusBadRequest,
+			Body:   []byte(d.configErr.Error()),
 		})
 	}
-	return sender.Send(&backend.CallResourceResponse{
-		Status: http.StatusOK,
-		Body:   body,
-	})
-
+	return d.resourceHandler().CallResource(ctx, req, sender)
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -328,10 +746,18 @@ func (d *CloudLoggingDatasource) CallResource(ctx context.Context, req *backend.
 // contains Frames ([]*Frame).
 func (d *CloudLoggingDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	// log.DefaultLogger.Info("QueryData called")
+	if d.configErr != nil {
+		response := backend.NewQueryDataResponse()
+		for _, q := range req.Queries {
+			response.Responses[q.RefID] = backend.ErrDataResponse(backend.StatusBadRequest, d.configErr.Error())
+		}
+		return response, nil
+	}
+
 	client := d.client
 
 	if d.oauthPassThrough {
-		oauthClient, err := d.CreateOauthClient(ctx, req.Headers)
+		oauthClient, release, err := d.passthroughClient(ctx, req.Headers)
 		if err != nil {
 			response := backend.NewQueryDataResponse()
 			for _, q := range req.Queries {
@@ -342,7 +768,7 @@ func (d *CloudLoggingDatasource) QueryData(ctx context.Context, req *backend.Que
 			return response, nil
 		}
 		client = oauthClient
-		defer client.Close()
+		defer release()
 	}
 
 	// create response struct
@@ -367,16 +793,73 @@ type queryModel struct {
 	ProjectID string `json:"projectId"`
 	BucketId  string `json:"bucketId"`
 	ViewId    string `json:"viewId"`
+	// LogScope is the ID of a log scope of the project, queried instead of the bucket and view
+	LogScope string `json:"logScope,omitempty"`
+	// ParentType is what the logs of the query belong to: project, the default, folder,
+	// organization or billingAccount
+	ParentType string `json:"parentType,omitempty"`
+	// ParentID is the ID of the folder, organization or billing account of the query, queried
+	// instead of the project
+	ParentID string `json:"parentId,omitempty"`
+	// Parent is the project, folder, organization or billing account of sinks and exclusions
+	// queries, such as folders/123. The parent of the logs of the query is used if empty
+	Parent string `json:"parent,omitempty"`
+	// SQL is the Log Analytics query of SQL queries
+	SQL string `json:"sql,omitempty"`
+	// Format is how the results of SQL queries are returned: table, or time_series
+	Format string `json:"format,omitempty"`
+	// ErrorGroups looks up the Error Reporting error groups of the error log entries, which
+	// takes a second request
+	ErrorGroups bool `json:"errorGroups,omitempty"`
 }
 
-func (d *CloudLoggingDatasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, client cloudlogging.API) backend.DataResponse {
-	response := backend.DataResponse{}
+func (d *CloudLoggingDatasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, client cloudlogging.API) (response backend.DataResponse) {
 
 	var q queryModel
 	response.Error = json.Unmarshal(query.JSON, &q)
 	if response.Error != nil {
 		return response
 	}
+	if query.QueryType == sinksQueryType || query.QueryType == exclusionsQueryType {
+		return d.inventoryQuery(ctx, query.QueryType, q, client)
+	}
+	if query.QueryType == logBucketsQueryType {
+		return d.logBucketsQuery(ctx, q, client)
+	}
+	if query.QueryType == sqlQueryType {
+		return d.analyticsQuery(ctx, query, q, client)
+	}
+	parent, err := parentName(q.ParentType, q.ParentID)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("query: %s", err))
+	}
+	switch {
+	case parent != "" && q.LogScope != "":
+		return backend.ErrDataResponse(backend.StatusBadRequest, "query: log scopes are only available for projects")
+	case q.LogScope != "":
+		if err := d.checkLogScope(ctx, client, q.ProjectID, q.LogScope); err != nil {
+			var permissionErr *permissionError
+			var invalidIDErr *invalidIDError
+			if errors.As(err, &permissionErr) || errors.As(err, &invalidIDErr) {
+				return allowlistErrorResponse(err)
+			}
+			return backend.ErrDataResponse(backend.StatusBadGateway, fmt.Sprintf("query: %s", sanitizeErrorMessage(err)))
+		}
+	case parent != "":
+		if err := d.allowlist.checkParentView(parent, q.BucketId, q.ViewId); err != nil {
+			return allowlistErrorResponse(err)
+		}
+	default:
+		if err := d.allowlist.checkView(q.ProjectID, q.BucketId, q.ViewId); err != nil {
+			return allowlistErrorResponse(err)
+		}
+	}
+
+	stats := &cloudlogging.CallStats{}
+	ctx = cloudlogging.WithCallStats(ctx, stats)
+	defer func() {
+		addRetries(response.Frames, stats.Retries())
+	}()
 
 	var qstr string
 	if q.QueryText != "" {
@@ -388,6 +871,8 @@ func (d *CloudLoggingDatasource) query(ctx context.Context, pCtx backend.PluginC
 		ProjectID: q.ProjectID,
 		BucketId:  q.BucketId,
 		ViewId:    q.ViewId,
+		LogScope:  q.LogScope,
+		Parent:    parent,
 		Filter:    qstr,
 		Limit:     query.MaxDataPoints,
 		TimeRange: struct {
@@ -400,10 +885,48 @@ func (d *CloudLoggingDatasource) query(ctx context.Context, pCtx backend.PluginC
 	}
 
 	logs, err := client.ListLogs(ctx, &clientRequest)
-	if err != nil {
+	if err != nil && len(logs) == 0 {
+		if errors.Is(err, cloudlogging.ErrRateLimited) || errors.Is(err, cloudlogging.ErrQuotaExceeded) {
+			return backend.ErrDataResponse(backend.StatusTooManyRequests, fmt.Sprintf("query: %s", err))
+		}
 		response.Error = fmt.Errorf("query: %s", sanitizeErrorMessage(err))
 		return response
 	}
+	// A page failing after others were fetched still returns their logs, with a notice
+	var partialNotice *data.Notice
+	if err != nil {
+		partialNotice = &data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("Only the first %d log entries could be retrieved: %s", len(logs), sanitizeErrorMessage(err)),
+		}
+	}
+
+	// Split entries are reassembled before their messages are clustered into patterns
+	logs, incompleteSplits := reassembleSplitLogs(ctx, client, clientRequest, logs)
+
+	if query.QueryType == patternsQueryType {
+		frame, err := patternsFrame(logs, query.TimeRange, query.Interval, d.redactor)
+		if err != nil {
+			response.Error = fmt.Errorf("patterns: %s", sanitizeErrorMessage(err))
+			return response
+		}
+		if len(incompleteSplits) > 0 {
+			frame.Meta.Notices = append(frame.Meta.Notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("%d log entries were split into parts and not all of them could be retrieved, so their patterns may be partial", len(incompleteSplits)),
+			})
+		}
+		if partialNotice != nil {
+			frame.Meta.Notices = append(frame.Meta.Notices, *partialNotice)
+		}
+		response.Frames = append(response.Frames, frame)
+		return response
+	}
+
+	var errorGroups map[string][]string
+	if q.ErrorGroups {
+		errorGroups = lookupErrorGroups(ctx, client, clientRequest, logs)
+	}
 
 	// create data frame response.
 	frames := []*data.Frame{}
@@ -417,6 +940,10 @@ func (d *CloudLoggingDatasource) query(ctx context.Context, pCtx backend.PluginC
 		}
 
 		labels := cloudlogging.GetLogLabels(logs[i])
+		cloudlogging.AddErrorGroupLabels(labels, errorGroups[logs[i].GetInsertId()])
+		body, redactions := d.redactor.redact(body)
+		redactions += d.redactor.redactLabels(labels)
+
 		f := data.NewFrame(logs[i].GetInsertId())
 		timestamp := data.NewField("time", nil, []time.Time{logs[i].GetTimestamp().AsTime()})
 		content := data.NewField("content", labels, []string{body})
@@ -424,9 +951,22 @@ func (d *CloudLoggingDatasource) query(ctx context.Context, pCtx backend.PluginC
 		f.Fields = append(f.Fields, timestamp, content)
 		f.Meta = &data.FrameMeta{}
 		f.Meta.PreferredVisualization = data.VisTypeLogs
+		if d.redactor != nil {
+			f.Meta.Custom = map[string]any{"redactions": redactions}
+		}
+		if split := logs[i].GetSplit(); incompleteSplits[split.GetUid()] {
+			f.Meta.Notices = append(f.Meta.Notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("This log entry was split into %d parts and not all of them could be retrieved", split.GetTotalSplits()),
+			})
+		}
 		frames = append(frames, f)
 	}
 
+	if partialNotice != nil && len(frames) > 0 {
+		frames[0].Meta.Notices = append(frames[0].Meta.Notices, *partialNotice)
+	}
+
 	// add the frames to the response.
 	for _, f := range frames {
 		response.Frames = append(response.Frames, f)
@@ -435,6 +975,126 @@ func (d *CloudLoggingDatasource) query(ctx context.Context, pCtx backend.PluginC
 	return response
 }
 
+// checkLogScope returns a permission error if a log scope of a project reads a project, bucket
+// or view that is not allowed. The log scopes are only listed when the allowlist restricts
+// anything, and are then cached for a minute. Log scopes which cannot be found are not allowed
+func (d *CloudLoggingDatasource) checkLogScope(ctx context.Context, client cloudlogging.API, projectID, logScope string) error {
+	if err := d.allowlist.checkProject(projectID); err != nil {
+		return err
+	}
+	if d.allowlist == nil {
+		return nil
+	}
+	scopes, ok := d.logScopesCache.get(projectID)
+	if !ok {
+		var err error
+		scopes, err = client.ListLogScopes(ctx, projectID)
+		if err != nil {
+			return fmt.Errorf("list log scopes: %w", err)
+		}
+		d.logScopesCache.put(projectID, scopes)
+	}
+	for _, scope := range scopes {
+		if scope.ID == logScope {
+			return d.allowlist.checkLogScope(scope)
+		}
+	}
+	return &permissionError{kind: "log scope", name: logScope}
+}
+
+// addRetries reports the number of retried requests in the metadata of the frames
+func addRetries(frames data.Frames, retries int) {
+	if retries == 0 {
+		return
+	}
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		custom, ok := frame.Meta.Custom.(map[string]any)
+		if !ok {
+			custom = map[string]any{}
+			frame.Meta.Custom = custom
+		}
+		custom["retries"] = retries
+	}
+}
+
+// reassembleSplitLogs merges log entries that were split into multiple pieces, fetching
+// the pieces missing from the result set. The missing pieces are searched for around the
+// known ones rather than in the time range of the query, which they may be just outside of.
+// It returns the merged logs and the uids of splits that are still incomplete
+func reassembleSplitLogs(ctx context.Context, client cloudlogging.API, request cloudlogging.Query, logs []*loggingpb.LogEntry) ([]*loggingpb.LogEntry, map[string]bool) {
+	incomplete := cloudlogging.IncompleteSplits(logs)
+	if len(incomplete) == 0 {
+		return cloudlogging.MergeSplitLogEntries(logs), nil
+	}
+
+	if len(incomplete) > maxSplitFetches {
+		incomplete = incomplete[:maxSplitFetches]
+	}
+	filters := make([]string, 0, len(incomplete))
+	fetched := map[string]bool{}
+	for _, uid := range incomplete {
+		// Quoted as uids are read from the log entries
+		filters = append(filters, "split.uid="+strconv.Quote(uid))
+		fetched[uid] = true
+	}
+	request.Filter = strings.Join(filters, " OR ")
+	request.Limit = int64(len(incomplete)) * maxSplitPieces
+	var first, last time.Time
+	for _, entry := range logs {
+		if !fetched[entry.GetSplit().GetUid()] {
+			continue
+		}
+		timestamp := entry.GetTimestamp().AsTime()
+		if first.IsZero() || timestamp.Before(first) {
+			first = timestamp
+		}
+		if timestamp.After(last) {
+			last = timestamp
+		}
+	}
+	request.TimeRange.From = first.Add(-splitPieceMargin).Format(time.RFC3339)
+	request.TimeRange.To = last.Add(splitPieceMargin).Format(time.RFC3339)
+
+	// The pieces fetched before an error are used all the same
+	pieces, err := client.ListLogs(ctx, &request)
+	if err != nil {
+		log.DefaultLogger.Warn("failed fetching split log pieces", "error", err)
+	}
+	known := map[string]bool{}
+	for _, entry := range logs {
+		known[entry.GetInsertId()] = true
+	}
+	for _, piece := range pieces {
+		if !known[piece.GetInsertId()] && piece.GetSplit().GetUid() != "" {
+			logs = append(logs, piece)
+		}
+	}
+
+	stillIncomplete := map[string]bool{}
+	for _, uid := range cloudlogging.IncompleteSplits(logs) {
+		stillIncomplete[uid] = true
+	}
+	return cloudlogging.MergeSplitLogEntries(logs), stillIncomplete
+}
+
+// lookupErrorGroups returns the Error Reporting error groups of the error log entries, by
+// insert ID. The error groups are left out if they cannot be looked up
+func lookupErrorGroups(ctx context.Context, client cloudlogging.API, request cloudlogging.Query, logs []*loggingpb.LogEntry) map[string][]string {
+	ids := cloudlogging.ErrorEntryIDs(logs)
+	if len(ids) == 0 {
+		return nil
+	}
+	groups, err := client.ListErrorGroups(ctx, &request, ids)
+	if err != nil {
+		log.DefaultLogger.Warn("failed looking up error groups", "error", err)
+		return nil
+	}
+	return groups
+}
+
 // CheckHealth handles health checks sent from Grafana to the plugin.
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
@@ -442,10 +1102,17 @@ func (d *CloudLoggingDatasource) query(ctx context.Context, pCtx backend.PluginC
 func (d *CloudLoggingDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	// log.DefaultLogger.Info("CheckHealth called")
 
+	if d.configErr != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: d.configErr.Error(),
+		}, nil
+	}
+
 	client := d.client
 
 	if d.oauthPassThrough {
-		oauthClient, err := d.CreateOauthClient(ctx, req.Headers)
+		oauthClient, release, err := d.passthroughClient(ctx, req.Headers)
 		if err != nil {
 			return &backend.CheckHealthResult{
 				Status:  backend.HealthStatusError,
@@ -453,7 +1120,7 @@ func (d *CloudLoggingDatasource) CheckHealth(ctx context.Context, req *backend.C
 			}, nil
 		}
 		client = oauthClient
-		defer client.Close()
+		defer release()
 	}
 
 	var status = backend.HealthStatusOk
@@ -467,35 +1134,83 @@ func (d *CloudLoggingDatasource) CheckHealth(ctx context.Context, req *backend.C
 		}, nil
 	}
 
-	if conf.DefaultProject == "" && conf.AuthType == gceAuthentication {
-		proj, err := utils.GCEDefaultProject(ctx, "")
-		if err != nil {
+	parent, err := parentName(conf.DefaultParentType, conf.DefaultParentID)
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: fmt.Sprintf("invalid default parent: %s", err),
+		}, nil
+	}
+	// The default project is only needed for the test query when no other parent is set
+	if parent == "" {
+		if conf.DefaultProject == "" && conf.AuthType == gceAuthentication {
+			proj, err := utils.GCEDefaultProject(ctx, "")
+			if err != nil {
+				return &backend.CheckHealthResult{
+					Status:  backend.HealthStatusError,
+					Message: fmt.Sprintf("failed to get GCE default project: %s", sanitizeErrorMessage(err)),
+				}, nil
+			}
+			conf.DefaultProject = proj
+		}
+		if conf.DefaultProject == "" && conf.OAuthPassThru {
 			return &backend.CheckHealthResult{
 				Status:  backend.HealthStatusError,
-				Message: fmt.Sprintf("failed to get GCE default project: %s", sanitizeErrorMessage(err)),
+				Message: "Please define a default project for OAuth authentication",
 			}, nil
 		}
-		conf.DefaultProject = proj
+		parent = "projects/" + conf.DefaultProject
 	}
-	if conf.DefaultProject == "" && conf.OAuthPassThru {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: "Please define a default project for OAuth authentication",
-		}, nil
+	if d.proxyConfigured {
+		if err := client.TestProxy(ctx); err != nil {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: fmt.Sprintf("failed to connect through the proxy: %s", sanitizeErrorMessage(err)),
+			}, nil
+		}
 	}
-	if err := client.TestConnection(ctx, conf.DefaultProject); err != nil {
+	if err := client.TestConnection(ctx, parent); err != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: fmt.Sprintf("failed to run test query: %s", sanitizeErrorMessage(err)),
 		}, nil
 	}
 
+	// Such as "project my-project" or "organization 123"
+	collection, id, _ := strings.Cut(parent, "/")
+	message := fmt.Sprintf("Successfully queried logs from GCP %s %s", strings.TrimSuffix(collection, "s"), id)
+	if d.tokenSource != nil {
+		message += ". " + d.tokenLifetimeMessage()
+	}
+
 	return &backend.CheckHealthResult{
 		Status:  status,
-		Message: fmt.Sprintf("Successfully queried logs from GCP project %s", conf.DefaultProject),
+		Message: message,
 	}, nil
 }
 
+// tokenLifetimeMessage describes the remaining lifetime of the access token read from a file or a command
+func (d *CloudLoggingDatasource) tokenLifetimeMessage() string {
+	expiry, err := d.tokenSource.Expiry()
+	if err != nil {
+		return fmt.Sprintf("Failed to read access token: %s", sanitizeErrorMessage(err))
+	}
+	if expiry.IsZero() {
+		return "Access token expiry is unknown"
+	}
+	return fmt.Sprintf("Access token expires in %s", time.Until(expiry).Round(time.Second))
+}
+
+// allowlistErrorResponse returns the response of a query refused by the allowlist checks:
+// bad request for invalid IDs, and forbidden for anything not allowed
+func allowlistErrorResponse(err error) backend.DataResponse {
+	var invalidIDErr *invalidIDError
+	if errors.As(err, &invalidIDErr) {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	return backend.ErrDataResponse(backend.StatusForbidden, err.Error())
+}
+
 // htmlLikePattern matches error strings that contain HTML responses. It targets
 // specific HTML signatures to avoid false positives from Go error messages that
 // contain angle-bracket notation (e.g. <nil> from ASN.1/x509 parsing).
@@ -514,11 +1229,26 @@ func sanitizeErrorMessage(err error) string {
 		"If you have configured a Universe Domain, please verify it is correct."
 }
 
-func (d *CloudLoggingDatasource) CreateOauthClient(ctx context.Context, headers map[string]string) (*cloudlogging.Client, error) {
-	client, err := cloudlogging.NewClientWithPassThrough(ctx, headers, d.universeDomain)
+func (d *CloudLoggingDatasource) CreateOauthClient(ctx context.Context, headers map[string]string, extraOpts ...cloudlogging.ClientOption) (*cloudlogging.Client, error) {
+	opts := append([]cloudlogging.ClientOption{cloudlogging.WithPassThrough(headers)}, d.clientOptions...)
+	opts = append(opts, extraOpts...)
+	client, err := cloudlogging.New(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("create oauth client: %s", sanitizeErrorMessage(err))
 	}
 
 	return client, nil
 }
+
+// passthroughClient returns the client for the token of the signed in user, and a function
+// to call once the client is no longer used
+func (d *CloudLoggingDatasource) passthroughClient(ctx context.Context, headers map[string]string) (cloudlogging.API, func(), error) {
+	if d.clientCache == nil {
+		client, err := d.CreateOauthClient(ctx, headers)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+	return d.clientCache.get(ctx, headers)
+}
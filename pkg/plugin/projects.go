@@ -0,0 +1,218 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	// defaultProjectsPageSize is the number of projects returned by default
+	defaultProjectsPageSize = 100
+	// maxProjectsPageSize caps the number of projects returned
+	maxProjectsPageSize = 1000
+	// projectsRefreshInterval is how often the cached projects are listed again
+	projectsRefreshInterval = 5 * time.Minute
+	// projectsRefreshTimeout bounds a background listing of the projects
+	projectsRefreshTimeout = time.Minute
+	// userProjectsTTL is how long the projects of an OAuth passthrough user are kept, long
+	// enough for the pages of a variable to be read from one listing
+	userProjectsTTL = time.Minute
+)
+
+// projectsCache keeps the projects visible to the data source credentials, as listing them
+// walks every page of the projects and takes seconds in large organizations. The projects are
+// listed on first use, and then again in the background
+type projectsCache struct {
+	list     func(ctx context.Context) ([]cloudlogging.Project, error)
+	interval time.Duration
+
+	// loadMu serializes the listings, so that concurrent calls wait for the first one
+	loadMu sync.Mutex
+
+	mu       sync.Mutex
+	projects []cloudlogging.Project
+	loaded   bool
+
+	startOnce sync.Once
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+func newProjectsCache(list func(ctx context.Context) ([]cloudlogging.Project, error)) *projectsCache {
+	return &projectsCache{
+		list:     list,
+		interval: projectsRefreshInterval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// get returns the cached projects, listing them if they have not been listed yet
+func (c *projectsCache) get(ctx context.Context) ([]cloudlogging.Project, error) {
+	c.startOnce.Do(func() { go c.refreshLoop() })
+	if projects, ok := c.cached(); ok {
+		return projects, nil
+	}
+
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	if projects, ok := c.cached(); ok {
+		return projects, nil
+	}
+	return c.loadLocked(ctx)
+}
+
+func (c *projectsCache) cached() ([]cloudlogging.Project, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.projects, c.loaded
+}
+
+// loadLocked lists the projects, sorted by ID, and caches them. loadMu must be held
+func (c *projectsCache) loadLocked(ctx context.Context) ([]cloudlogging.Project, error) {
+	projects, err := c.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sortProjects(projects)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.projects, c.loaded = projects, true
+	return projects, nil
+}
+
+// refreshLoop lists the projects every interval. The previous projects are kept when it fails
+func (c *projectsCache) refreshLoop() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), projectsRefreshTimeout)
+			c.loadMu.Lock()
+			if _, err := c.loadLocked(ctx); err != nil {
+				log.DefaultLogger.Warn("problem refreshing projects", "error", err)
+			}
+			c.loadMu.Unlock()
+			cancel()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// close stops refreshing the projects
+func (c *projectsCache) close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// userProjects are the projects listed for the token of an OAuth passthrough user
+type userProjects struct {
+	projects []cloudlogging.Project
+	listed   time.Time
+}
+
+// userProjectsCache keeps the projects of each OAuth passthrough user for a short while, so that
+// the pages following the first one are not listed again. Projects are keyed by a hash of the
+// Authorization header, so they are never shared between tokens
+type userProjectsCache struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]userProjects
+}
+
+func newUserProjectsCache() *userProjectsCache {
+	return &userProjectsCache{
+		ttl:        userProjectsTTL,
+		maxEntries: maxPassthroughClients,
+		now:        time.Now,
+		entries:    map[string]userProjects{},
+	}
+}
+
+// get returns the projects of the token, sorted by ID, listing them with list if they are not
+// cached or have expired
+func (c *userProjectsCache) get(ctx context.Context, authorization string, list func(ctx context.Context) ([]cloudlogging.Project, error)) ([]cloudlogging.Project, error) {
+	key := authorizationKey(authorization)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Sub(entry.listed) < c.ttl {
+		return entry.projects, nil
+	}
+
+	projects, err := list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sortProjects(projects)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if now.Sub(e.listed) >= c.ttl {
+			delete(c.entries, k)
+		}
+	}
+	// The cache only fills up with that many users walking their projects within the TTL
+	if len(c.entries) < c.maxEntries {
+		c.entries[key] = userProjects{projects: projects, listed: now}
+	}
+	return projects, nil
+}
+
+// sortProjects sorts projects by ID
+func sortProjects(projects []cloudlogging.Project) {
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].ID < projects[j].ID
+	})
+}
+
+// searchProjects returns up to limit projects whose ID or display name starts with prefix,
+// ignoring case, and which are directly under parent if given. The projects are sorted by ID,
+// and only those after the ID after are returned, so that the next page starts after the last
+// project of the previous one
+func searchProjects(projects []cloudlogging.Project, prefix, parent, after string, limit int) []cloudlogging.Project {
+	prefix = strings.ToLower(prefix)
+	found := []cloudlogging.Project{}
+	for _, project := range projects {
+		if len(found) == limit {
+			break
+		}
+		if project.ID <= after {
+			continue
+		}
+		if parent != "" && project.Parent != parent {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(project.ID), prefix) && !strings.HasPrefix(strings.ToLower(project.DisplayName), prefix) {
+			continue
+		}
+		found = append(found, project)
+	}
+	return found
+}
@@ -0,0 +1,212 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// defaultRedactionReplacement replaces redacted text when a rule has no replacement
+const defaultRedactionReplacement = "[REDACTED]"
+
+// redactionRule is a redaction rule configured on the data source. Either a named
+// preset or a regular expression can be given
+type redactionRule struct {
+	Name        string `json:"name"`
+	Preset      string `json:"preset"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// redactionPattern is a compiled redaction rule
+type redactionPattern struct {
+	pattern *regexp.Regexp
+	// replacement may reference capture groups of the pattern, as in regexp.Expand
+	replacement string
+	// validate, if set, filters the matches to redact
+	validate func(string) bool
+}
+
+// redactionPresets are the named redaction rules that can be used instead of a pattern
+var redactionPresets = map[string][]redactionPattern{
+	"email": {
+		{pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	},
+	"ip": {
+		{pattern: regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)},
+		{pattern: regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b`)},
+	},
+	"bearerToken": {
+		{pattern: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`), replacement: "Bearer " + defaultRedactionReplacement},
+	},
+	"apiKey": {
+		// Google API keys
+		{pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z\-_]{35}\b`)},
+		// Values assigned to api_key, apikey, x-api-key and similar keys
+		{
+			pattern:     regexp.MustCompile(`(?i)(\b(?:api[_-]?key|x-api-key)\b["']?\s*[:=]\s*["']?)[A-Za-z0-9\-_.]{8,}`),
+			replacement: "${1}" + defaultRedactionReplacement,
+		},
+	},
+	"creditCard": {
+		{pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), validate: luhnValid},
+	},
+}
+
+// redactor applies the redaction rules of a data source to log messages and labels
+type redactor struct {
+	patterns []redactionPattern
+}
+
+// newRedactor compiles the redaction rules. It returns nil if there are no rules
+func newRedactor(rules []redactionRule) (*redactor, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	r := &redactor{}
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		switch {
+		case rule.Preset != "" && rule.Pattern != "":
+			return nil, fmt.Errorf("redaction rule %s: set either a preset or a pattern", name)
+		case rule.Preset != "":
+			presets, ok := redactionPresets[rule.Preset]
+			if !ok {
+				return nil, fmt.Errorf("redaction rule %s: unknown preset %q", name, rule.Preset)
+			}
+			for _, preset := range presets {
+				if rule.Replacement != "" {
+					preset.replacement = rule.Replacement
+				}
+				r.patterns = append(r.patterns, preset)
+			}
+		case rule.Pattern != "":
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %s: %w", name, err)
+			}
+			r.patterns = append(r.patterns, redactionPattern{pattern: pattern, replacement: rule.Replacement})
+		default:
+			return nil, fmt.Errorf("redaction rule %s: a preset or a pattern is required", name)
+		}
+	}
+	return r, nil
+}
+
+// redact returns the text with every match of the rules replaced, and the number of replacements
+func (r *redactor) redact(text string) (string, int) {
+	if r == nil {
+		return text, 0
+	}
+
+	count := 0
+	for _, p := range r.patterns {
+		replacement := p.replacement
+		if replacement == "" {
+			replacement = defaultRedactionReplacement
+		}
+
+		if p.validate != nil {
+			text = p.pattern.ReplaceAllStringFunc(text, func(match string) string {
+				if !p.validate(match) {
+					return match
+				}
+				count++
+				return replacement
+			})
+			continue
+		}
+
+		if matches := len(p.pattern.FindAllStringIndex(text, -1)); matches > 0 {
+			count += matches
+			text = p.pattern.ReplaceAllString(text, replacement)
+		}
+	}
+	return text, count
+}
+
+// redactLabels redacts the label keys and values in place, and returns the number of replacements
+func (r *redactor) redactLabels(labels data.Labels) int {
+	if r == nil {
+		return 0
+	}
+	return redactMap(r, labels, r.redact)
+}
+
+// redactMap redacts the keys of m in place, and its values with redactValue. A key redacted to
+// the name of another key is suffixed with _2, _3 and so on, so that no value is dropped. It
+// returns the number of replacements
+func redactMap[V any](r *redactor, m map[string]V, redactValue func(V) (V, int)) int {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	count := 0
+	for _, k := range keys {
+		value, n := redactValue(m[k])
+		count += n
+		key, n := r.redact(k)
+		if n == 0 {
+			m[k] = value
+			continue
+		}
+		count += n
+		delete(m, k)
+		if _, taken := m[key]; taken {
+			for i := 2; ; i++ {
+				suffixed := fmt.Sprintf("%s_%d", key, i)
+				if _, taken := m[suffixed]; !taken {
+					key = suffixed
+					break
+				}
+			}
+		}
+		m[key] = value
+	}
+	return count
+}
+
+// luhnValid checks a candidate card number with the Luhn algorithm, ignoring separators
+func luhnValid(number string) bool {
+	sum := 0
+	digits := 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
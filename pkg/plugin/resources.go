@@ -0,0 +1,622 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"github.com/GoogleCloudPlatform/cloud-logging-data-source-plugin/pkg/plugin/cloudlogging"
+	"github.com/grafana/grafana-google-sdk-go/pkg/utils"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+)
+
+const (
+	// recentResourceTypesWindow is how far back log entries are sampled for their resource types
+	recentResourceTypesWindow = time.Hour
+	// recentResourceTypesSampleSize is the number of log entries sampled for their resource types
+	recentResourceTypesSampleSize = 1000
+)
+
+// clientHandlerFunc handles a resource call with the client of the data source, or of the user
+// for OAuth passthrough
+type clientHandlerFunc func(w http.ResponseWriter, r *http.Request, client cloudlogging.API)
+
+// resourceHandler returns the handler of the resource calls, creating it on first use
+func (d *CloudLoggingDatasource) resourceHandler() backend.CallResourceHandler {
+	d.resourceHandlerOnce.Do(func() {
+		d.fieldValuesCache = newFieldValuesCache()
+		if !d.oauthPassThrough && d.client != nil {
+			d.projectsCache = newProjectsCache(d.client.ListProjects)
+		}
+		if d.oauthPassThrough {
+			d.userProjectsCache = newUserProjectsCache()
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/gcedefaultproject", d.handleGCEDefaultProject)
+		mux.HandleFunc("/projects", d.withClient(d.handleProjects))
+		mux.HandleFunc("/folders", d.withClient(d.handleFolders))
+		mux.HandleFunc("/logbuckets", d.withClient(d.handleLogBuckets))
+		mux.HandleFunc("/logviews", d.withClient(d.handleLogViews))
+		mux.HandleFunc("/logscopes", d.withClient(d.handleLogScopes))
+		mux.HandleFunc("/lognames", d.withClient(d.handleLogNames))
+		mux.HandleFunc("/resourcedescriptors", d.withClient(d.handleResourceDescriptors))
+		mux.HandleFunc("/resourcetypes", d.withClient(d.handleResourceTypes))
+		mux.HandleFunc("/fieldvalues", d.withClient(d.handleFieldValues))
+		mux.HandleFunc("/savedqueries", d.withClient(d.handleSavedQueries))
+		mux.HandleFunc("/recentqueries", d.withClient(d.handleRecentQueries))
+		mux.HandleFunc("/sinks", d.withClient(d.handleSinks))
+		mux.HandleFunc("/exclusions", d.withClient(d.handleExclusions))
+		mux.HandleFunc("/export", d.withClient(d.handleExport))
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, http.StatusNotFound, "No such path")
+		})
+		d.callResourceHandler = httpadapter.New(lowercasePaths(mux))
+	})
+	return d.callResourceHandler
+}
+
+// lowercasePaths makes resource paths case insensitive
+func lowercasePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = strings.ToLower(r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withClient resolves the client a resource call is made with
+func (d *CloudLoggingDatasource) withClient(handler clientHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := d.client
+
+		if d.oauthPassThrough {
+			headers := make(map[string]string)
+			if authorization := authorizationHeader(r); authorization != "" {
+				headers["Authorization"] = authorization
+			}
+			oauthClient, release, err := d.passthroughClient(r.Context(), headers)
+			if err != nil {
+				writeError(w, http.StatusBadGateway, sanitizeErrorMessage(err))
+				return
+			}
+			client = oauthClient
+			defer release()
+		}
+
+		handler(w, r, client)
+	}
+}
+
+// authorizationHeader returns the Authorization header of a resource call. Grafana does not
+// canonicalize the names of the headers it forwards
+func authorizationHeader(r *http.Request) string {
+	for k, v := range r.Header {
+		if strings.EqualFold(k, "Authorization") && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// writeJSON sends the JSON encoding of v
+func writeJSON(w http.ResponseWriter, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Unable to create response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// writeError sends an error message as plain text
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
+
+// writeAPIError sends an error returned by a Google Cloud API, or by the allowlist
+func writeAPIError(w http.ResponseWriter, err error) {
+	var permissionErr *permissionError
+	if errors.As(err, &permissionErr) {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	var invalidIDErr *invalidIDError
+	if errors.As(err, &invalidIDErr) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, cloudlogging.ErrRateLimited) || errors.Is(err, cloudlogging.ErrQuotaExceeded) {
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	writeError(w, http.StatusBadGateway, sanitizeErrorMessage(err))
+}
+
+// intParam returns the value of an optional positive integer query parameter, capped to max,
+// sending an error if it is invalid
+func intParam(w http.ResponseWriter, r *http.Request, name string, defaultValue, max int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: "+name)
+		return 0, false
+	}
+	return min(n, max), true
+}
+
+// timeParam returns the value of an optional RFC 3339 time query parameter, sending an error
+// if it is invalid
+func timeParam(w http.ResponseWriter, r *http.Request, name string, defaultValue time.Time) (time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, true
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: "+name)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// requireParams returns the values of the query parameters, sending an error if one is missing
+func requireParams(w http.ResponseWriter, r *http.Request, names ...string) ([]string, bool) {
+	query := r.URL.Query()
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		value := query.Get(name)
+		if value == "" {
+			writeError(w, http.StatusBadRequest, "Missing required parameter: "+name)
+			return nil, false
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
+
+func (d *CloudLoggingDatasource) handleGCEDefaultProject(w http.ResponseWriter, r *http.Request) {
+	proj, err := utils.GCEDefaultProject(r.Context(), "")
+	if err != nil {
+		log.DefaultLogger.Warn("problem getting GCE default project", "error", err)
+		writeError(w, http.StatusBadGateway, sanitizeErrorMessage(err))
+		return
+	}
+	writeJSON(w, proj)
+}
+
+// handleProjects searches the projects by the prefix of their ID or display name, and by their
+// parent. The projects are sorted by ID, and the next page starts after the After project ID.
+// The projects of the data source credentials are cached, while those of OAuth passthrough
+// users are listed on every call
+func (d *CloudLoggingDatasource) handleProjects(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	limit, ok := intParam(w, r, "PageSize", defaultProjectsPageSize, maxProjectsPageSize)
+	if !ok {
+		return
+	}
+
+	var projects []cloudlogging.Project
+	var err error
+	switch {
+	case d.projectsCache != nil:
+		projects, err = d.projectsCache.get(r.Context())
+	case d.userProjectsCache != nil:
+		projects, err = d.userProjectsCache.get(r.Context(), authorizationHeader(r), client.ListProjects)
+	default:
+		projects, err = client.ListProjects(r.Context())
+		sortProjects(projects)
+	}
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing projects", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	writeJSON(w, searchProjects(d.allowlist.filterProjects(projects), query.Get("Query"), query.Get("Parent"), query.Get("After"), limit))
+}
+
+// handleFolders lists the folders directly under the Parent folder or organization, or the
+// organizations at the root of the hierarchy without a parent
+func (d *CloudLoggingDatasource) handleFolders(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	parent := r.URL.Query().Get("Parent")
+	if parent == "" {
+		organizations, err := client.ListOrganizations(r.Context())
+		if err != nil {
+			log.DefaultLogger.Warn("problem listing organizations", "error", err)
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, d.allowlist.filterOrganizations(organizations))
+		return
+	}
+
+	if err := validateParent(parent); err != nil || strings.HasPrefix(parent, "projects/") {
+		writeError(w, http.StatusBadRequest, "Invalid parameter: Parent must be folders/ID or organizations/ID")
+		return
+	}
+	if err := d.allowlist.checkParent(parent); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	folders, err := client.ListFolders(r.Context(), parent)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing folders", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, folders)
+}
+
+// logParam returns the Parent project, folder, organization or billing account of log bucket
+// and view calls, or else the project of their ProjectId
+func logParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if parent := r.URL.Query().Get("Parent"); parent != "" {
+		if err := validateParent(parent); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid parameter: Parent must be projects/ID, folders/ID, organizations/ID or billingAccounts/ID")
+			return "", false
+		}
+		return parent, true
+	}
+	params, ok := requireParams(w, r, "ProjectId")
+	if !ok {
+		return "", false
+	}
+	return "projects/" + params[0], true
+}
+
+// handleLogBuckets lists the log buckets of the Parent, or of the project of ProjectId
+func (d *CloudLoggingDatasource) handleLogBuckets(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	parent, ok := logParam(w, r)
+	if !ok {
+		return
+	}
+	if err := d.allowlist.checkParent(parent); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	buckets, err := client.ListBuckets(r.Context(), parent)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing log buckets", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, d.allowlist.filterBuckets(parent, buckets))
+}
+
+// handleLogViews lists the views of the BucketId bucket of the Parent, or of the project of ProjectId
+func (d *CloudLoggingDatasource) handleLogViews(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	parent, ok := logParam(w, r)
+	if !ok {
+		return
+	}
+	params, ok := requireParams(w, r, "BucketId")
+	if !ok {
+		return
+	}
+	bucketID := params[0]
+	if err := d.allowlist.checkParentBucket(parent, bucketID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	views, err := client.ListBucketViews(r.Context(), parent, bucketID)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing log views", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, d.allowlist.filterViews(parent, bucketID, views))
+}
+
+// handleLogNames lists the log names of a project, or of a bucket or view if given, for the
+// completion of logName filters
+func (d *CloudLoggingDatasource) handleLogNames(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	params, ok := requireParams(w, r, "ProjectId")
+	if !ok {
+		return
+	}
+	projectID := params[0]
+	bucketID, viewID := r.URL.Query().Get("BucketId"), r.URL.Query().Get("ViewId")
+	if viewID != "" && bucketID == "" {
+		writeError(w, http.StatusBadRequest, "Missing required parameter: BucketId")
+		return
+	}
+	if err := d.allowlist.checkView(projectID, bucketID, viewID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	logNames, err := client.ListLogNames(r.Context(), projectID, bucketID, viewID)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing log names", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, logNames)
+}
+
+// handleLogScopes lists the log scopes of a project, which group projects and views to query
+// together. Log scopes reading a project or view outside the allowlist are left out
+func (d *CloudLoggingDatasource) handleLogScopes(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	params, ok := requireParams(w, r, "ProjectId")
+	if !ok {
+		return
+	}
+	projectID := params[0]
+	if err := d.allowlist.checkProject(projectID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	scopes, err := client.ListLogScopes(r.Context(), projectID)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing log scopes", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, d.allowlist.filterLogScopes(scopes))
+}
+
+// handleResourceDescriptors lists the monitored resource types with their labels, for the
+// completion of resource.type and resource.labels filters
+func (d *CloudLoggingDatasource) handleResourceDescriptors(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	descriptors, err := client.ListMonitoredResourceDescriptors(r.Context())
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing monitored resource descriptors", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, descriptors)
+}
+
+// handleResourceTypes lists the resource types of the recent log entries of a project, or of
+// a bucket or view if given, the most frequent first
+func (d *CloudLoggingDatasource) handleResourceTypes(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	params, ok := requireParams(w, r, "ProjectId")
+	if !ok {
+		return
+	}
+	projectID := params[0]
+	bucketID, viewID := r.URL.Query().Get("BucketId"), r.URL.Query().Get("ViewId")
+	if viewID != "" && bucketID == "" {
+		writeError(w, http.StatusBadRequest, "Missing required parameter: BucketId")
+		return
+	}
+	if err := d.allowlist.checkView(projectID, bucketID, viewID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	q := &cloudlogging.Query{
+		ProjectID: projectID,
+		BucketId:  bucketID,
+		ViewId:    viewID,
+		Limit:     recentResourceTypesSampleSize,
+	}
+	q.TimeRange.From = now.Add(-recentResourceTypesWindow).Format(time.RFC3339)
+	q.TimeRange.To = now.Format(time.RFC3339)
+
+	entries, err := client.ListLogs(r.Context(), q)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing recent resource types", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, resourceTypes(entries))
+}
+
+// resourceTypes returns the distinct resource types of the entries, the most frequent first
+func resourceTypes(entries []*loggingpb.LogEntry) []string {
+	counts := map[string]int{}
+	types := []string{}
+	for _, entry := range entries {
+		resourceType := entry.GetResource().GetType()
+		if resourceType == "" {
+			continue
+		}
+		if counts[resourceType] == 0 {
+			types = append(types, resourceType)
+		}
+		counts[resourceType]++
+	}
+	sort.SliceStable(types, func(i, j int) bool {
+		if counts[types[i]] != counts[types[j]] {
+			return counts[types[i]] > counts[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	return types
+}
+
+// handleFieldValues samples the log entries matching a filter, and returns the most frequent
+// values of a field in them, such as jsonPayload.service or resource.labels.cluster_name
+func (d *CloudLoggingDatasource) handleFieldValues(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	params, ok := requireParams(w, r, "ProjectId", "Field")
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	projectID, field := params[0], params[1]
+	bucketID, viewID := query.Get("BucketId"), query.Get("ViewId")
+	if viewID != "" && bucketID == "" {
+		writeError(w, http.StatusBadRequest, "Missing required parameter: BucketId")
+		return
+	}
+	sampleSize, ok := intParam(w, r, "SampleSize", defaultFieldValuesSampleSize, maxFieldValuesSampleSize)
+	if !ok {
+		return
+	}
+	limit, ok := intParam(w, r, "Limit", defaultFieldValuesLimit, maxFieldValuesLimit)
+	if !ok {
+		return
+	}
+	// Times are truncated to the minute, so that the samples of a moving time range are reused
+	now := time.Now().UTC()
+	from, ok := timeParam(w, r, "From", now.Add(-defaultFieldValuesWindow))
+	if !ok {
+		return
+	}
+	to, ok := timeParam(w, r, "To", now)
+	if !ok {
+		return
+	}
+	if err := d.allowlist.checkView(projectID, bucketID, viewID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	req := fieldValuesRequest{
+		query: cloudlogging.Query{
+			ProjectID: projectID,
+			BucketId:  bucketID,
+			ViewId:    viewID,
+			Filter:    query.Get("Filter"),
+			Limit:     int64(sampleSize),
+		},
+		field: field,
+	}
+	req.query.TimeRange.From = from.UTC().Truncate(time.Minute).Format(time.RFC3339)
+	req.query.TimeRange.To = to.UTC().Truncate(time.Minute).Format(time.RFC3339)
+	if d.oauthPassThrough {
+		sum := sha256.Sum256([]byte(authorizationHeader(r)))
+		req.credential = hex.EncodeToString(sum[:])
+	}
+
+	key := req.cacheKey()
+	values, ok := d.fieldValuesCache.get(key)
+	if !ok {
+		entries, err := client.ListLogs(r.Context(), &req.query)
+		if err != nil {
+			log.DefaultLogger.Warn("problem sampling field values", "error", err)
+			writeAPIError(w, err)
+			return
+		}
+		values = countFieldValues(entries, field, d.redactor)
+		d.fieldValuesCache.put(key, values)
+	}
+	writeJSON(w, values[:min(limit, len(values))])
+}
+
+// handleSavedQueries lists the Logs Explorer queries saved in a project, for loading them in
+// the query editor
+func (d *CloudLoggingDatasource) handleSavedQueries(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	params, ok := requireParams(w, r, "ProjectId")
+	if !ok {
+		return
+	}
+	projectID := params[0]
+	if err := d.allowlist.checkProject(projectID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	queries, err := client.ListSavedQueries(r.Context(), projectID)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing saved queries", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, queries)
+}
+
+// handleRecentQueries lists the Logs Explorer queries recently run in a project
+func (d *CloudLoggingDatasource) handleRecentQueries(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	params, ok := requireParams(w, r, "ProjectId")
+	if !ok {
+		return
+	}
+	projectID := params[0]
+	if err := d.allowlist.checkProject(projectID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	queries, err := client.ListRecentQueries(r.Context(), projectID)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing recent queries", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, queries)
+}
+
+// parentParam returns the Parent query parameter, a project, folder or organization, sending
+// an error if it is missing, invalid or not allowed
+func (d *CloudLoggingDatasource) parentParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	params, ok := requireParams(w, r, "Parent")
+	if !ok {
+		return "", false
+	}
+	parent := params[0]
+	if err := validateParent(parent); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	if err := d.allowlist.checkParent(parent); err != nil {
+		writeAPIError(w, err)
+		return "", false
+	}
+	return parent, true
+}
+
+// handleSinks lists the sinks of a project, folder or organization
+func (d *CloudLoggingDatasource) handleSinks(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	parent, ok := d.parentParam(w, r)
+	if !ok {
+		return
+	}
+
+	sinks, err := client.ListSinks(r.Context(), parent)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing sinks", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, sinks)
+}
+
+// handleExclusions lists the exclusions of a project, folder or organization
+func (d *CloudLoggingDatasource) handleExclusions(w http.ResponseWriter, r *http.Request, client cloudlogging.API) {
+	parent, ok := d.parentParam(w, r)
+	if !ok {
+		return
+	}
+
+	exclusions, err := client.ListExclusions(r.Context(), parent)
+	if err != nil {
+		log.DefaultLogger.Warn("problem listing exclusions", "error", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, exclusions)
+}
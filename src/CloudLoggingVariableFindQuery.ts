@@ -34,6 +34,8 @@ export default class CloudLoggingVariableFindQuery {
                     return this.handleBucketQuery(query)
                 case LogFindQueryScopes.Views:
                     return this.handleViewQuery(query)
+                case LogFindQueryScopes.LogScopes:
+                    return this.handleLogScopeQuery(query)
                 default:
                     return [];
             }
@@ -44,7 +46,7 @@ export default class CloudLoggingVariableFindQuery {
     }
 
     async handleProjectsQuery() {
-        const projects = await this.datasource.getProjects();
+        const projects = (await this.datasource.getAllProjects()).map(p => p.id);
         return (projects).map((s) => ({
             text: s,
             value: s,
@@ -58,7 +60,7 @@ export default class CloudLoggingVariableFindQuery {
         if (projectId.startsWith('$')) {
             p = getTemplateSrv().replace(projectId)
         }
-        buckets = await this.datasource.getLogBuckets(p);
+        buckets = (await this.datasource.getLogBuckets(p)).map(b => b.id);
         return (buckets).map((s) => ({
             text: s,
             value: s,
@@ -83,11 +85,24 @@ export default class CloudLoggingVariableFindQuery {
         if (!b) {
             return []
         }
-        views = await this.datasource.getLogBucketViews(p, b);
+        views = (await this.datasource.getLogBucketViews(p, b)).map(v => v.id);
         return (views).map((s) => ({
             text: s,
             value: s,
             expandable: true,
         } as SelectableValue<string>));
     }
+
+    async handleLogScopeQuery({ projectId }: CloudLoggingVariableQuery) {
+        let p = projectId
+        if (projectId.startsWith('$')) {
+            p = getTemplateSrv().replace(projectId)
+        }
+        const scopes = (await this.datasource.getLogScopes(p)).map(s => s.id);
+        return (scopes).map((s) => ({
+            text: s,
+            value: s,
+            expandable: true,
+        } as SelectableValue<string>));
+    }
 }
@@ -16,12 +16,26 @@
 
 import React, { KeyboardEvent, useEffect, useMemo, useState } from 'react';
 import { QueryEditorProps, SelectableValue } from '@grafana/data';
-import { InlineField, InlineFieldRow, LinkButton, Select, TextArea, Tooltip } from '@grafana/ui';
+import { Button, InlineField, InlineFieldRow, InlineLabel, InlineSwitch, Input, LinkButton, Select, TextArea, Tooltip } from '@grafana/ui';
 import { DataSource } from './datasource';
-import { CloudLoggingOptions, defaultQuery, Query } from './types';
+import { CloudLoggingOptions, defaultQuery, ExportFormat, LogBucket, parentCollections, ParentType, parentTypes, Query, QueryType, queryTypes, SQLFormat, sqlFormats } from './types';
 
 type Props = QueryEditorProps<DataSource, Query, CloudLoggingOptions>;
 
+// Milliseconds to wait after the last keystroke before searching the projects
+const projectSearchDelay = 300;
+
+/**
+ * Bucket options, with the default bucket first and their retention as description
+ */
+function bucketOptions(buckets: LogBucket[]): Array<SelectableValue<string>> {
+  return [{ label: '', value: '' }, ...buckets.map(bucket => ({
+    label: bucket.id,
+    value: bucket.id,
+    description: `${bucket.retentionDays} days retention${bucket.analyticsEnabled ? ', Log Analytics' : ''}`,
+  }))];
+}
+
 /**
  * This is basically copied from {MQLQueryEditor} from the cloud-monitoring data source
  *
@@ -67,52 +81,89 @@ export function LoggingQueryEditor({ datasource, query, range, onChange, onRunQu
   };
 
   const [projects, setProjects] = useState<Array<SelectableValue<string>>>();
+  const [projectSearch, setProjectSearch] = useState('');
   useEffect(() => {
-    datasource.getProjects().then(res => {
-      setProjects(res.map(project => ({
-        label: project,
-        value: project,
-      })));
-      setFetchError(undefined);
-    }).catch(err => setFetchError(sanitizeFetchError(err)));
-  }, [datasource]);
+    // Search once typing pauses, and ignore the answers of earlier searches arriving late
+    let stale = false;
+    const timer = setTimeout(() => {
+      datasource.getProjects(projectSearch).then(res => {
+        if (stale) {
+          return;
+        }
+        setProjects(res.map(project => ({
+          label: project.id,
+          value: project.id,
+          description: project.displayName,
+        })));
+        setFetchError(undefined);
+      }).catch(err => {
+        if (!stale) {
+          setFetchError(sanitizeFetchError(err));
+        }
+      });
+    }, projectSearch ? projectSearchDelay : 0);
+    return () => {
+      stale = true;
+      clearTimeout(timer);
+    };
+  }, [datasource, projectSearch]);
+
+  // Folder, organization or billing account queried instead of the project, such as organizations/123
+  const collection = query.parentType ? parentCollections[query.parentType] : undefined;
+  const parent = collection && query.parentId ? `${collection}/${query.parentId}` : undefined;
 
   const [buckets, setBuckets] = useState<Array<SelectableValue<string>>>();
   useEffect(() => {
-    if (!query.projectId) {
+    if (collection) {
+      if (parent && !parent.includes('$')) {
+        datasource.getLogBuckets(query.projectId, parent).then(res => {
+          setBuckets(bucketOptions(res));
+          setFetchError(undefined);
+        }).catch(err => setFetchError(sanitizeFetchError(err)));
+      }
+    } else if (!query.projectId) {
       datasource.getDefaultProject().then(r => {
         query.projectId = r;
         datasource.getLogBuckets(query.projectId).then(res => {
-          setBuckets(res.map(bucket => ({
-            label: bucket,
-            value: bucket,
-          })));
+          setBuckets(bucketOptions(res));
         }).catch(err => setFetchError(sanitizeFetchError(err)));
       });
     } else if (!query.projectId.startsWith('$')) {
       datasource.getLogBuckets(query.projectId).then(res => {
-        setBuckets(res.map(bucket => ({
-          label: bucket,
-          value: bucket,
-        })));
+        setBuckets(bucketOptions(res));
         setFetchError(undefined);
       }).catch(err => setFetchError(sanitizeFetchError(err)));
     }
-  }, [datasource, query]);
+  }, [datasource, query, collection, parent]);
 
   const [views, setViews] = useState<Array<SelectableValue<string>>>();
   useEffect(() => {
     const bid = query.bucketId ? query.bucketId : "global/buckets/_Default";
-    if (query.projectId && !query.projectId.startsWith('$') && !bid.startsWith('$')) {
-      datasource.getLogBucketViews(query.projectId, `${bid}`).then(res => {
-        setViews(res.map(view => ({
-          label: view,
-          value: view,
-        })));
+    const queried = collection ? parent && !parent.includes('$') : query.projectId && !query.projectId.startsWith('$');
+    if (queried && !bid.startsWith('$')) {
+      datasource.getLogBucketViews(query.projectId, `${bid}`, parent).then(res => {
+        setViews([{ label: '', value: '' }, ...res.map(view => ({
+          label: view.id,
+          value: view.id,
+          description: view.filter || view.description,
+        }))]);
         setFetchError(undefined);
       }).catch(err => setFetchError(sanitizeFetchError(err)));
     }
-  }, [datasource, query]);
+  }, [datasource, query, collection, parent]);
+
+  const [logScopes, setLogScopes] = useState<Array<SelectableValue<string>>>();
+  useEffect(() => {
+    if (query.projectId && !query.projectId.startsWith('$')) {
+      datasource.getLogScopes(query.projectId).then(res => {
+        setLogScopes([{ label: '', value: '' }, ...res.map(scope => ({
+          label: scope.id,
+          value: scope.id,
+          description: scope.description || scope.resourceNames.join(', '),
+        }))]);
+      }).catch(err => setFetchError(sanitizeFetchError(err)));
+    }
+  }, [datasource, query.projectId]);
 
   /**
    * Keep an up-to-date URI that links to the equivalent query in the GCP console
@@ -122,6 +173,11 @@ export function LoggingQueryEditor({ datasource, query, range, onChange, onRunQu
       return undefined;
     }
 
+    // The console only opens the logs of projects
+    if (collection) {
+      return undefined;
+    }
+
     let storageScope = "";
     if (query.projectId) {
       let scopePath = `storage,projects/${query.projectId}`;
@@ -168,11 +224,49 @@ export function LoggingQueryEditor({ datasource, query, range, onChange, onRunQu
     }
 
     return `https://console.cloud.google.com/logs/query?${queryParams.join('&')}`;
-  }, [query, range]);
+  }, [query, range, collection]);
+
+  const [exporting, setExporting] = useState(false);
+  /**
+   * Download the log entries of the query in the time range, as NDJSON or CSV
+   */
+  const exportLogs = (format: ExportFormat) => {
+    if (range === undefined) {
+      return;
+    }
+    setExporting(true);
+    datasource.exportLogs(query, range, format).then(blob => {
+      const link = document.createElement('a');
+      link.href = URL.createObjectURL(blob);
+      link.download = `logs-${parent ? parent.replace('/', '-') : query.projectId}.${format}`;
+      link.click();
+      URL.revokeObjectURL(link.href);
+      setFetchError(undefined);
+    }).catch(err => setFetchError(sanitizeFetchError(err))).finally(() => setExporting(false));
+  };
+
+  // Sinks and exclusions queries list the configuration of a parent instead of querying logs
+  const isInventory = query.queryType === QueryType.Sinks || query.queryType === QueryType.Exclusions;
+  // Log buckets queries list the buckets of the project
+  const listsConfiguration = isInventory || query.queryType === QueryType.LogBuckets;
+  // SQL queries run Log Analytics queries instead of filtering log entries
+  const isSQL = query.queryType === QueryType.SQL;
 
   return (
     <>
       <InlineFieldRow>
+        <InlineField label='Query type'>
+          <Select
+            width={20}
+            onChange={e => onChange({
+              ...query,
+              queryType: e.value!,
+            })}
+            options={queryTypes}
+            value={query.queryType ?? QueryType.Logs}
+            inputId={`${query.refId}-query-type`}
+          />
+        </InlineField>
         <InlineField label='Project ID'>
           <Select
             width={30}
@@ -183,8 +277,10 @@ export function LoggingQueryEditor({ datasource, query, range, onChange, onRunQu
               projectId: e.value!,
               bucketId: query.bucketId && query.bucketId.startsWith('$') ? query.bucketId : "",
               viewId: query.viewId && query.viewId.startsWith('$') ? query.viewId : "",
+              logScope: query.logScope && query.logScope.startsWith('$') ? query.logScope : "",
             })}
             options={projects}
+            onInputChange={v => setProjectSearch(v)}
             value={query.projectId}
             placeholder="Select Project"
             inputId={`${query.refId}-project`}
@@ -221,12 +317,126 @@ export function LoggingQueryEditor({ datasource, query, range, onChange, onRunQu
             inputId={`${query.refId}-view`}
           />
         </InlineField>
+        {!listsConfiguration && !isSQL && !collection && (
+        <InlineField label='Log Scope' tooltip='Query the projects and views of a log scope of the project, instead of the bucket and view'>
+          <Select
+            width={30}
+            allowCustomValue
+            formatCreateLabel={(v) => `Use log scope: ${v}`}
+            onChange={e => onChange({
+              ...query,
+              logScope: e.value!,
+            })}
+            options={logScopes}
+            value={query.logScope}
+            placeholder="Select Log Scope"
+            inputId={`${query.refId}-log-scope`}
+          />
+        </InlineField>
+        )}
       </InlineFieldRow>
+      {!isInventory && !isSQL && (
+        <InlineFieldRow>
+          <InlineField label='Parent type' tooltip='Query the logs of a folder, organization or billing account, such as organization audit logs, instead of the project'>
+            <Select
+              width={20}
+              onChange={e => onChange({
+                ...query,
+                parentType: e.value as ParentType,
+                bucketId: query.bucketId && query.bucketId.startsWith('$') ? query.bucketId : "",
+                viewId: query.viewId && query.viewId.startsWith('$') ? query.viewId : "",
+                logScope: e.value === ParentType.Project ? query.logScope : "",
+              })}
+              options={parentTypes}
+              value={query.parentType ?? ParentType.Project}
+              inputId={`${query.refId}-parent-type`}
+            />
+          </InlineField>
+          {collection && (
+          <InlineField label='Parent ID' tooltip='ID of the folder, organization or billing account, such as 123 or 0A1B2C-3D4E5F-6A7B8C'>
+            <Input
+              width={30}
+              value={query.parentId ?? ''}
+              placeholder='123'
+              onChange={e => onChange({
+                ...query,
+                parentId: e.currentTarget.value,
+              })}
+              onBlur={onRunQuery}
+            />
+          </InlineField>
+          )}
+        </InlineFieldRow>
+      )}
       {fetchError && (
         <div style={{ color: 'rgb(224, 93, 93)', marginBottom: '8px', padding: '8px', border: '1px solid rgb(224, 93, 93)', borderRadius: '4px', background: 'rgba(224, 93, 93, 0.1)' }}>
           ⚠️ {fetchError}
         </div>
       )}
+      {isInventory && (
+        <InlineFieldRow>
+          <InlineField label='Parent' tooltip='Project, folder or organization, such as folders/123. The project above is used if empty'>
+            <Input
+              width={40}
+              value={query.parent ?? ''}
+              placeholder={query.projectId ? `projects/${query.projectId}` : 'projects/my-project'}
+              onChange={e => onChange({
+                ...query,
+                parent: e.currentTarget.value,
+              })}
+              onBlur={onRunQuery}
+            />
+          </InlineField>
+        </InlineFieldRow>
+      )}
+      {isSQL && (<>
+      <InlineFieldRow>
+        <InlineField label='Format'>
+          <Select
+            width={20}
+            onChange={e => onChange({
+              ...query,
+              format: e.value as SQLFormat,
+            })}
+            options={sqlFormats}
+            value={query.format ?? SQLFormat.Table}
+            inputId={`${query.refId}-format`}
+          />
+        </InlineField>
+        {datasource.hasAllowlist() && (
+          <InlineLabel width="auto" tooltip='SQL queries are checked against the data source allowlist, and cannot read other views'>
+            Only reads the allowed bucket and view above
+          </InlineLabel>
+        )}
+      </InlineFieldRow>
+      <TextArea
+        name="SQL"
+        className="slate-query-field"
+        value={query.sql}
+        rows={10}
+        placeholder="SELECT $__timeGroup(timestamp) AS time, severity, COUNT(*) AS count FROM $__table WHERE $__timeFilter(timestamp) GROUP BY time, severity ORDER BY time (Run with Shift+Enter)"
+        onBlur={onRunQuery}
+        onChange={e => onChange({
+          ...query,
+          sql: e.currentTarget.value,
+        })}
+        onKeyDown={onKeyDown}
+        onPointerEnterCapture={undefined}
+        onPointerLeaveCapture={undefined}
+      />
+      </>)}
+      {!listsConfiguration && !isSQL && (<>
+      <InlineFieldRow>
+        <InlineField label='Error groups' tooltip='Look up the Error Reporting error groups of error log entries. This takes a second request, which counts against the read quota'>
+          <InlineSwitch
+            value={query.errorGroups ?? false}
+            onChange={e => onChange({
+              ...query,
+              errorGroups: e.currentTarget.checked,
+            })}
+          />
+        </InlineField>
+      </InlineFieldRow>
       <TextArea
         name="Query"
         className="slate-query-field"
@@ -253,6 +463,25 @@ export function LoggingQueryEditor({ datasource, query, range, onChange, onRunQu
           View in Cloud Logging
         </LinkButton>
       </Tooltip>
+      <Tooltip content='Download the log entries of the time range, without the line limit of the panel'>
+        <Button
+          disabled={exporting || range === undefined}
+          icon='download-alt'
+          variant='secondary'
+          onClick={() => exportLogs(ExportFormat.NDJSON)}
+        >
+          Export NDJSON
+        </Button>
+      </Tooltip>
+      <Button
+        disabled={exporting || range === undefined}
+        icon='download-alt'
+        variant='secondary'
+        onClick={() => exportLogs(ExportFormat.CSV)}
+      >
+        Export CSV
+      </Button>
+      </>)}
     </>
   );
 };
@@ -29,6 +29,7 @@ export class CloudLoggingVariableQueryEditor extends PureComponent<Props, Variab
         { value: LogFindQueryScopes.Projects, label: 'Projects' },
         { value: LogFindQueryScopes.Buckets, label: 'Buckets' },
         { value: LogFindQueryScopes.Views, label: 'Views' },
+        { value: LogFindQueryScopes.LogScopes, label: 'Log scopes' },
     ];
 
     defaults: VariableScopeData = {
@@ -49,10 +50,10 @@ export class CloudLoggingVariableQueryEditor extends PureComponent<Props, Variab
     async componentDidMount() {
         await this.props.datasource.ensureGCEDefaultProject();
         const projectId = this.props.query.projectId || (await this.props.datasource.getDefaultProject());
-        const projects = (await this.props.datasource.getProjects());
+        const projects = (await this.props.datasource.getAllProjects()).map(p => p.id);
         let buckets: string[] = [];
         if (!projectId.startsWith('$')) {
-            buckets = await this.props.datasource.getLogBuckets(projectId);
+            buckets = (await this.props.datasource.getLogBuckets(projectId)).map(b => b.id);
         }
 
         const state: any = {
@@ -80,7 +81,7 @@ export class CloudLoggingVariableQueryEditor extends PureComponent<Props, Variab
     async onProjectChange(projectId: string) {
         let buckets: string[] = [];
         if (!projectId.startsWith('$')) {
-            buckets = await this.props.datasource.getLogBuckets(projectId);
+            buckets = (await this.props.datasource.getLogBuckets(projectId)).map(b => b.id);
         }
         const state: any = {
             buckets,
@@ -94,7 +95,7 @@ export class CloudLoggingVariableQueryEditor extends PureComponent<Props, Variab
     async onBucketChange(projectId: string, bucketId: string) {
         let views: string[] = [];
         if (!bucketId.startsWith('$')) {
-            views = await this.props.datasource.getLogBucketViews(projectId, bucketId);
+            views = (await this.props.datasource.getLogBucketViews(projectId, bucketId)).map(v => v.id);
         }
 
         const state: any = {
@@ -120,6 +121,7 @@ export class CloudLoggingVariableQueryEditor extends PureComponent<Props, Variab
 
         switch (queryType) {
             case LogFindQueryScopes.Buckets:
+            case LogFindQueryScopes.LogScopes:
                 return (
                     <>
                         <VariableQueryField
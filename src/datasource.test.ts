@@ -44,6 +44,21 @@ describe('Google Cloud Logging Data Source', () => {
             ds.getDefaultProject().then(r => expect(r).toBe(projectId));
         });
     });
+    describe('getAllProjects', () => {
+        it('gets the projects a page at a time', async () => {
+            const ds = makeDataSource();
+            const ids = Array.from({ length: 1001 }, (_, i) => `project-${String(i).padStart(4, '0')}`);
+            const getResource = jest.spyOn(ds, 'getResource').mockImplementation(async (_path, params) => {
+                const after = (params as Record<string, string>)['After'] ?? '';
+                return ids.filter(id => id > after).slice(0, 1000).map(id => ({ id }));
+            });
+
+            const projects = await ds.getAllProjects();
+            expect(projects.map(p => p.id)).toEqual(ids);
+            expect(getResource).toHaveBeenCalledTimes(2);
+            expect(getResource).toHaveBeenLastCalledWith('projects', { PageSize: '1000', After: 'project-0999' });
+        });
+    });
 });
 
 const makeDataSource = () => {
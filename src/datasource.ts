@@ -14,9 +14,10 @@
  * limitations under the License.
  */
 
-import { DataSourceInstanceSettings, QueryFixAction, ScopedVars } from '@grafana/data';
-import { DataSourceWithBackend, getTemplateSrv, TemplateSrv } from '@grafana/runtime';
-import { CloudLoggingOptions, Query } from './types';
+import { DataSourceInstanceSettings, QueryFixAction, ScopedVars, TimeRange } from '@grafana/data';
+import { DataSourceWithBackend, getBackendSrv, getTemplateSrv, TemplateSrv } from '@grafana/runtime';
+import { lastValueFrom } from 'rxjs';
+import { CloudLoggingOptions, Exclusion, ExportFormat, FieldValue, Folder, LogBucket, LogScope, LogView, MonitoredResourceDescriptor, Project, Query, RecentQuery, SavedQuery, Sink } from './types';
 import { CloudLoggingVariableSupport } from './variables';
 
 export class DataSource extends DataSourceWithBackend<Query, CloudLoggingOptions> {
@@ -71,6 +72,14 @@ export class DataSource extends DataSourceWithBackend<Query, CloudLoggingOptions
     return defaultProject || '';
   }
 
+  /**
+   * Whether the data source restricts the projects, buckets or views it may query
+   */
+  hasAllowlist() {
+    const { projects, buckets, views } = this.instanceSettings.jsonData.allowlist ?? {};
+    return Boolean(projects?.length || buckets?.length || views?.length);
+  }
+
   async getGCEDefaultProject() {
     return this.getResource(`gceDefaultProject`);
   }
@@ -83,33 +92,216 @@ export class DataSource extends DataSourceWithBackend<Query, CloudLoggingOptions
   }
 
   /**
-   * Have the backend call `resourcemanager.projects.list` with our credentials,
-   * and return the IDs of all projects found
+   * Have the backend search the projects visible to our credentials, which it caches
    *
-   * @returns List of discovered project IDs
+   * @param query Prefix of the project IDs or display names
+   * @param parent Folder or organization the projects are directly under, such as folders/123
+   * @param pageSize Number of projects returned at most, 100 by default and 1000 at most
+   * @param after Project ID the returned projects come after, to get the next page
+   * @returns List of discovered projects, sorted by ID
    */
-  getProjects(): Promise<string[]> {
-    return this.getResource(`projects`);
+  getProjects(query?: string, parent?: string, pageSize?: number, after?: string): Promise<Project[]> {
+    const params: Record<string, string> = {};
+    if (query) {
+      params["Query"] = query;
+    }
+    if (parent) {
+      params["Parent"] = parent;
+    }
+    if (pageSize) {
+      params["PageSize"] = `${pageSize}`;
+    }
+    if (after) {
+      params["After"] = after;
+    }
+    return this.getResource(`projects`, params);
+  }
+
+  /**
+   * Get every project visible to our credentials, a page at a time
+   *
+   * @returns List of discovered projects, sorted by ID
+   */
+  async getAllProjects(): Promise<Project[]> {
+    const pageSize = 1000;
+    const projects: Project[] = [];
+    let page: Project[];
+    do {
+      page = await this.getProjects(undefined, undefined, pageSize, projects[projects.length - 1]?.id);
+      projects.push(...page);
+    } while (page.length === pageSize);
+    return projects;
+  }
+
+  /**
+   * Have the backend call `resourcemanager.folders.list` with our credentials, to browse the
+   * resource hierarchy
+   *
+   * @param parent Folder or organization, such as organizations/456. Without it, the
+   * organizations at the root of the hierarchy are returned
+   * @returns List of folders or organizations
+   */
+  getFolders(parent?: string): Promise<Folder[]> {
+    return this.getResource(`folders`, parent ? { "Parent": parent } : {});
   }
 
   /**
    * Have the backend call `projects.locations.buckets.list` with our credentials,
-   * and return the names of all log buckets found
+   * and return all log buckets found in the project, or in the parent folder, organization
+   * or billing account if given, such as organizations/123
    *
-   * @returns List of discovered bucket names
+   * @returns List of discovered buckets, with their retention and Log Analytics settings
    */
-  getLogBuckets(projectId: string): Promise<string[]> {
-    return this.getResource(`logBuckets`, { "ProjectId": projectId });
+  getLogBuckets(projectId: string, parent?: string): Promise<LogBucket[]> {
+    return this.getResource(`logBuckets`, parent ? { "Parent": parent } : { "ProjectId": projectId });
   }
 
   /**
    * Have the backend call `projects.locations.buckets.views.list` with our credentials,
-   * and return the names of all views of the log bucket
+   * and return all views of the log bucket of the project, or of the parent if given
+   *
+   * @returns List of discovered views, with their filters
+   */
+  getLogBucketViews(projectId: string, bucketId: string, parent?: string): Promise<LogView[]> {
+    return this.getResource(`logViews`, parent ? { "Parent": parent, "BucketId": bucketId } : { "ProjectId": projectId, "BucketId": bucketId });
+  }
+
+  /**
+   * Have the backend call `logs.list` with our credentials, and return the names of the
+   * logs of the project, or of the log bucket or view if given
+   *
+   * @returns List of log names, such as `projects/my-project/logs/syslog`
+   */
+  getLogNames(projectId: string, bucketId?: string, viewId?: string): Promise<string[]> {
+    const params: Record<string, string> = { "ProjectId": projectId };
+    if (bucketId) {
+      params["BucketId"] = bucketId;
+    }
+    if (viewId) {
+      params["ViewId"] = viewId;
+    }
+    return this.getResource(`logNames`, params);
+  }
+
+  /**
+   * Have the backend call `monitoredResourceDescriptors.list` with our credentials, and
+   * return the monitored resource types with their label keys
+   *
+   * @returns List of monitored resource descriptors
+   */
+  getResourceDescriptors(): Promise<MonitoredResourceDescriptor[]> {
+    return this.getResource(`resourceDescriptors`);
+  }
+
+  /**
+   * Have the backend sample the log entries of the last hour of the project, or of the log
+   * bucket or view if given, and return their resource types
+   *
+   * @returns List of resource types, the most frequent first
+   */
+  getResourceTypes(projectId: string, bucketId?: string, viewId?: string): Promise<string[]> {
+    const params: Record<string, string> = { "ProjectId": projectId };
+    if (bucketId) {
+      params["BucketId"] = bucketId;
+    }
+    if (viewId) {
+      params["ViewId"] = viewId;
+    }
+    return this.getResource(`resourceTypes`, params);
+  }
+
+  /**
+   * Have the backend sample the log entries of the query matching the filter in the time
+   * range, and return the most frequent values of a field, such as `jsonPayload.service`
+   *
+   * @returns List of field values with their counts, the most frequent first
+   */
+  getFieldValues(query: Query, field: string, range?: TimeRange, filter?: string): Promise<FieldValue[]> {
+    const params: Record<string, string> = { "ProjectId": query.projectId, "Field": field };
+    if (query.bucketId) {
+      params["BucketId"] = query.bucketId;
+    }
+    if (query.viewId) {
+      params["ViewId"] = query.viewId;
+    }
+    if (filter) {
+      params["Filter"] = filter;
+    }
+    if (range) {
+      params["From"] = range.from.toISOString();
+      params["To"] = range.to.toISOString();
+    }
+    return this.getResource(`fieldValues`, params);
+  }
+
+  /**
+   * Have the backend list the log scopes of a project with our credentials
+   *
+   * @returns List of log scopes with their projects and views
+   */
+  getLogScopes(projectId: string): Promise<LogScope[]> {
+    return this.getResource(`logScopes`, { "ProjectId": projectId });
+  }
+
+  /**
+   * Have the backend list the queries saved in the Logs Explorer with our credentials
+   *
+   * @returns List of saved queries with their filters
+   */
+  getSavedQueries(projectId: string): Promise<SavedQuery[]> {
+    return this.getResource(`savedQueries`, { "ProjectId": projectId });
+  }
+
+  /**
+   * Have the backend list the queries recently run in the Logs Explorer with our credentials
+   *
+   * @returns List of recent queries with their filters
+   */
+  getRecentQueries(projectId: string): Promise<RecentQuery[]> {
+    return this.getResource(`recentQueries`, { "ProjectId": projectId });
+  }
+
+  /**
+   * Have the backend call `sinks.list` with our credentials
+   *
+   * @param parent Project, folder or organization, such as `projects/my-project`
+   * @returns List of sinks with their destinations, filters and exclusions
+   */
+  getSinks(parent: string): Promise<Sink[]> {
+    return this.getResource(`sinks`, { "Parent": parent });
+  }
+
+  /**
+   * Have the backend call `exclusions.list` with our credentials
+   *
+   * @param parent Project, folder or organization, such as `folders/123`
+   * @returns List of exclusions with their filters
+   */
+  getExclusions(parent: string): Promise<Exclusion[]> {
+    return this.getResource(`exclusions`, { "Parent": parent });
+  }
+
+  /**
+   * Have the backend export the log entries of the query in the time range, without the
+   * limits of data frames, up to the maximum configured on the data source
    *
-   * @returns List of discovered bucket names
+   * @param limit Number of entries exported at most, if lower than the configured maximum
+   * @returns The log entries as NDJSON, one `LogEntry` per line, or as CSV
    */
-  getLogBucketViews(projectId: string, bucketId: string): Promise<string[]> {
-    return this.getResource(`logViews`, { "ProjectId": projectId, "BucketId": bucketId });
+  async exportLogs(query: Query, range: TimeRange, format: ExportFormat, limit?: number): Promise<Blob> {
+    const response = await lastValueFrom(getBackendSrv().fetch<Blob>({
+      url: `/api/datasources/uid/${this.uid}/resources/export`,
+      method: 'POST',
+      data: {
+        query: this.applyTemplateVariables(query, {}),
+        from: range.from.toISOString(),
+        to: range.to.toISOString(),
+        format,
+        limit,
+      },
+      responseType: 'blob',
+    }));
+    return response.data;
   }
 
   applyTemplateVariables(query: Query, scopedVars: ScopedVars): Query {
@@ -119,6 +311,10 @@ export class DataSource extends DataSourceWithBackend<Query, CloudLoggingOptions
       projectId: this.templateSrv.replace(query.projectId, scopedVars),
       bucketId: this.templateSrv.replace(query.bucketId, scopedVars),
       viewId: this.templateSrv.replace(query.viewId, scopedVars),
+      logScope: this.templateSrv.replace(query.logScope, scopedVars),
+      parentId: this.templateSrv.replace(query.parentId, scopedVars),
+      parent: this.templateSrv.replace(query.parent, scopedVars),
+      sql: this.templateSrv.replace(query.sql, scopedVars),
     };
   }
 
@@ -23,6 +23,7 @@ import {
 
 export interface DataSourceSecureJsonData extends BaseDataSourceSecureJsonData {
   accessToken?: string;
+  proxyPassword?: string;
 }
 
 export const authTypes: Array<SelectableValue<string>> = [
@@ -30,6 +31,7 @@ export const authTypes: Array<SelectableValue<string>> = [
   { label: 'GCE Default Service Account', value: GoogleAuthType.GCE },
   { label: 'Access Token', value: 'accessToken' },
   { label: 'OAuth Passthrough', value: 'oauthPassthrough' },
+  { label: 'External Account', value: 'externalAccount' },
 ];
 
 /**
@@ -39,8 +41,228 @@ export interface DataSourceOptionsExt extends DataSourceOptions {
   gceDefaultProject?: string;
   serviceAccountToImpersonate?: string;
   usingImpersonation?: boolean;
+  impersonationDelegates?: string[];
+  impersonationScopes?: string[];
+  impersonationLifetime?: string;
   oauthPassThru?: boolean;
   universeDomain?: string;
+  redactionRules?: RedactionRule[];
+  externalAccount?: ExternalAccount;
+  accessTokenSource?: 'static' | 'file' | 'command';
+  accessTokenFile?: string;
+  accessTokenCommand?: string;
+  endpoints?: Endpoints;
+  proxy?: Proxy;
+  allowlist?: Allowlist;
+  retry?: RetryPolicy;
+  rateLimit?: RateLimit;
+  export?: ExportSettings;
+  // Folder, organization or billing account that the health check queries instead of the default project
+  defaultParentType?: ParentType;
+  defaultParentId?: string;
+}
+
+/**
+ * Limits of the exports of log entries
+ */
+export interface ExportSettings {
+  maxEntries?: number;
+}
+
+/**
+ * Client-side rate limit of the log entry requests
+ */
+export interface RateLimit {
+  requestsPerMinute?: number;
+  burst?: number;
+  queueTimeout?: string;
+  perProject?: boolean;
+}
+
+/**
+ * Retry policy of the Cloud Logging requests. Durations are strings such as 500ms or 2m
+ */
+export interface RetryPolicy {
+  maxAttempts?: number;
+  initialBackoff?: string;
+  maxBackoff?: string;
+  pageTimeout?: string;
+  totalTimeout?: string;
+}
+
+/**
+ * Projects, buckets and views the data source may query, as exact names or glob patterns
+ */
+export interface Allowlist {
+  projects?: string[];
+  buckets?: string[];
+  views?: string[];
+}
+
+/**
+ * HTTP CONNECT proxy for the Google Cloud API connections
+ */
+export interface Proxy {
+  url?: string;
+  username?: string;
+  noProxy?: string;
+}
+
+/**
+ * Custom API endpoints, as host:port
+ */
+export interface Endpoints {
+  logging?: string;
+  config?: string;
+  resourceManager?: string;
+  loggingRest?: string;
+  plaintext?: boolean;
+}
+
+/**
+ * Workload identity federation credential configuration
+ */
+export interface ExternalAccount {
+  audience: string;
+  subjectTokenType: string;
+  tokenUrl?: string;
+  serviceAccountImpersonationUrl?: string;
+  credentialSource: {
+    file?: string;
+    url?: string;
+    headers?: Record<string, string>;
+    executable?: { command: string; timeoutMillis?: number; outputFile?: string };
+    format?: { type: 'text' | 'json'; subjectTokenFieldName?: string };
+  };
+}
+
+/**
+ * Redaction rule applied by the backend to log messages and labels
+ */
+export interface RedactionRule {
+  name?: string;
+  preset?: 'email' | 'ip' | 'bearerToken' | 'apiKey' | 'creditCard';
+  pattern?: string;
+  replacement?: string;
+}
+
+/**
+ * Monitored resource type that logs can be written for, such as `k8s_container`
+ */
+export interface MonitoredResourceDescriptor {
+  type: string;
+  displayName: string;
+  description: string;
+  labelKeys: string[];
+}
+
+/**
+ * Distinct value of a field in sampled log entries, with its number of occurrences
+ */
+export interface FieldValue {
+  value: string;
+  count: number;
+}
+
+/**
+ * Query saved in the Logs Explorer
+ */
+export interface SavedQuery {
+  name: string;
+  displayName: string;
+  description: string;
+  filter: string;
+  visibility: 'SHARED' | 'PRIVATE';
+  updateTime: string;
+}
+
+/**
+ * Query recently run in the Logs Explorer
+ */
+export interface RecentQuery {
+  name: string;
+  filter: string;
+  lastRunTime: string;
+}
+
+/**
+ * Google Cloud project
+ */
+export interface Project {
+  id: string;
+  displayName: string;
+  // Folder or organization of the project, such as folders/123
+  parent: string;
+}
+
+/**
+ * Folder, or organization at the root of the resource hierarchy
+ */
+export interface Folder {
+  // Resource name, such as folders/123 or organizations/456
+  name: string;
+  displayName: string;
+  // Folder or organization of the folder, which organizations have none of
+  parent?: string;
+}
+
+/**
+ * Log bucket storing the log entries of a project
+ */
+export interface LogBucket {
+  id: string;
+  name: string;
+  description: string;
+  retentionDays: number;
+  lifecycleState: string;
+  locked: boolean;
+  analyticsEnabled: boolean;
+  kmsKeyName?: string;
+}
+
+/**
+ * View of a subset of the log entries of a log bucket
+ */
+export interface LogView {
+  id: string;
+  name: string;
+  description: string;
+  filter: string;
+}
+
+/**
+ * Group of projects and log views queried together
+ */
+export interface LogScope {
+  id: string;
+  name: string;
+  description: string;
+  // Projects and views of the log scope, such as projects/my-project
+  resourceNames: string[];
+}
+
+/**
+ * Exclusion of the log entries matching its filter from storage
+ */
+export interface Exclusion {
+  name: string;
+  description: string;
+  filter: string;
+  disabled: boolean;
+}
+
+/**
+ * Sink routing the log entries matching its filter to a destination
+ */
+export interface Sink {
+  name: string;
+  destination: string;
+  filter: string;
+  description: string;
+  disabled: boolean;
+  exclusions: Exclusion[];
+  writerIdentity: string;
+  includeChildren: boolean;
 }
 
 /**
@@ -52,8 +274,87 @@ export interface Query extends DataQuery {
   projectId: string;
   bucketId?: string;
   viewId?: string;
+  // ID of a log scope of the project, queried instead of the bucket and view
+  logScope?: string;
+  // What the logs of the query belong to, the project by default
+  parentType?: ParentType;
+  // ID of the folder, organization or billing account queried instead of the project
+  parentId?: string;
+  // Project, folder or organization of sinks and exclusions queries, such as folders/123
+  parent?: string;
+  // Log Analytics query of SQL queries
+  sql?: string;
+  // Whether SQL results are returned as a table or as time series
+  format?: SQLFormat;
+  // Whether the Error Reporting error groups of error log entries are looked up
+  errorGroups?: boolean;
+}
+
+/**
+ * What the logs of a query belong to
+ */
+export enum ParentType {
+  Project = 'project',
+  Folder = 'folder',
+  Organization = 'organization',
+  BillingAccount = 'billingAccount',
+}
+
+export const parentTypes: Array<SelectableValue<string>> = [
+  { label: 'Project', value: ParentType.Project },
+  { label: 'Folder', value: ParentType.Folder },
+  { label: 'Organization', value: ParentType.Organization },
+  { label: 'Billing account', value: ParentType.BillingAccount },
+];
+
+/**
+ * Collections of the parent types other than projects
+ */
+export const parentCollections: Record<string, string> = {
+  [ParentType.Folder]: 'folders',
+  [ParentType.Organization]: 'organizations',
+  [ParentType.BillingAccount]: 'billingAccounts',
+};
+
+export enum SQLFormat {
+  Table = 'table',
+  TimeSeries = 'time_series',
 }
 
+export const sqlFormats: Array<SelectableValue<string>> = [
+  { label: 'Table', value: SQLFormat.Table },
+  { label: 'Time series', value: SQLFormat.TimeSeries, description: 'Needs a TIMESTAMP column, with rows ordered by time' },
+];
+
+/**
+ * Formats of the exported log entries
+ */
+export enum ExportFormat {
+  NDJSON = 'ndjson',
+  CSV = 'csv',
+}
+
+/**
+ * Types of queries supported by the backend
+ */
+export enum QueryType {
+  Logs = 'logs',
+  Patterns = 'patterns',
+  Sinks = 'sinks',
+  Exclusions = 'exclusions',
+  LogBuckets = 'logBuckets',
+  SQL = 'sql',
+}
+
+export const queryTypes: Array<SelectableValue<string>> = [
+  { label: 'Logs', value: QueryType.Logs },
+  { label: 'Patterns', value: QueryType.Patterns, description: 'Group similar log messages into patterns' },
+  { label: 'Sinks', value: QueryType.Sinks, description: 'List the sinks routing logs to their destinations' },
+  { label: 'Exclusions', value: QueryType.Exclusions, description: 'List the exclusions of logs before storage' },
+  { label: 'Log buckets', value: QueryType.LogBuckets, description: 'List the log buckets of the project with their retention' },
+  { label: 'SQL', value: QueryType.SQL, description: 'Run a Log Analytics query on a bucket upgraded to Log Analytics' },
+];
+
 /**
  * Query that basically gets all logs
  */
@@ -82,6 +383,7 @@ export enum LogFindQueryScopes {
   Projects = 'projects',
   Buckets = 'buckets',
   Views = 'views',
+  LogScopes = 'logScopes',
 }
 
 /**